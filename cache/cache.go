@@ -5,16 +5,23 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
-	"regexp"
+	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 type Cache interface {
 	Get(req *http.Request) (Response, bool)
 	Save(res Response)
-	Purge(req *http.Request)
+	// Fill returns the writer of the body of the response, the latter being
+	// saved once the writer is committed
+	Fill(res Response) BodyWriter
+	// Purge removes the responses to the URL of the request, or only marks
+	// them stale when soft
+	Purge(req *http.Request, soft bool)
+	// PurgeTag removes the responses tagged with tag, or only marks them stale
+	// when soft, and returns their count
+	PurgeTag(tag string, soft bool) int
 }
 
 type Response struct {
@@ -26,22 +33,81 @@ type Response struct {
 	Body            []byte
 	Created         time.Time
 	Expires         time.Time
+	// Namespace keeps the response apart from the ones of other routes
+	Namespace string
+	// Host keeps the response apart from the ones of other hosts sharing the
+	// backend, empty when not set
+	Host string
+	// DefaultTTL overrides the default TTL of the cache for the response, in
+	// seconds, when not zero
+	DefaultTTL int
+	// IgnoreCacheControl makes the response fresh for its default TTL, whatever
+	// its Cache-Control and Expires headers
+	IgnoreCacheControl bool
+	// bodyPath is the file the body is read from instead of Body, for the
+	// responses stored on disk
+	bodyPath string
+}
+
+// responseOverhead roughly accounts for the memory used by a Response besides
+// its URL, headers and body.
+const responseOverhead = 256
+
+// size estimates the memory used by the response, in bytes.
+func (response Response) size() int64 {
+	size := int64(responseOverhead + len(response.Namespace) + len(response.Host) + len(response.URL) + len(response.Method) + len(response.Body))
+	for _, headers := range []http.Header{response.RequestHeaders, response.ResponseHeaders} {
+		for name, values := range headers {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+// OpenBody returns the reader of the body of the response, to be closed.
+func (response Response) OpenBody() (io.ReadSeekCloser, error) {
+	if response.bodyPath != "" {
+		return os.Open(response.bodyPath)
+	}
+	return bodyReader{bytes.NewReader(response.Body)}, nil
+}
+
+// bodyReader reads a body held in memory.
+type bodyReader struct {
+	*bytes.Reader
+}
+
+func (bodyReader) Close() error {
+	return nil
 }
 
 func AcceptsCache(req *http.Request) bool {
-	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) ||
-		req.Header.Get("Pragma") == "no-cache" ||
-		strings.Contains(req.Header.Get("Cache-Control"), "no-cache") ||
-		strings.Contains(req.Header.Get("Cache-Control"), "no-store") ||
-		strings.Contains(req.Header.Get("Cache-Control"), "max-age=0") ||
-		strings.Contains(req.Header.Get("Cache-Control"), "s-max-age=0") ||
+	return BypassReason(req) == ""
+}
+
+// BypassReason tells why the request can't be served from cache, following
+// the fwd values of the Cache-Status header (RFC 9211), or returns an empty
+// string if it can.
+func BypassReason(req *http.Request) string {
+	cacheControl := ParseCacheControl(req.Header)
+	maxAge, hasMaxAge := cacheControl.Duration("max-age")
+	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		log.Debugf("Request doesn't accept cache")
+		return "method"
+	}
+	if req.Header.Get("Pragma") == "no-cache" ||
+		cacheControl.Has("no-cache") ||
+		cacheControl.Has("no-store") ||
+		(hasMaxAge && maxAge == 0) ||
 		req.Header.Get("Authorization") != "" {
 		log.Debugf("Request doesn't accept cache")
-		return false
-	} else {
-		log.Debugf("Request accepts cache")
-		return true
+		return "request"
 	}
+	log.Debugf("Request accepts cache")
+	return ""
 }
 
 func IsValidForRequest(response Response, req *http.Request) bool {
@@ -49,57 +115,226 @@ func IsValidForRequest(response Response, req *http.Request) bool {
 		log.Debugf("Response too old for the request")
 		return false
 	}
-	if hasExpired(response) {
+	if hasExpired(response) && !acceptsStale(response, req) {
 		log.Debugf("Response expired")
 		return false
 	}
 	return true
 }
 
-func IsNotModified(req *http.Request) bool {
-	return req.Header.Get("If-Modified-Since") != "" ||
-		req.Header.Get("If-Unmodified-Since") != "" ||
-		req.Header.Get("If-None-Match") != "" ||
-		req.Header.Get("If-Match") != ""
+func IsCacheable(res *http.Response) bool {
+	return NotStoredReason(res) == ""
 }
 
-func IsCacheable(res *http.Response) bool {
-	if !isStatusCacheable(res.StatusCode) {
-		log.Debugf("Response status code non cacheable")
+// NotStoredReason tells why the response can't be stored in cache, or
+// returns an empty string if it can.
+func NotStoredReason(res *http.Response) string {
+	reason := StoragePolicy{}.NotStoredReason(res)
+	if reason != "" {
+		log.Debugf("Response non cacheable : %s", reason)
+	}
+	return reason
+}
+
+// MustRevalidate tells if the response can't be served stale without being
+// successfully revalidated first.
+func MustRevalidate(response Response) bool {
+	cacheControl := responseCacheControl(response)
+	return cacheControl.Has("must-revalidate") || cacheControl.Has("proxy-revalidate")
+}
+
+// CanServeStaleWhileRevalidate tells if the expired response can be served to
+// the request while it's revalidated in the background (RFC 5861).
+func CanServeStaleWhileRevalidate(response Response, req *http.Request) bool {
+	if isTooOldForRequest(response, req) || MustRevalidate(response) {
 		return false
 	}
-	if ttl, ok := getTTL(res.Header); ok && ttl == time.Duration(0) {
-		log.Debugf("Response non cacheable")
+	window, ok := responseCacheControl(response).Duration("stale-while-revalidate")
+	return ok && time.Now().Before(response.Expires.Add(window))
+}
+
+// CanServeStaleIfError tells if the expired response can be served to the
+// request instead of an error of the backend, as allowed by the response or
+// the request (RFC 5861).
+func CanServeStaleIfError(response Response, req *http.Request) bool {
+	if MustRevalidate(response) {
 		return false
 	}
-	return true
+	for _, cacheControl := range []CacheControl{responseCacheControl(response), ParseCacheControl(req.Header)} {
+		window, ok := cacheControl.Duration("stale-if-error")
+		if ok && time.Now().Before(response.Expires.Add(window)) {
+			return true
+		}
+	}
+	return false
 }
 
-func WriteResponse(rw http.ResponseWriter, response Response) {
+// WriteResponse writes the cached response, or the ranges of its body
+// requested, and returns the status code written.
+func WriteResponse(rw http.ResponseWriter, req *http.Request, response Response) int {
+	body, err := response.OpenBody()
+	if err != nil {
+		return writeBodyError(rw, response, err)
+	}
+	defer body.Close()
+	copyHeaders(rw, response)
+	return writeRangesOrBody(rw, req, response, body)
+}
+
+// WriteStaleResponse writes an expired response, warning the client about it.
+func WriteStaleResponse(rw http.ResponseWriter, req *http.Request, response Response) int {
+	body, err := response.OpenBody()
+	if err != nil {
+		return writeBodyError(rw, response, err)
+	}
+	defer body.Close()
+	copyHeaders(rw, response)
+	rw.Header().Set("Warning", "110 Caeche/1.0.0 \"This response comes from a stale cache\"") // https://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html#sec13.1.2
+	return writeRangesOrBody(rw, req, response, body)
+}
+
+// writeRangesOrBody writes the ranges requested out of a complete response,
+// which are advertised as supported, or the whole body otherwise.
+func writeRangesOrBody(rw http.ResponseWriter, req *http.Request, response Response, body io.ReadSeeker) int {
+	if response.StatusCode != http.StatusOK {
+		return writeBody(rw, response, body)
+	}
+	if rw.Header().Get("Accept-Ranges") == "" {
+		rw.Header().Set("Accept-Ranges", "bytes")
+	}
+	if !RangeApplies(req, response.ResponseHeaders) {
+		return writeBody(rw, response, body)
+	}
+	return writeRanges(rw, req, response, body)
+}
+
+// copyHeaders copies the headers of the cached response but its tags, along
+// with its current age. The cached values come before the ones already set,
+// like the Cache-Status of upstream caches before ours.
+func copyHeaders(rw http.ResponseWriter, response Response) {
 	for name, values := range response.ResponseHeaders {
-		for _, value := range values {
-			rw.Header().Set(name, value)
-		}
+		rw.Header()[name] = append(append([]string{}, values...), rw.Header()[name]...)
 	}
+	StripTags(rw.Header())
+	setAge(rw, response)
+}
+
+func setAge(rw http.ResponseWriter, response Response) {
+	rw.Header().Set("Age", strconv.Itoa(int(CurrentAge(response).Seconds())))
+}
+
+func writeBody(rw http.ResponseWriter, response Response, body io.Reader) int {
 	rw.WriteHeader(response.StatusCode)
-	_, err := io.Copy(rw, io.NopCloser(bytes.NewBuffer(response.Body)))
-	if err != nil {
-		log.Fatal(err)
+	if _, err := io.Copy(rw, body); err != nil {
+		log.Errorf("Writing %q : %s", response.URL, err)
+	}
+	return response.StatusCode
+}
+
+// writeBodyError answers with a 500 when the body of the response can't be
+// read, e.g. when it's removed from the disk just after its lookup.
+func writeBodyError(rw http.ResponseWriter, response Response, err error) int {
+	log.Errorf("Reading body of %q : %s", response.URL, err)
+	rw.WriteHeader(http.StatusInternalServerError)
+	return http.StatusInternalServerError
+}
+
+// setExpires sets when the response expires from its freshness lifetime, and
+// returns the latter. The default TTL of the response takes precedence over
+// the one of the cache.
+func setExpires(response *Response, defaultTTL int) time.Duration {
+	if response.DefaultTTL != 0 {
+		defaultTTL = response.DefaultTTL
+	}
+	ttl := time.Duration(defaultTTL) * time.Second
+	if !response.IgnoreCacheControl {
+		ttl = FreshnessLifetime(response.ResponseHeaders, ttl)
 	}
+	response.Expires = response.Created.Add(ttl)
+	return ttl
 }
 
+// responseCacheControl returns the Cache-Control directives of the response,
+// unless they're ignored.
+func responseCacheControl(response Response) CacheControl {
+	if response.IgnoreCacheControl {
+		return CacheControl{}
+	}
+	return ParseCacheControl(response.ResponseHeaders)
+}
+
+// isTooOldForRequest tells if the response doesn't satisfy the max-age or
+// min-fresh directives of the request.
 func isTooOldForRequest(response Response, req *http.Request) bool {
-	ttl, ok := getTTL(req.Header)
-	if ok {
-		return response.Created.Before(time.Now().Add(ttl * -1))
+	cacheControl := ParseCacheControl(req.Header)
+	if maxAge, ok := cacheControl.Duration("max-age"); ok && CurrentAge(response) > maxAge {
+		return true
+	}
+	if minFresh, ok := cacheControl.Duration("min-fresh"); ok && time.Until(response.Expires) < minFresh {
+		return true
 	}
 	return false
 }
 
+// acceptsStale tells if the max-stale directive of the request allows the
+// expired response to be served.
+func acceptsStale(response Response, req *http.Request) bool {
+	cacheControl := ParseCacheControl(req.Header)
+	if !cacheControl.Has("max-stale") || MustRevalidate(response) {
+		return false
+	}
+	if cacheControl["max-stale"] == "" {
+		return true
+	}
+	maxStale, ok := cacheControl.Duration("max-stale")
+	return ok && time.Since(response.Expires) <= maxStale
+}
+
 func hasExpired(response Response) bool {
 	return response.Expires.Before(time.Now().UTC())
 }
 
+// staleUntil returns the time until which the response may still be served
+// stale, by allowance of its headers.
+func staleUntil(response Response) time.Time {
+	if MustRevalidate(response) {
+		return response.Expires
+	}
+	cacheControl := responseCacheControl(response)
+	whileRevalidate, _ := cacheControl.Duration("stale-while-revalidate")
+	ifError, _ := cacheControl.Duration("stale-if-error")
+	if whileRevalidate > ifError {
+		return response.Expires.Add(whileRevalidate)
+	}
+	return response.Expires.Add(ifError)
+}
+
+// markStale expires the response now, so that it's revalidated on its next
+// request, while it can still be served stale as its stale-while-revalidate
+// and stale-if-error directives allow.
+func markStale(response *Response) {
+	if now := time.Now().UTC(); response.Expires.After(now) {
+		response.Expires = now
+	}
+}
+
+// isObsolete tells if the response can't be served anymore, even stale.
+func isObsolete(response Response) bool {
+	return staleUntil(response).Before(time.Now().UTC())
+}
+
+// retainUntil returns the time until which the response is kept in cache:
+// retention past the time it may be served stale, so that it's still served
+// when the backend is unreachable, or revalidated with its validators. A
+// response which must be revalidated, without validators, is useless once
+// expired.
+func retainUntil(response Response, retention time.Duration) time.Time {
+	if MustRevalidate(response) && !HasValidators(response) {
+		return response.Expires
+	}
+	return staleUntil(response).Add(retention)
+}
+
 func isStatusCacheable(status int) bool {
 	cacheableStatus := []int{200, 203, 204, 206, 300, 301, 404, 405, 410, 414, 501}
 	for _, v := range cacheableStatus {
@@ -109,35 +344,3 @@ func isStatusCacheable(status int) bool {
 	}
 	return false
 }
-
-func getTTL(headers http.Header) (time.Duration, bool) {
-	expires := headers.Get("If-Modified-Since")
-	if expires != "" {
-		expiresDate, err := http.ParseTime(expires)
-		if err == nil {
-			diff := expiresDate.UTC().Sub(time.Now().UTC())
-			if diff > 0 {
-				return diff, true
-			}
-		}
-	}
-
-	cacheControl := headers.Get("Cache-Control")
-	if cacheControl != "" {
-		if strings.Contains(cacheControl, "no-cache") ||
-			strings.Contains(cacheControl, "no-store") ||
-			strings.Contains(cacheControl, "private") {
-			return time.Duration(0), true
-		}
-		ageRegex := regexp.MustCompile(`s?-?max-age=(?P<TTL>\d+)`)
-		age := ageRegex.FindStringSubmatch(cacheControl)
-		if len(age) > 0 {
-			ageTTL, err := strconv.ParseInt(age[1], 10, 64)
-			if err == nil {
-				return time.Duration(ageTTL) * time.Second, true
-			}
-		}
-	}
-
-	return time.Duration(0), false
-}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the directives of the Cache-Control headers, by lowercase
+// name, with their unquoted argument if any.
+type CacheControl map[string]string
+
+// ParseCacheControl parses all the Cache-Control headers. When a directive is
+// repeated, its first occurrence wins.
+func ParseCacheControl(headers http.Header) CacheControl {
+	cacheControl := CacheControl{}
+	for _, value := range headers.Values("Cache-Control") {
+		for _, directive := range splitDirectives(value) {
+			name, argument := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, argument = directive[:i], strings.TrimSpace(directive[i+1:])
+				if unquoted, err := strconv.Unquote(argument); err == nil && strings.HasPrefix(argument, `"`) {
+					argument = unquoted
+				}
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, exists := cacheControl[name]; !exists {
+				cacheControl[name] = argument
+			}
+		}
+	}
+	return cacheControl
+}
+
+// Has tells if the directive is present.
+func (cacheControl CacheControl) Has(directive string) bool {
+	_, ok := cacheControl[directive]
+	return ok
+}
+
+// Duration returns the delta-seconds argument of the directive, if present
+// and valid.
+func (cacheControl CacheControl) Duration(directive string) (time.Duration, bool) {
+	argument, ok := cacheControl[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// splitDirectives splits a Cache-Control header on the commas which are not
+// inside a quoted string.
+func splitDirectives(value string) []string {
+	var directives []string
+	inQuotes, escaped, start := false, false, 0
+	for i, char := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\' && inQuotes:
+			escaped = true
+		case char == '"':
+			inQuotes = !inQuotes
+		case char == ',' && !inQuotes:
+			directives = append(directives, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(directives, strings.TrimSpace(value[start:]))
+}
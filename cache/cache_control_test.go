@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		headers  []string
+		expected CacheControl
+	}{
+		{
+			desc:     "No header",
+			headers:  []string{},
+			expected: CacheControl{},
+		},
+		{
+			desc:     "Directives with and without argument",
+			headers:  []string{"public, max-age=60, stale-while-revalidate=30"},
+			expected: CacheControl{"public": "", "max-age": "60", "stale-while-revalidate": "30"},
+		},
+		{
+			desc:     "Directive names are case insensitive",
+			headers:  []string{"No-Cache, MAX-AGE=60"},
+			expected: CacheControl{"no-cache": "", "max-age": "60"},
+		},
+		{
+			desc:     "Quoted argument with a comma",
+			headers:  []string{`private="Set-Cookie, X-Foo", max-age=10`},
+			expected: CacheControl{"private": "Set-Cookie, X-Foo", "max-age": "10"},
+		},
+		{
+			desc:     "Several headers",
+			headers:  []string{"max-age=10", "must-revalidate"},
+			expected: CacheControl{"max-age": "10", "must-revalidate": ""},
+		},
+		{
+			desc:     "First occurrence wins",
+			headers:  []string{"max-age=10, max-age=20"},
+			expected: CacheControl{"max-age": "10"},
+		},
+		{
+			desc:     "Empty directives are ignored",
+			headers:  []string{" , max-age=10,,"},
+			expected: CacheControl{"max-age": "10"},
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			headers := http.Header{}
+			for _, value := range test.headers {
+				headers.Add("Cache-Control", value)
+			}
+			assert.Equal(t, test.expected, ParseCacheControl(headers))
+		})
+	}
+}
+
+func TestCacheControlDuration(t *testing.T) {
+	cacheControl := CacheControl{"max-age": "60", "s-maxage": "abc", "stale-if-error": "-1", "no-cache": ""}
+
+	duration, ok := cacheControl.Duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, duration)
+
+	for _, directive := range []string{"s-maxage", "stale-if-error", "no-cache", "min-fresh"} {
+		_, ok := cacheControl.Duration(directive)
+		assert.False(t, ok, directive)
+	}
+}
@@ -100,15 +100,21 @@ func TestAcceptsCache(t *testing.T) {
 			expected: true,
 		},
 		{
-			desc:     "GET request with Cache-Control: s-max-age=0",
+			desc:     "GET request with Cache-Control: MAX-AGE=0",
 			method:   http.MethodGet,
-			headers:  map[string]string{"Cache-Control": "s-max-age=0"},
+			headers:  map[string]string{"Cache-Control": "MAX-AGE=0"},
 			expected: false,
 		},
 		{
-			desc:     "GET request with Cache-Control: s-max-age=60",
+			desc:     "GET request with Cache-Control: s-maxage=0, which only applies to responses",
 			method:   http.MethodGet,
-			headers:  map[string]string{"Cache-Control": "s-max-age=60"},
+			headers:  map[string]string{"Cache-Control": "s-maxage=0"},
+			expected: true,
+		},
+		{
+			desc:     "GET request with Cache-Control: max-age=600, min-fresh=10",
+			method:   http.MethodGet,
+			headers:  map[string]string{"Cache-Control": "max-age=600, min-fresh=10"},
 			expected: true,
 		},
 		{
@@ -148,8 +154,8 @@ func TestIsValidForRequest(t *testing.T) {
 			expected:  true,
 		},
 		{
-			desc:      "Valid response for a request with Cache-Control: s-max-age=3600",
-			headers:   map[string]string{"Cache-Control": "s-max-age=3600"},
+			desc:      "Valid response for a request with Cache-Control: s-maxage=10, which only applies to responses",
+			headers:   map[string]string{"Cache-Control": "s-maxage=10"},
 			expiresIn: 60,
 			expected:  true,
 		},
@@ -160,9 +166,33 @@ func TestIsValidForRequest(t *testing.T) {
 			expected:  false,
 		},
 		{
-			desc:      "Response too old for a request with Cache-Control: s-max-age=10",
-			headers:   map[string]string{"Cache-Control": "s-max-age=10"},
+			desc:      "Response not fresh enough for a request with Cache-Control: min-fresh=120",
+			headers:   map[string]string{"Cache-Control": "min-fresh=120"},
+			expiresIn: 60,
+			expected:  false,
+		},
+		{
+			desc:      "Response fresh enough for a request with Cache-Control: min-fresh=30",
+			headers:   map[string]string{"Cache-Control": "min-fresh=30"},
 			expiresIn: 60,
+			expected:  true,
+		},
+		{
+			desc:      "Expired response for a request with Cache-Control: max-stale",
+			headers:   map[string]string{"Cache-Control": "max-stale"},
+			expiresIn: 10 * -1,
+			expected:  true,
+		},
+		{
+			desc:      "Expired response for a request with Cache-Control: max-stale=30",
+			headers:   map[string]string{"Cache-Control": "max-stale=30"},
+			expiresIn: 10 * -1,
+			expected:  true,
+		},
+		{
+			desc:      "Response expired for too long for a request with Cache-Control: max-stale=5",
+			headers:   map[string]string{"Cache-Control": "max-stale=5"},
+			expiresIn: 10 * -1,
 			expected:  false,
 		},
 		{
@@ -199,7 +229,7 @@ func TestIsValidForRequest(t *testing.T) {
 }
 
 func TestStatusIsCacheable(t *testing.T) {
-	testCases := map[int]bool{200: true, 201: false, 202: false, 203: true, 204: true, 205: false, 206: true, 207: false, 208: false, 226: false,
+	testCases := map[int]bool{200: true, 201: false, 202: false, 203: true, 204: true, 205: false, 206: false, 207: false, 208: false, 226: false,
 		300: true, 301: true, 302: false, 303: false, 304: false, 305: false, 306: false, 307: false, 308: false,
 		400: false, 401: false, 402: false, 403: false, 404: true, 405: true, 406: false, 407: false, 408: false, 409: false, 410: true, 411: false, 412: false, 413: false, 414: true, 415: false, 416: false, 417: false, 418: false, 421: false, 422: false, 423: false, 424: false, 425: false, 426: false, 427: false, 428: false, 429: false, 431: false, 451: false,
 		500: false, 501: true, 502: false, 503: false, 504: false, 505: false, 506: false, 507: false, 508: false, 509: false, 510: false, 511: false,
@@ -211,6 +241,7 @@ func TestStatusIsCacheable(t *testing.T) {
 		} else {
 			desc = "%d is not cacheable"
 		}
+		status, cacheable := status, cacheable
 		t.Run(desc, func(t *testing.T) {
 			t.Parallel()
 			res := http.Response{StatusCode: status}
@@ -256,8 +287,48 @@ func TestIsCacheable(t *testing.T) {
 			expected: false,
 		},
 		{
-			desc:     "Response with Cache-Control: s-max-age=0 isn't cacheable",
-			headers:  map[string]string{"Cache-Control": "s-max-age=0"},
+			desc:     "Response with Cache-Control: s-maxage=0 isn't cacheable",
+			headers:  map[string]string{"Cache-Control": "s-maxage=0"},
+			expected: false,
+		},
+		{
+			desc:     "Response with Cache-Control: max-age=0, s-maxage=60 is cacheable",
+			headers:  map[string]string{"Cache-Control": "max-age=0, s-maxage=60"},
+			expected: true,
+		},
+		{
+			desc:     "Response with Cache-Control: public, max-age=3600 is cacheable",
+			headers:  map[string]string{"Cache-Control": "public, max-age=3600"},
+			expected: true,
+		},
+		{
+			desc:     "Response with Cache-Control: Private isn't cacheable",
+			headers:  map[string]string{"Cache-Control": "Private"},
+			expected: false,
+		},
+		{
+			desc:     "Response with an Expires header in the past isn't cacheable",
+			headers:  map[string]string{"Expires": "Thu, 01 Jan 1970 00:00:00 GMT"},
+			expected: false,
+		},
+		{
+			desc:     "Response with an invalid Expires header isn't cacheable",
+			headers:  map[string]string{"Expires": "0"},
+			expected: false,
+		},
+		{
+			desc:     "Response with If-Modified-Since header is cacheable",
+			headers:  map[string]string{"If-Modified-Since": "Thu, 01 Jan 1970 00:00:00 GMT"},
+			expected: true,
+		},
+		{
+			desc:     "Response with Vary: Accept-Encoding is cacheable",
+			headers:  map[string]string{"Vary": "Accept-Encoding"},
+			expected: true,
+		},
+		{
+			desc:     "Response with Vary: * isn't cacheable",
+			headers:  map[string]string{"Vary": "*"},
 			expected: false,
 		},
 	}
@@ -278,3 +349,196 @@ func TestIsCacheable(t *testing.T) {
 		})
 	}
 }
+
+func TestCanServeStaleWhileRevalidate(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		cacheControl   string
+		requestHeaders map[string]string
+		expiredFor     int
+		expected       bool
+	}{
+		{
+			desc:         "Expired response within the stale-while-revalidate window",
+			cacheControl: "max-age=60, stale-while-revalidate=30",
+			expiredFor:   10,
+			expected:     true,
+		},
+		{
+			desc:         "Expired response out of the stale-while-revalidate window",
+			cacheControl: "max-age=60, stale-while-revalidate=30",
+			expiredFor:   40,
+			expected:     false,
+		},
+		{
+			desc:         "Expired response without stale-while-revalidate",
+			cacheControl: "max-age=60",
+			expiredFor:   10,
+			expected:     false,
+		},
+		{
+			desc:         "Expired response which must be revalidated",
+			cacheControl: "max-age=60, stale-while-revalidate=30, must-revalidate",
+			expiredFor:   10,
+			expected:     false,
+		},
+		{
+			desc:           "Expired response too old for the request",
+			cacheControl:   "max-age=60, stale-while-revalidate=30",
+			requestHeaders: map[string]string{"Cache-Control": "max-age=30"},
+			expiredFor:     10,
+			expected:       false,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			response := Response{
+				ResponseHeaders: http.Header{"Cache-Control": {test.cacheControl}},
+				Created:         time.Now().Add(time.Duration(-60-test.expiredFor) * time.Second),
+				Expires:         time.Now().Add(time.Duration(-test.expiredFor) * time.Second),
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			for k, v := range test.requestHeaders {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, test.expected, CanServeStaleWhileRevalidate(response, req))
+		})
+	}
+}
+
+func TestCanServeStaleIfError(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		cacheControl   string
+		requestHeaders map[string]string
+		expiredFor     int
+		expected       bool
+	}{
+		{
+			desc:         "Expired response within the stale-if-error window",
+			cacheControl: "max-age=60, stale-if-error=300",
+			expiredFor:   100,
+			expected:     true,
+		},
+		{
+			desc:         "Expired response out of the stale-if-error window",
+			cacheControl: "max-age=60, stale-if-error=300",
+			expiredFor:   400,
+			expected:     false,
+		},
+		{
+			desc:           "Expired response within the stale-if-error window of the request",
+			cacheControl:   "max-age=60",
+			requestHeaders: map[string]string{"Cache-Control": "stale-if-error=300"},
+			expiredFor:     100,
+			expected:       true,
+		},
+		{
+			desc:         "Expired response without stale-if-error",
+			cacheControl: "max-age=60",
+			expiredFor:   10,
+			expected:     false,
+		},
+		{
+			desc:         "Expired response which must be revalidated",
+			cacheControl: "max-age=60, stale-if-error=300, proxy-revalidate",
+			expiredFor:   10,
+			expected:     false,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			response := Response{
+				ResponseHeaders: http.Header{"Cache-Control": {test.cacheControl}},
+				Expires:         time.Now().Add(time.Duration(-test.expiredFor) * time.Second),
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			for k, v := range test.requestHeaders {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, test.expected, CanServeStaleIfError(response, req))
+		})
+	}
+}
+
+func TestWriteStaleResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	WriteStaleResponse(recorder, httptest.NewRequest(http.MethodGet, "/", nil), Response{
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Age": {"5"}},
+		Body:            []byte("stale"),
+		Created:         time.Now().Add(-90 * time.Second),
+	})
+	assert.Equal(t, "90", recorder.Header().Get("Age"))
+	assert.Contains(t, recorder.Header().Get("Warning"), "110")
+	assert.Equal(t, "stale", recorder.Body.String())
+}
+
+func TestWriteResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Cache-Status", "caeche; hit")
+	WriteResponse(recorder, httptest.NewRequest(http.MethodGet, "/", nil), Response{
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Age": {"5"}, "Cache-Status": {"upstream; fwd=uri-miss"}},
+		Body:            []byte("fresh"),
+		Created:         time.Now().Add(-30 * time.Second),
+	})
+	assert.Equal(t, "30", recorder.Header().Get("Age"))
+	assert.Equal(t, []string{"upstream; fwd=uri-miss", "caeche; hit"}, recorder.Header().Values("Cache-Status"))
+	assert.Equal(t, "fresh", recorder.Body.String())
+}
+
+func TestBypassReason(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		method   string
+		headers  map[string]string
+		expected string
+	}{
+		{desc: "GET request", method: http.MethodGet, expected: ""},
+		{desc: "POST request", method: http.MethodPost, expected: "method"},
+		{desc: "Request with no-cache", method: http.MethodGet, headers: map[string]string{"Cache-Control": "no-cache"}, expected: "request"},
+		{desc: "Request with Authorization", method: http.MethodGet, headers: map[string]string{"Authorization": "Basic"}, expected: "request"},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(test.method, "/", nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, test.expected, BypassReason(req))
+		})
+	}
+}
+
+func TestNotStoredReason(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		status   int
+		headers  map[string]string
+		expected string
+	}{
+		{desc: "Cacheable response", status: http.StatusOK, expected: ""},
+		{desc: "Non cacheable status", status: http.StatusInternalServerError, expected: "status"},
+		{desc: "Vary on every header", status: http.StatusOK, headers: map[string]string{"Vary": "*"}, expected: "vary"},
+		{desc: "Private response", status: http.StatusOK, headers: map[string]string{"Cache-Control": "private"}, expected: "private"},
+		{desc: "Already expired response", status: http.StatusOK, headers: map[string]string{"Cache-Control": "max-age=0"}, expected: "expired"},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			res := http.Response{StatusCode: test.status, Header: http.Header{}}
+			for k, v := range test.headers {
+				res.Header.Set(k, v)
+			}
+			assert.Equal(t, test.expected, NotStoredReason(&res))
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// notModifiedHeaders are the headers of a response which are sent along with
+// a 304 Not Modified (RFC 9110, section 15.4.5).
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"}
+
+// IsNotModified tells if the cached response matches the If-None-Match or
+// If-Modified-Since headers of the request, so that a 304 Not Modified can be
+// sent instead (RFC 9110, section 13.2.2).
+func IsNotModified(req *http.Request, response Response) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return matchesETag(ifNoneMatch, response.ResponseHeaders.Get("ETag"), false)
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(response.ResponseHeaders.Get("Last-Modified"))
+		return err == nil && !lastModified.After(since)
+	}
+	return false
+}
+
+// IsPreconditionFailed tells if the cached response doesn't match the If-Match
+// or If-Unmodified-Since headers of the request, so that a 412 Precondition
+// Failed must be sent instead (RFC 9110, section 13.2.2).
+func IsPreconditionFailed(req *http.Request, response Response) bool {
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		return !matchesETag(ifMatch, response.ResponseHeaders.Get("ETag"), true)
+	}
+	if ifUnmodifiedSince := req.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" {
+		since, err := http.ParseTime(ifUnmodifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(response.ResponseHeaders.Get("Last-Modified"))
+		return err != nil || lastModified.After(since)
+	}
+	return false
+}
+
+// HasValidators tells if the cached response can be revalidated with the
+// backend by a conditional request.
+func HasValidators(response Response) bool {
+	return response.ResponseHeaders.Get("ETag") != "" || response.ResponseHeaders.Get("Last-Modified") != ""
+}
+
+// SetValidators replaces the conditional headers of the request by the ones
+// revalidating the cached response, and returns the replaced headers.
+func SetValidators(req *http.Request, response Response) http.Header {
+	replaced := http.Header{}
+	for _, name := range conditionalHeaders {
+		if values := req.Header.Values(name); len(values) > 0 {
+			replaced[name] = values
+			req.Header.Del(name)
+		}
+	}
+	if etag := response.ResponseHeaders.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := response.ResponseHeaders.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return replaced
+}
+
+// RestoreConditionalHeaders puts back the conditional headers replaced by
+// SetValidators.
+func RestoreConditionalHeaders(req *http.Request, replaced http.Header) {
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+	for name, values := range replaced {
+		req.Header[name] = values
+	}
+}
+
+// Refresh updates the cached response with the headers of the 304 Not
+// Modified it was revalidated with, created at the given time (RFC 9111,
+// section 4.3.4).
+func Refresh(response Response, notModified *http.Response, created time.Time) Response {
+	headers := response.ResponseHeaders.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for name, values := range notModified.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		headers[name] = values
+	}
+	response.ResponseHeaders = headers
+	response.Created = created
+	response.Expires = time.Time{}
+	return response
+}
+
+// WriteNotModified writes a 304 Not Modified for the cached response.
+func WriteNotModified(rw http.ResponseWriter, response Response) {
+	for _, name := range notModifiedHeaders {
+		if values := response.ResponseHeaders.Values(name); len(values) > 0 {
+			rw.Header()[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	setAge(rw, response)
+	rw.WriteHeader(http.StatusNotModified)
+}
+
+// matchesETag tells if the entity-tag of an existing response is listed in the
+// If-Match or If-None-Match header value, using the strong or weak comparison.
+func matchesETag(header string, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
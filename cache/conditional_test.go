@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+	before       = "Tue, 20 Oct 2015 07:28:00 GMT"
+	after        = "Thu, 22 Oct 2015 07:28:00 GMT"
+)
+
+func TestIsNotModified(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		method          string
+		requestHeaders  map[string]string
+		responseHeaders map[string]string
+		expected        bool
+	}{
+		{
+			desc:            "No conditional header",
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        false,
+		},
+		{
+			desc:            "If-None-Match with the same ETag",
+			requestHeaders:  map[string]string{"If-None-Match": `"abc"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        true,
+		},
+		{
+			desc:            "If-None-Match with another ETag",
+			requestHeaders:  map[string]string{"If-None-Match": `"def"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        false,
+		},
+		{
+			desc:            "If-None-Match with a list containing the ETag",
+			requestHeaders:  map[string]string{"If-None-Match": `"def", "abc"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        true,
+		},
+		{
+			desc:            "If-None-Match uses the weak comparison",
+			requestHeaders:  map[string]string{"If-None-Match": `W/"abc"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        true,
+		},
+		{
+			desc:            "If-None-Match: *",
+			requestHeaders:  map[string]string{"If-None-Match": "*"},
+			responseHeaders: map[string]string{},
+			expected:        true,
+		},
+		{
+			desc:            "If-None-Match without ETag in response",
+			requestHeaders:  map[string]string{"If-None-Match": `"abc"`},
+			responseHeaders: map[string]string{},
+			expected:        false,
+		},
+		{
+			desc:            "If-None-Match takes precedence over If-Modified-Since",
+			requestHeaders:  map[string]string{"If-None-Match": `"def"`, "If-Modified-Since": after},
+			responseHeaders: map[string]string{"ETag": `"abc"`, "Last-Modified": lastModified},
+			expected:        false,
+		},
+		{
+			desc:            "If-Modified-Since after Last-Modified",
+			requestHeaders:  map[string]string{"If-Modified-Since": after},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        true,
+		},
+		{
+			desc:            "If-Modified-Since equal to Last-Modified",
+			requestHeaders:  map[string]string{"If-Modified-Since": lastModified},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        true,
+		},
+		{
+			desc:            "If-Modified-Since before Last-Modified",
+			requestHeaders:  map[string]string{"If-Modified-Since": before},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        false,
+		},
+		{
+			desc:            "If-Modified-Since without Last-Modified in response",
+			requestHeaders:  map[string]string{"If-Modified-Since": after},
+			responseHeaders: map[string]string{},
+			expected:        false,
+		},
+		{
+			desc:            "Invalid If-Modified-Since",
+			requestHeaders:  map[string]string{"If-Modified-Since": "yesterday"},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        false,
+		},
+		{
+			desc:            "If-None-Match on a POST request",
+			method:          http.MethodPost,
+			requestHeaders:  map[string]string{"If-None-Match": `"abc"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        false,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "http://localhost", nil)
+			for k, v := range test.requestHeaders {
+				req.Header.Set(k, v)
+			}
+			response := Response{ResponseHeaders: http.Header{}}
+			for k, v := range test.responseHeaders {
+				response.ResponseHeaders.Set(k, v)
+			}
+			assert.Equal(t, test.expected, IsNotModified(req, response))
+		})
+	}
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		requestHeaders  map[string]string
+		responseHeaders map[string]string
+		expected        bool
+	}{
+		{
+			desc:            "No conditional header",
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        false,
+		},
+		{
+			desc:            "If-Match with the same ETag",
+			requestHeaders:  map[string]string{"If-Match": `"abc"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        false,
+		},
+		{
+			desc:            "If-Match with another ETag",
+			requestHeaders:  map[string]string{"If-Match": `"def"`},
+			responseHeaders: map[string]string{"ETag": `"abc"`},
+			expected:        true,
+		},
+		{
+			desc:            "If-Match uses the strong comparison",
+			requestHeaders:  map[string]string{"If-Match": `W/"abc"`},
+			responseHeaders: map[string]string{"ETag": `W/"abc"`},
+			expected:        true,
+		},
+		{
+			desc:            "If-Match: *",
+			requestHeaders:  map[string]string{"If-Match": "*"},
+			responseHeaders: map[string]string{},
+			expected:        false,
+		},
+		{
+			desc:            "If-Unmodified-Since after Last-Modified",
+			requestHeaders:  map[string]string{"If-Unmodified-Since": after},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        false,
+		},
+		{
+			desc:            "If-Unmodified-Since before Last-Modified",
+			requestHeaders:  map[string]string{"If-Unmodified-Since": before},
+			responseHeaders: map[string]string{"Last-Modified": lastModified},
+			expected:        true,
+		},
+		{
+			desc:            "If-Unmodified-Since without Last-Modified in response",
+			requestHeaders:  map[string]string{"If-Unmodified-Since": after},
+			responseHeaders: map[string]string{},
+			expected:        true,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			for k, v := range test.requestHeaders {
+				req.Header.Set(k, v)
+			}
+			response := Response{ResponseHeaders: http.Header{}}
+			for k, v := range test.responseHeaders {
+				response.ResponseHeaders.Set(k, v)
+			}
+			assert.Equal(t, test.expected, IsPreconditionFailed(req, response))
+		})
+	}
+}
+
+func TestSetAndRestoreValidators(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("If-None-Match", `"client"`)
+	req.Header.Set("If-Unmodified-Since", before)
+	response := Response{ResponseHeaders: http.Header{"Etag": {`"abc"`}, "Last-Modified": {lastModified}}}
+
+	replaced := SetValidators(req, response)
+	assert.Equal(t, `"abc"`, req.Header.Get("If-None-Match"))
+	assert.Equal(t, lastModified, req.Header.Get("If-Modified-Since"))
+	assert.Empty(t, req.Header.Get("If-Unmodified-Since"))
+
+	RestoreConditionalHeaders(req, replaced)
+	assert.Equal(t, `"client"`, req.Header.Get("If-None-Match"))
+	assert.Equal(t, before, req.Header.Get("If-Unmodified-Since"))
+	assert.Empty(t, req.Header.Get("If-Modified-Since"))
+}
+
+func TestRefresh(t *testing.T) {
+	headers := http.Header{"Etag": {`"abc"`}, "Cache-Control": {"max-age=60"}, "Content-Length": {"4"}}
+	response := Response{
+		ResponseHeaders: headers,
+		Body:            []byte("body"),
+		Created:         time.Now().Add(-time.Hour),
+		Expires:         time.Now().Add(-time.Minute),
+	}
+	date := time.Now()
+	refreshed := Refresh(response, &http.Response{
+		StatusCode: http.StatusNotModified,
+		Header:     http.Header{"Cache-Control": {"max-age=120"}, "Content-Length": {"0"}},
+	}, date)
+
+	assert.Equal(t, "max-age=120", refreshed.ResponseHeaders.Get("Cache-Control"))
+	assert.Equal(t, `"abc"`, refreshed.ResponseHeaders.Get("ETag"))
+	assert.Equal(t, "4", refreshed.ResponseHeaders.Get("Content-Length"))
+	assert.Equal(t, "body", string(refreshed.Body))
+	assert.Equal(t, date, refreshed.Created)
+	assert.Equal(t, "max-age=60", headers.Get("Cache-Control"), "The cached headers shouldn't be modified in place")
+}
+
+func TestWriteNotModified(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	WriteNotModified(recorder, Response{
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Etag": {`"abc"`}, "Content-Type": {"text/plain"}},
+		Body:            []byte("body"),
+	})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, `"abc"`, recorder.Header().Get("ETag"))
+	assert.Empty(t, recorder.Header().Get("Content-Type"))
+	assert.Empty(t, recorder.Body.String())
+}
@@ -0,0 +1,604 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	bodyFileExt = ".body"
+	metaFileExt = ".meta"
+)
+
+// Disk stores the responses on the local disk so that they survive restarts:
+// each one in a metadata file, with its headers, and in the file of its body.
+// Writing a response only writes its own files, its body going to a new file
+// so that the responses being read keep their own. The last access to a
+// response is the modification time of its metadata file.
+type Disk struct {
+	DefaultTTL int
+	MaxSize    int64
+	MaxEntries int
+	path       string
+	mutex      sync.Mutex
+	entries    map[StorageKey]*diskEntry
+	variants   map[string][]StorageKey
+	tags       map[string]map[StorageKey]bool
+	recency    *list.List
+	elements   map[StorageKey]*list.Element
+	size       int64
+	evictions  int64
+	purges     int64
+}
+
+type diskEntry struct {
+	Key        StorageKey
+	Response   Response
+	BodyFile   string
+	BodySize   int64
+	LastAccess time.Time `json:"-"`
+}
+
+// metaFile returns the name of the metadata file of the entry, the same for
+// every response stored under its key.
+func (entry *diskEntry) metaFile() string {
+	return diskFileName(entry.Key) + metaFileExt
+}
+
+// newBodyFile returns a name of body file of the response stored under key,
+// which no other response has.
+func newBodyFile(key StorageKey) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%x%s", diskFileName(key), suffix, bodyFileExt), nil
+}
+
+func diskFileName(key StorageKey) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// NewDisk returns a cache stored in the directory at path, holding at most
+// maxSize bytes and maxEntries responses, the least recently used ones being
+// evicted first. A limit of 0 means unlimited. The responses already stored in
+// the directory are loaded.
+func NewDisk(path string, defaultTTL int, maxSize int64, maxEntries int) (*Disk, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	cache := &Disk{
+		DefaultTTL: defaultTTL,
+		MaxSize:    maxSize,
+		MaxEntries: maxEntries,
+		path:       path,
+		entries:    make(map[StorageKey]*diskEntry),
+		variants:   make(map[string][]StorageKey),
+		tags:       make(map[string]map[StorageKey]bool),
+		recency:    list.New(),
+		elements:   make(map[StorageKey]*list.Element),
+	}
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Get looks the response up in the index, its files being checked and
+// touched out of the lock.
+func (cache *Disk) Get(req *http.Request) (Response, bool) {
+	indexKey := requestIndexKey(req)
+	cache.mutex.Lock()
+	var found *diskEntry
+	for _, key := range cache.variants[indexKey] {
+		entry := cache.entries[key]
+		if entry.Response.Method == req.Method && matchesVary(entry.Response, req) {
+			found = entry
+			break
+		}
+	}
+	if found == nil {
+		cache.mutex.Unlock()
+		log.Debugf("Getting %q : Response not found in cache", indexKey)
+		return Response{}, false
+	}
+	found.LastAccess = time.Now()
+	cache.recency.MoveToFront(cache.elements[found.Key])
+	key, bodyFile, lastAccess := found.Key, found.BodyFile, found.LastAccess
+	metaPath := filepath.Join(cache.path, found.metaFile())
+	response := found.Response
+	cache.mutex.Unlock()
+
+	response.bodyPath = filepath.Join(cache.path, bodyFile)
+	if _, err := os.Stat(response.bodyPath); err != nil {
+		log.Errorf("Getting %q : Cannot find body : %s", key, err)
+		cache.removeWithBody(key, bodyFile)
+		return Response{}, false
+	}
+	touch(key, metaPath, lastAccess)
+	log.Debugf("Getting %q : Response retrieved", key)
+	return response, true
+}
+
+func (cache *Disk) Save(response Response) {
+	if response.bodyPath != "" && cache.refresh(response) {
+		return
+	}
+	if err := fill(cache, response); err != nil {
+		log.Errorf("Saving %q : %s", response.URL, err)
+	}
+}
+
+// Fill writes the body of the response to a temporary file, moved next to
+// the other bodies once committed.
+func (cache *Disk) Fill(response Response) BodyWriter {
+	file, err := ioutil.TempFile(cache.path, "fill.*.tmp")
+	return &diskBody{cache: cache, response: response, file: file, err: err}
+}
+
+// refresh saves the response again along with the body already stored for
+// it, e.g. once revalidated, and tells if it did.
+func (cache *Disk) refresh(response Response) bool {
+	key, ok := newStorageKey(response)
+	if !ok {
+		return false
+	}
+	ttl := setExpires(&response, cache.DefaultTTL)
+	bodyPath := response.bodyPath
+	response.bodyPath = ""
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, exists := cache.entries[key]
+	if !exists || filepath.Join(cache.path, entry.BodyFile) != bodyPath {
+		return false
+	}
+	cache.unindex(key)
+	refreshed := &diskEntry{
+		Key:        key,
+		Response:   response,
+		BodyFile:   entry.BodyFile,
+		BodySize:   entry.BodySize,
+		LastAccess: time.Now(),
+	}
+	cache.index(key, refreshed)
+	cache.persist(refreshed)
+	cache.evict()
+	log.Debugf("Saving %q : Response refreshed for %s", key, ttl)
+	return true
+}
+
+// store moves the body written to tempPath to a new body file, and indexes
+// the response, removing the body it replaces and the variants varying on
+// other headers.
+func (cache *Disk) store(response Response, tempPath string, bodySize int64) error {
+	defer os.Remove(tempPath)
+	key, ok := newStorageKey(response)
+	if !ok {
+		log.Debugf("Saving %q : Response varies on every header, not saved", response.URL)
+		return nil
+	}
+	if cache.MaxSize > 0 && response.size()+bodySize > cache.MaxSize {
+		log.Debugf("Saving %q : Response too large, not saved", key)
+		return nil
+	}
+	ttl := setExpires(&response, cache.DefaultTTL)
+	bodyFile, err := newBodyFile(key)
+	if err != nil {
+		return fmt.Errorf("cannot name body: %w", err)
+	}
+	if err := os.Rename(tempPath, filepath.Join(cache.path, bodyFile)); err != nil {
+		return fmt.Errorf("cannot write body: %w", err)
+	}
+
+	response.Body = nil
+	entry := &diskEntry{
+		Key:        key,
+		Response:   response,
+		BodyFile:   bodyFile,
+		BodySize:   bodySize,
+		LastAccess: time.Now(),
+	}
+	cache.mutex.Lock()
+	outdated := outdatedVariants(response, cache.variants[responseIndexKey(response)], func(key StorageKey) Response {
+		return cache.entries[key].Response
+	})
+	for _, variant := range outdated {
+		cache.remove(variant)
+		log.Debugf("Saving %q : Variant %q varying on other headers removed", key, variant)
+	}
+	replaced := cache.unindex(key)
+	cache.index(key, entry)
+	cache.persist(entry)
+	cache.evict()
+	cache.mutex.Unlock()
+	// The readers which opened the replaced body keep reading it
+	if replaced != nil {
+		removeFile(key, filepath.Join(cache.path, replaced.BodyFile))
+	}
+	log.Debugf("Saving %q : Response saved for %s", key, ttl)
+	return nil
+}
+
+func (cache *Disk) Purge(req *http.Request, soft bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	indexKey := requestIndexKey(req)
+	for _, key := range append([]StorageKey(nil), cache.variants[indexKey]...) {
+		cache.purge(key, soft)
+		log.Debugf("Purging %s", key)
+	}
+}
+
+func (cache *Disk) PurgeTag(tag string, soft bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	purged := 0
+	for key := range cache.tags[tag] {
+		cache.purge(key, soft)
+		purged++
+		log.Debugf("Purging %s tagged %q", key, tag)
+	}
+	return purged
+}
+
+func (cache *Disk) Entries() []Entry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entries := make([]Entry, 0, len(cache.entries))
+	for key, entry := range cache.entries {
+		entries = append(entries, newEntry(key, entry.Response, entry.Response.size()+entry.BodySize))
+	}
+	return entries
+}
+
+func (cache *Disk) Lookup(key StorageKey) (Response, bool) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		cache.mutex.Unlock()
+		return Response{}, false
+	}
+	response := entry.Response
+	response.bodyPath = filepath.Join(cache.path, entry.BodyFile)
+	cache.mutex.Unlock()
+	if _, err := os.Stat(response.bodyPath); err != nil {
+		log.Errorf("Looking up %q : Cannot find body : %s", key, err)
+		return Response{}, false
+	}
+	return response, true
+}
+
+// Walk calls fn out of the lock, with the responses cached when called whose
+// body is still there.
+func (cache *Disk) Walk(fn func(key StorageKey, response Response) error) error {
+	cache.mutex.Lock()
+	responses := make(map[StorageKey]Response, len(cache.entries))
+	for key, entry := range cache.entries {
+		response := entry.Response
+		response.bodyPath = filepath.Join(cache.path, entry.BodyFile)
+		responses[key] = response
+	}
+	cache.mutex.Unlock()
+	for key, response := range responses {
+		if _, err := os.Stat(response.bodyPath); err != nil {
+			continue
+		}
+		if err := fn(key, response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cache *Disk) Delete(match func(Entry) bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	deleted := 0
+	for key, entry := range cache.entries {
+		if match(newEntry(key, entry.Response, entry.Response.size()+entry.BodySize)) {
+			cache.remove(key)
+			cache.purges++
+			deleted++
+			log.Debugf("Deleting %s", key)
+		}
+	}
+	return deleted
+}
+
+func (cache *Disk) Expire(match func(Entry) bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	expired := 0
+	for key, entry := range cache.entries {
+		if match(newEntry(key, entry.Response, entry.Response.size()+entry.BodySize)) {
+			cache.purge(key, true)
+			expired++
+			log.Debugf("Expiring %s", key)
+		}
+	}
+	return expired
+}
+
+func (cache *Disk) Stats() Stats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return Stats{Entries: len(cache.entries), Size: cache.size, Evictions: cache.evictions, Purges: cache.purges}
+}
+
+// StartJanitor removes the responses which can't be served anymore, even
+// stale, and were retained for retention since, from the cache every interval,
+// until the returned function is called.
+func (cache *Disk) StartJanitor(interval time.Duration, retention time.Duration) func() {
+	return startJanitor(interval, func() { cache.removeObsolete(retention) })
+}
+
+func (cache *Disk) removeObsolete(retention time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now().UTC()
+	for key, entry := range cache.entries {
+		if retainUntil(entry.Response, retention).Before(now) {
+			cache.remove(key)
+			log.Debugf("Removing obsolete %s", key)
+		}
+	}
+}
+
+// load reads the metadata files of the responses stored in the directory,
+// dropping the ones whose body is missing and the bodies without metadata.
+func (cache *Disk) load() error {
+	metaFiles, err := filepath.Glob(filepath.Join(cache.path, "*"+metaFileExt))
+	if err != nil {
+		return err
+	}
+	var entries []*diskEntry
+	for _, metaFile := range metaFiles {
+		entry, err := readDiskEntry(metaFile)
+		if err != nil {
+			log.Warnf("Loading %s : %s, dropped", metaFile, err)
+			os.Remove(metaFile)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(cache.path, entry.BodyFile))
+		if err != nil {
+			log.Warnf("Loading %q : Body not found, dropped", entry.Key)
+			os.Remove(metaFile)
+			continue
+		}
+		entry.BodySize = info.Size()
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastAccess.Before(entries[j].LastAccess)
+	})
+	for _, entry := range entries {
+		cache.index(entry.Key, entry)
+	}
+	cache.evict()
+
+	bodyFiles, err := filepath.Glob(filepath.Join(cache.path, "*"+bodyFileExt))
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool, len(cache.entries))
+	for _, entry := range cache.entries {
+		indexed[entry.BodyFile] = true
+	}
+	for _, bodyFile := range bodyFiles {
+		if !indexed[filepath.Base(bodyFile)] {
+			log.Debugf("Removing orphan body %s", bodyFile)
+			os.Remove(bodyFile)
+		}
+	}
+	// The files being written when the proxy stopped
+	tempFiles, err := filepath.Glob(filepath.Join(cache.path, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, tempFile := range tempFiles {
+		os.Remove(tempFile)
+	}
+	log.Debugf("Loaded %d responses from %s", len(cache.entries), cache.path)
+	return nil
+}
+
+func readDiskEntry(metaFile string) (*diskEntry, error) {
+	data, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	var entry diskEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("cannot decode metadata: %w", err)
+	}
+	if entry.Key == "" || entry.BodyFile == "" {
+		return nil, errors.New("incomplete metadata")
+	}
+	info, err := os.Stat(metaFile)
+	if err != nil {
+		return nil, err
+	}
+	entry.LastAccess = info.ModTime()
+	return &entry, nil
+}
+
+// persist writes the metadata file of the entry.
+func (cache *Disk) persist(entry *diskEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Cannot encode metadata of %q : %s", entry.Key, err)
+		return
+	}
+	if err := writeFileAtomically(filepath.Join(cache.path, entry.metaFile()), data); err != nil {
+		log.Errorf("Cannot write metadata of %q : %s", entry.Key, err)
+	}
+}
+
+// touch records the access to the response stored under key, in the
+// modification time of its metadata file.
+func touch(key StorageKey, metaPath string, lastAccess time.Time) {
+	if err := os.Chtimes(metaPath, lastAccess, lastAccess); err != nil {
+		log.Debugf("Cannot touch metadata of %q : %s", key, err)
+	}
+}
+
+// evict drops the least recently used responses until the cache fits in its
+// limits.
+func (cache *Disk) evict() {
+	for (cache.MaxSize > 0 && cache.size > cache.MaxSize) ||
+		(cache.MaxEntries > 0 && len(cache.entries) > cache.MaxEntries) {
+		oldest := cache.recency.Back()
+		if oldest == nil {
+			return
+		}
+		key := oldest.Value.(StorageKey)
+		cache.remove(key)
+		cache.evictions++
+		log.Debugf("Evicting %s", key)
+	}
+}
+
+func (cache *Disk) index(key StorageKey, entry *diskEntry) {
+	cache.entries[key] = entry
+	indexKey := responseIndexKey(entry.Response)
+	cache.variants[indexKey] = append(cache.variants[indexKey], key)
+	tagKey(cache.tags, key, entry.Response)
+	cache.elements[key] = cache.recency.PushFront(key)
+	cache.size += entry.Response.size() + entry.BodySize
+}
+
+// unindex forgets about the response stored under key, without removing its
+// body file.
+func (cache *Disk) unindex(key StorageKey) *diskEntry {
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(cache.entries, key)
+	untagKey(cache.tags, key, entry.Response)
+	cache.recency.Remove(cache.elements[key])
+	delete(cache.elements, key)
+	cache.size -= entry.Response.size() + entry.BodySize
+
+	indexKey := responseIndexKey(entry.Response)
+	variants := cache.variants[indexKey]
+	for i, variant := range variants {
+		if variant == key {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(cache.variants, indexKey)
+	} else {
+		cache.variants[indexKey] = variants
+	}
+	return entry
+}
+
+func (cache *Disk) remove(key StorageKey) {
+	entry := cache.unindex(key)
+	if entry == nil {
+		return
+	}
+	for _, file := range []string{entry.metaFile(), entry.BodyFile} {
+		removeFile(key, filepath.Join(cache.path, file))
+	}
+}
+
+// removeWithBody removes the response stored under key, unless replaced by
+// one with another body since.
+func (cache *Disk) removeWithBody(key StorageKey, bodyFile string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry, ok := cache.entries[key]; ok && entry.BodyFile == bodyFile {
+		cache.remove(key)
+	}
+}
+
+func removeFile(key StorageKey, path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Cannot remove %s of %q : %s", filepath.Base(path), key, err)
+	}
+}
+
+// purge removes the response, or only marks it stale when soft.
+func (cache *Disk) purge(key StorageKey, soft bool) {
+	cache.purges++
+	if !soft {
+		cache.remove(key)
+		return
+	}
+	if entry, ok := cache.entries[key]; ok {
+		markStale(&entry.Response)
+		cache.persist(entry)
+	}
+}
+
+// diskBody writes the body of a response to a temporary file of the cache.
+type diskBody struct {
+	cache    *Disk
+	response Response
+	file     *os.File
+	size     int64
+	err      error
+}
+
+func (body *diskBody) Write(data []byte) (int, error) {
+	if body.err != nil {
+		return 0, body.err
+	}
+	if body.cache.MaxSize > 0 && body.size+int64(len(data)) > body.cache.MaxSize {
+		return 0, errBodyTooLarge
+	}
+	written, err := body.file.Write(data)
+	body.size += int64(written)
+	return written, err
+}
+
+func (body *diskBody) Commit() error {
+	if body.err != nil {
+		return body.err
+	}
+	if err := body.file.Close(); err != nil {
+		os.Remove(body.file.Name())
+		return err
+	}
+	return body.cache.store(body.response, body.file.Name(), body.size)
+}
+
+func (body *diskBody) Abort() {
+	if body.file != nil {
+		body.file.Close()
+		os.Remove(body.file.Name())
+	}
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
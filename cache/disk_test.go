@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDisk(t *testing.T, maxSize int64) (*Disk, string) {
+	path, err := ioutil.TempDir("", "caeche_disk_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+	cache, err := NewDisk(path, 3600, maxSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, path
+}
+
+func countBodyFiles(t *testing.T, path string) int {
+	return countFiles(t, path, "*.body")
+}
+
+func countFiles(t *testing.T, path string, pattern string) int {
+	files, err := filepath.Glob(filepath.Join(path, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestDiskGetNotFoundResponse(t *testing.T) {
+	cache, _ := newTestDisk(t, 0)
+	response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, Response{}, response)
+	assert.False(t, ok)
+}
+
+func TestDiskSaveAndGet(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.Save(Response{
+		URL:             "http://localhost/foo",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		RequestHeaders:  http.Header{"Accept-Language": {"fr"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Language"}, "Content-Type": {"text/plain"}},
+		Body:            []byte("bonjour"),
+		Created:         time.Now(),
+	})
+	assert.Equal(t, 1, countBodyFiles(t, path))
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Accept-Language", "fr")
+	response, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "bonjour", readBody(t, response))
+	assert.Equal(t, "text/plain", response.ResponseHeaders.Get("Content-Type"))
+	assert.True(t, response.Expires.After(time.Now()))
+
+	req.Header.Set("Accept-Language", "en")
+	_, ok = cache.Get(req)
+	assert.False(t, ok)
+}
+
+func TestDiskSurvivesRestart(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.Save(Response{
+		URL:        "http://localhost/foo",
+		Method:     http.MethodGet,
+		StatusCode: http.StatusOK,
+		Body:       []byte("foo"),
+		Created:    time.Now(),
+	})
+
+	reloaded, err := NewDisk(path, 3600, 0, 0)
+	assert.NoError(t, err)
+	response, ok := reloaded.Get(httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "foo", readBody(t, response))
+	assert.Equal(t, cache.size, reloaded.size)
+}
+
+func TestDiskDropsOrphansOnLoad(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.Save(Response{URL: "http://localhost/foo", Method: http.MethodGet, Body: []byte("foo"), Created: time.Now()})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "orphan.body"), []byte("orphan"), 0o644))
+	for _, entry := range cache.entries {
+		assert.NoError(t, os.Remove(filepath.Join(path, entry.BodyFile)))
+	}
+
+	reloaded, err := NewDisk(path, 3600, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.entries, 0)
+	assert.Equal(t, 0, countBodyFiles(t, path))
+	assert.Equal(t, 0, countFiles(t, path, "*.meta"))
+}
+
+func TestDiskWritesOneMetadataFilePerResponse(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	for _, p := range []string{"/a", "/b"} {
+		cache.Save(Response{URL: "http://localhost" + p, Method: http.MethodGet, Body: []byte(p), Created: time.Now()})
+	}
+	assert.Equal(t, 2, countFiles(t, path, "*.meta"))
+
+	cache.Purge(httptest.NewRequest("PURGE", "/a", nil), false)
+	assert.Equal(t, 1, countFiles(t, path, "*.meta"))
+	assert.Equal(t, 1, countBodyFiles(t, path))
+}
+
+func TestDiskRecencySurvivesRestart(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	for _, p := range []string{"/a", "/b"} {
+		cache.Save(Response{URL: "http://localhost" + p, Method: http.MethodGet, Body: []byte(p), Created: time.Now()})
+	}
+	for _, entry := range cache.entries {
+		lastAccess := time.Now().Add(-time.Hour)
+		if entry.Response.URL == "http://localhost/a" {
+			lastAccess = time.Now()
+		}
+		assert.NoError(t, os.Chtimes(filepath.Join(path, entry.metaFile()), lastAccess, lastAccess))
+	}
+
+	reloaded, err := NewDisk(path, 3600, 0, 1)
+	assert.NoError(t, err)
+	_, ok := reloaded.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.True(t, ok, "/a was accessed last")
+	_, ok = reloaded.Get(httptest.NewRequest(http.MethodGet, "/b", nil))
+	assert.False(t, ok, "/b should have been evicted")
+}
+
+func TestDiskPurgeRemovesAllVariants(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	for _, language := range []string{"fr", "en"} {
+		cache.Save(Response{
+			URL:             "http://localhost/foo",
+			Method:          http.MethodGet,
+			RequestHeaders:  http.Header{"Accept-Language": {language}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Body:            []byte(language),
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{URL: "http://localhost/bar", Method: http.MethodGet, Body: []byte("bar"), Created: time.Now()})
+	assert.Equal(t, 3, countBodyFiles(t, path))
+
+	cache.Purge(httptest.NewRequest("PURGE", "/foo", nil), false)
+	assert.Equal(t, 1, countBodyFiles(t, path))
+	assert.Len(t, cache.entries, 1)
+}
+
+func TestDiskSaveReplacesVariantsOfAnotherVary(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	for _, language := range []string{"fr", "en"} {
+		cache.Save(Response{
+			URL:             "http://localhost/foo",
+			Method:          http.MethodGet,
+			RequestHeaders:  http.Header{"Accept-Language": {language}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Body:            []byte(language),
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{URL: "http://localhost/foo", Method: http.MethodGet, Body: []byte("any"), Created: time.Now()})
+	assert.Len(t, cache.entries, 1)
+	assert.Equal(t, 1, countBodyFiles(t, path))
+	assert.Equal(t, 1, countFiles(t, path, "*.meta"))
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Accept-Language", "fr")
+	response, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "any", readBody(t, response))
+}
+
+func TestDiskEvictOverMaxSize(t *testing.T) {
+	body := make([]byte, 1000)
+	response := Response{URL: "http://localhost/a", Method: http.MethodGet, Body: body, Created: time.Now()}
+	cache, path := newTestDisk(t, 2*response.size()+10)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		cache.Save(Response{URL: "http://localhost" + p, Method: http.MethodGet, Body: body, Created: time.Now()})
+	}
+	assert.Len(t, cache.entries, 2)
+	assert.Equal(t, 2, countBodyFiles(t, path))
+	assert.LessOrEqual(t, cache.size, cache.MaxSize)
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.False(t, ok, "/a should have been evicted")
+}
+
+func TestDiskEvictOverMaxEntries(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.MaxEntries = 2
+	for _, p := range []string{"/a", "/b", "/c"} {
+		cache.Save(Response{URL: "http://localhost" + p, Method: http.MethodGet, Body: []byte(p), Created: time.Now()})
+	}
+	assert.Len(t, cache.entries, 2)
+	assert.Equal(t, 2, countBodyFiles(t, path))
+	assert.Equal(t, int64(1), cache.Stats().Evictions)
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.False(t, ok, "/a should have been evicted")
+}
+
+func TestDiskReplaceKeepsSizeAccurate(t *testing.T) {
+	cache, _ := newTestDisk(t, 0)
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodGet, Body: make([]byte, 1000), Created: time.Now()})
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodGet, Body: make([]byte, 10), Created: time.Now()})
+	assert.Len(t, cache.entries, 1)
+	cache.Purge(httptest.NewRequest("PURGE", "/", nil), false)
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func TestDiskReplaceKeepsBodyOfResponsesRead(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodGet, ResponseHeaders: http.Header{"Etag": {`"old"`}}, Body: []byte("old"), Created: time.Now()})
+	old, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, ok)
+	opened, err := old.OpenBody()
+	assert.NoError(t, err)
+	defer opened.Close()
+
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodGet, ResponseHeaders: http.Header{"Etag": {`"new"`}}, Body: []byte("new"), Created: time.Now()})
+	data, err := ioutil.ReadAll(opened)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data), "The body opened should be the one of its headers")
+	_, err = old.OpenBody()
+	assert.Error(t, err, "The replaced body should be removed")
+	assert.Equal(t, 1, countBodyFiles(t, path))
+
+	response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, `"new"`, response.ResponseHeaders.Get("Etag"))
+	assert.Equal(t, "new", readBody(t, response))
+	assert.False(t, cache.refresh(old), "A response should only be refreshed along with its own body")
+}
+
+func TestDiskJanitorRemovesExpiredResponses(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	cache.Save(Response{
+		URL:             "http://localhost/expired",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60"}},
+		Created:         time.Now().Add(-time.Hour),
+	})
+	stop := cache.StartJanitor(time.Millisecond, 0)
+	defer stop()
+	assert.Eventually(t, func() bool {
+		return countBodyFiles(t, path) == 0
+	}, time.Second, time.Millisecond)
+}
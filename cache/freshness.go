@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// heuristicFraction is the fraction of the time since its last modification a
+// response is considered fresh for, when its headers don't tell (RFC 9111,
+// section 4.2.2).
+const heuristicFraction = 10
+
+// FreshnessLifetime returns how long a response stays fresh after its
+// creation, as a shared cache (RFC 9111, section 4.2.1): from its s-maxage or
+// max-age directives, its Expires header, a heuristic on its Last-Modified
+// header, or else the default TTL.
+func FreshnessLifetime(headers http.Header, defaultTTL time.Duration) time.Duration {
+	if lifetime, ok := explicitFreshnessLifetime(headers); ok {
+		return lifetime
+	}
+	if lifetime, ok := heuristicFreshnessLifetime(headers); ok {
+		return lifetime
+	}
+	return defaultTTL
+}
+
+// CreationTime estimates when a response was generated by the origin server,
+// from its Date and Age headers and the times its request was sent and it was
+// received (RFC 9111, section 4.2.3). The current age of the response is the
+// time elapsed since then.
+func CreationTime(headers http.Header, requestTime time.Time, responseTime time.Time) time.Time {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(headers.Get("Date")); err == nil && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	correctedAge := ageValue(headers) + responseTime.Sub(requestTime)
+	if apparentAge > correctedAge {
+		return responseTime.Add(-apparentAge)
+	}
+	return responseTime.Add(-correctedAge)
+}
+
+// CurrentAge returns the time elapsed since the cached response was generated
+// by the origin server.
+func CurrentAge(response Response) time.Duration {
+	age := time.Since(response.Created)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// explicitFreshnessLifetime returns the freshness lifetime of a response set
+// by its headers, if any.
+func explicitFreshnessLifetime(headers http.Header) (time.Duration, bool) {
+	cacheControl := ParseCacheControl(headers)
+	if lifetime, ok := cacheControl.Duration("s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := cacheControl.Duration("max-age"); ok {
+		return lifetime, true
+	}
+	if expiresHeader := headers.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			// An invalid date, like "0", represents a time in the past
+			return 0, true
+		}
+		date, err := http.ParseTime(headers.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if lifetime := expires.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// heuristicFreshnessLifetime returns a fraction of the time elapsed between
+// the last modification of a response and its creation, if known.
+func heuristicFreshnessLifetime(headers http.Header) (time.Duration, bool) {
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+	date, err := http.ParseTime(headers.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if !date.After(lastModified) {
+		return 0, false
+	}
+	return (date.Sub(lastModified) / heuristicFraction).Truncate(time.Second), true
+}
+
+func ageValue(headers http.Header) time.Duration {
+	seconds, err := strconv.ParseInt(headers.Get("Age"), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2021, time.September, 1, 12, 0, 0, 0, time.UTC)
+	httpDate := func(d time.Duration) string {
+		return date.Add(d).Format(http.TimeFormat)
+	}
+	testCases := []struct {
+		desc     string
+		headers  map[string]string
+		expected time.Duration
+	}{
+		{
+			desc:     "No freshness information uses the default TTL",
+			headers:  map[string]string{},
+			expected: time.Hour,
+		},
+		{
+			desc:     "max-age",
+			headers:  map[string]string{"Cache-Control": "max-age=60"},
+			expected: 60 * time.Second,
+		},
+		{
+			desc:     "s-maxage takes precedence over max-age",
+			headers:  map[string]string{"Cache-Control": "max-age=60, s-maxage=120"},
+			expected: 120 * time.Second,
+		},
+		{
+			desc:     "s-maxage before max-age in the header",
+			headers:  map[string]string{"Cache-Control": "s-maxage=120, max-age=60"},
+			expected: 120 * time.Second,
+		},
+		{
+			desc:     "s-max-age is not a directive",
+			headers:  map[string]string{"Cache-Control": "s-max-age=120"},
+			expected: time.Hour,
+		},
+		{
+			desc:     "max-age takes precedence over Expires",
+			headers:  map[string]string{"Cache-Control": "max-age=60", "Date": httpDate(0), "Expires": httpDate(time.Hour)},
+			expected: 60 * time.Second,
+		},
+		{
+			desc:     "Invalid max-age is ignored",
+			headers:  map[string]string{"Cache-Control": "max-age=soon", "Date": httpDate(0), "Expires": httpDate(time.Minute)},
+			expected: time.Minute,
+		},
+		{
+			desc:     "Expires relative to Date",
+			headers:  map[string]string{"Date": httpDate(0), "Expires": httpDate(10 * time.Minute)},
+			expected: 10 * time.Minute,
+		},
+		{
+			desc:     "Expires before Date",
+			headers:  map[string]string{"Date": httpDate(0), "Expires": httpDate(-time.Minute)},
+			expected: 0,
+		},
+		{
+			desc:     "Invalid Expires means already expired",
+			headers:  map[string]string{"Date": httpDate(0), "Expires": "0"},
+			expected: 0,
+		},
+		{
+			desc:     "Heuristic from Last-Modified",
+			headers:  map[string]string{"Date": httpDate(0), "Last-Modified": httpDate(-10 * time.Hour)},
+			expected: time.Hour,
+		},
+		{
+			desc:     "Explicit freshness takes precedence over the heuristic",
+			headers:  map[string]string{"Cache-Control": "max-age=5", "Date": httpDate(0), "Last-Modified": httpDate(-10 * time.Hour)},
+			expected: 5 * time.Second,
+		},
+		{
+			desc:     "Last-Modified after Date uses the default TTL",
+			headers:  map[string]string{"Date": httpDate(0), "Last-Modified": httpDate(time.Hour)},
+			expected: time.Hour,
+		},
+		{
+			desc:     "If-Modified-Since is not Expires",
+			headers:  map[string]string{"Date": httpDate(0), "If-Modified-Since": httpDate(time.Minute)},
+			expected: time.Hour,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			headers := http.Header{}
+			for k, v := range test.headers {
+				headers.Set(k, v)
+			}
+			assert.Equal(t, test.expected, FreshnessLifetime(headers, time.Hour))
+		})
+	}
+}
+
+func TestCreationTime(t *testing.T) {
+	requestTime := time.Date(2021, time.September, 1, 12, 0, 0, 0, time.UTC)
+	httpDate := func(d time.Duration) string {
+		return requestTime.Add(d).Format(http.TimeFormat)
+	}
+	testCases := []struct {
+		desc          string
+		headers       map[string]string
+		responseDelay time.Duration
+		expectedAge   time.Duration
+	}{
+		{
+			desc:          "No Date nor Age: the age is the response delay",
+			headers:       map[string]string{},
+			responseDelay: 2 * time.Second,
+			expectedAge:   2 * time.Second,
+		},
+		{
+			desc:          "Date in the past gives an apparent age",
+			headers:       map[string]string{"Date": httpDate(-30 * time.Second)},
+			responseDelay: time.Second,
+			expectedAge:   31 * time.Second,
+		},
+		{
+			desc:          "Date in the future is ignored",
+			headers:       map[string]string{"Date": httpDate(time.Minute)},
+			responseDelay: time.Second,
+			expectedAge:   time.Second,
+		},
+		{
+			desc:          "Age header corrected by the response delay",
+			headers:       map[string]string{"Date": httpDate(0), "Age": "100"},
+			responseDelay: 2 * time.Second,
+			expectedAge:   102 * time.Second,
+		},
+		{
+			desc:          "Apparent age larger than the corrected Age",
+			headers:       map[string]string{"Date": httpDate(-300 * time.Second), "Age": "100"},
+			responseDelay: 2 * time.Second,
+			expectedAge:   302 * time.Second,
+		},
+		{
+			desc:          "Invalid Age is ignored",
+			headers:       map[string]string{"Age": "-5"},
+			responseDelay: time.Second,
+			expectedAge:   time.Second,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			headers := http.Header{}
+			for k, v := range test.headers {
+				headers.Set(k, v)
+			}
+			responseTime := requestTime.Add(test.responseDelay)
+			created := CreationTime(headers, requestTime, responseTime)
+			assert.Equal(t, test.expectedAge, responseTime.Sub(created))
+		})
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	assert.InDelta(t, float64(time.Minute), float64(CurrentAge(Response{Created: time.Now().Add(-time.Minute)})), float64(time.Second))
+	assert.Equal(t, time.Duration(0), CurrentAge(Response{Created: time.Now().Add(time.Minute)}))
+}
+
+func TestSetExpires(t *testing.T) {
+	created := time.Now()
+	response := Response{
+		ResponseHeaders: http.Header{"Cache-Control": {"s-maxage=60"}},
+		Created:         created,
+	}
+	assert.Equal(t, 60*time.Second, setExpires(&response, 3600))
+	assert.Equal(t, created.Add(60*time.Second), response.Expires)
+}
+
+func TestSetExpiresWithResponseDefaultTTL(t *testing.T) {
+	response := Response{Created: time.Now(), DefaultTTL: 60}
+	assert.Equal(t, 60*time.Second, setExpires(&response, 3600))
+
+	response.ResponseHeaders = http.Header{"Cache-Control": {"max-age=10"}}
+	assert.Equal(t, 10*time.Second, setExpires(&response, 3600), "Cache-Control takes precedence over the default TTL")
+}
@@ -1,86 +1,295 @@
 package cache
 
 import (
-	"crypto/sha256"
-	"encoding/json"
-	"fmt"
+	"container/list"
 	log "github.com/sirupsen/logrus"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 )
 
-type StorageKey string
-
 type InMemory struct {
 	DefaultTTL int
+	MaxSize    int64
+	MaxEntries int
+	mutex      sync.Mutex
 	store      map[StorageKey]Response
+	variants   map[string][]StorageKey
+	tags       map[string]map[StorageKey]bool
+	recency    *list.List
+	elements   map[StorageKey]*list.Element
+	size       int64
+	evictions  int64
+	purges     int64
 }
 
-func NewInMemory(defaultTTL int) *InMemory {
-	return &InMemory{
+// NewInMemory returns an in-memory cache holding at most maxSize bytes and
+// maxEntries responses, the least recently used ones being evicted first.
+// A limit of 0 means unlimited.
+func NewInMemory(defaultTTL int, maxSize int64, maxEntries int) *InMemory {
+	cache := &InMemory{
 		DefaultTTL: defaultTTL,
-		store:      make(map[StorageKey]Response),
+		MaxSize:    maxSize,
+		MaxEntries: maxEntries,
 	}
+	cache.SetStore(make(map[StorageKey]Response))
+	return cache
 }
 
 func (cache *InMemory) SetStore(store map[StorageKey]Response) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
 	cache.store = store
+	cache.variants = make(map[string][]StorageKey)
+	cache.tags = make(map[string]map[StorageKey]bool)
+	cache.recency = list.New()
+	cache.elements = make(map[StorageKey]*list.Element)
+	cache.size = 0
+	for key, response := range store {
+		cache.index(key, response)
+	}
 }
 
 func (cache *InMemory) Get(req *http.Request) (Response, bool) {
-	key := cache.newStorageKeyFromRequest(req)
-	response, ok := cache.store[key]
-	if !ok {
-		log.Debugf("Getting %q : Response not found in cache", key)
-		return response, ok
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	indexKey := requestIndexKey(req)
+	for _, key := range cache.variants[indexKey] {
+		response := cache.store[key]
+		if response.Method == req.Method && matchesVary(response, req) {
+			cache.recency.MoveToFront(cache.elements[key])
+			log.Debugf("Getting %q : Response retrieved", key)
+			return response, true
+		}
 	}
-	log.Debugf("Getting %q : Response retrieved", key)
-	return response, ok
+	log.Debugf("Getting %q : Response not found in cache", indexKey)
+	return Response{}, false
 }
 
 func (cache *InMemory) Save(response Response) {
-	key := cache.newStorageKeyFromResponse(response)
-	ttl, ok := getTTL(response.ResponseHeaders)
+	ttl := setExpires(&response, cache.DefaultTTL)
+	if key, ok := cache.put(response, false); ok {
+		log.Debugf("Saving %q : Response saved for %s", key, ttl)
+	}
+}
+
+// Restore saves the response as it was cached, keeping its expiration, unless
+// a more recent version of it is already cached.
+func (cache *InMemory) Restore(response Response) {
+	if key, ok := cache.put(response, true); ok {
+		log.Debugf("Restoring %q : Response restored until %s", key, response.Expires.Format(time.RFC3339))
+	}
+}
+
+// put stores the response, replacing its previous version and the variants
+// varying on other headers, unless it can't be or, when restoring, the ones
+// replaced are more recent.
+func (cache *InMemory) put(response Response, restoring bool) (StorageKey, bool) {
+	key, ok := newStorageKey(response)
 	if !ok {
-		ttl = time.Duration(cache.DefaultTTL) * time.Second
+		log.Debugf("Saving %q : Response varies on every header, not saved", response.URL)
+		return key, false
+	}
+	if cache.MaxSize > 0 && response.size() > cache.MaxSize {
+		log.Debugf("Saving %q : Response too large, not saved", key)
+		return key, false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	replaced := outdatedVariants(response, cache.variants[responseIndexKey(response)], func(key StorageKey) Response {
+		return cache.store[key]
+	})
+	if _, exists := cache.store[key]; exists {
+		replaced = append(replaced, key)
+	}
+	for _, previous := range replaced {
+		if restoring && cache.store[previous].Created.After(response.Created) {
+			log.Debugf("Restoring %q : More recent response already cached, not restored", key)
+			return key, false
+		}
+	}
+	for _, previous := range replaced {
+		cache.remove(previous)
 	}
-	response.Expires = response.Created.Add(ttl)
 	cache.store[key] = response
-	log.Debugf("Saving %q : Response saved for %s", key, ttl)
+	cache.index(key, response)
+	cache.evict()
+	return key, true
+}
+
+// Fill buffers the body of the response, up to the size limit of the cache.
+func (cache *InMemory) Fill(response Response) BodyWriter {
+	return newBufferedBody(response, cache.Save, cache.MaxSize)
 }
 
-func (cache *InMemory) Purge(req *http.Request) {
-	pattern := fmt.Sprintf("%s_%s", req.URL, cache.hashHeaders(req.Header))
-	for key := range cache.store {
-		if strings.Contains(string(key), pattern) {
-			delete(cache.store, key)
-			log.Debugf("Purging %s", key)
+func (cache *InMemory) Purge(req *http.Request, soft bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	indexKey := requestIndexKey(req)
+	for _, key := range append([]StorageKey(nil), cache.variants[indexKey]...) {
+		cache.purge(key, soft)
+		log.Debugf("Purging %s", key)
+	}
+}
+
+func (cache *InMemory) Entries() []Entry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entries := make([]Entry, 0, len(cache.store))
+	for key, response := range cache.store {
+		entries = append(entries, newEntry(key, response, response.size()))
+	}
+	return entries
+}
+
+func (cache *InMemory) Lookup(key StorageKey) (Response, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	response, ok := cache.store[key]
+	return response, ok
+}
+
+// Walk calls fn out of the lock, with the responses cached when called.
+func (cache *InMemory) Walk(fn func(key StorageKey, response Response) error) error {
+	cache.mutex.Lock()
+	store := make(map[StorageKey]Response, len(cache.store))
+	for key, response := range cache.store {
+		store[key] = response
+	}
+	cache.mutex.Unlock()
+	for key, response := range store {
+		if err := fn(key, response); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (cache *InMemory) newStorageKeyFromRequest(req *http.Request) StorageKey {
-	return StorageKey(fmt.Sprintf("%s_%s_%s", req.Method, req.URL, cache.hashHeaders(req.Header)))
+func (cache *InMemory) Delete(match func(Entry) bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	deleted := 0
+	for key, response := range cache.store {
+		if match(newEntry(key, response, response.size())) {
+			cache.remove(key)
+			cache.purges++
+			deleted++
+			log.Debugf("Deleting %s", key)
+		}
+	}
+	return deleted
+}
+
+func (cache *InMemory) Expire(match func(Entry) bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	expired := 0
+	for key, response := range cache.store {
+		if match(newEntry(key, response, response.size())) {
+			cache.purge(key, true)
+			expired++
+			log.Debugf("Expiring %s", key)
+		}
+	}
+	return expired
+}
+
+func (cache *InMemory) Stats() Stats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return Stats{Entries: len(cache.store), Size: cache.size, Evictions: cache.evictions, Purges: cache.purges}
+}
+
+func (cache *InMemory) PurgeTag(tag string, soft bool) int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	purged := 0
+	for key := range cache.tags[tag] {
+		cache.purge(key, soft)
+		purged++
+		log.Debugf("Purging %s tagged %q", key, tag)
+	}
+	return purged
+}
+
+// StartJanitor removes the responses which can't be served anymore, even
+// stale, and were retained for retention since, from the cache every interval,
+// until the returned function is called.
+func (cache *InMemory) StartJanitor(interval time.Duration, retention time.Duration) func() {
+	return startJanitor(interval, func() { cache.removeObsolete(retention) })
+}
+
+func (cache *InMemory) removeObsolete(retention time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now().UTC()
+	for key, response := range cache.store {
+		if retainUntil(response, retention).Before(now) {
+			cache.remove(key)
+			log.Debugf("Removing obsolete %s", key)
+		}
+	}
+}
+
+// purge removes the response, or only marks it stale when soft.
+func (cache *InMemory) purge(key StorageKey, soft bool) {
+	cache.purges++
+	if !soft {
+		cache.remove(key)
+		return
+	}
+	response := cache.store[key]
+	markStale(&response)
+	cache.store[key] = response
 }
 
-func (cache *InMemory) newStorageKeyFromResponse(response Response) StorageKey {
-	headers := response.RequestHeaders
-	headers.Del("X-Forwarded-For")
-	return StorageKey(fmt.Sprintf("%s_%s_%s", response.Method, response.URL, cache.hashHeaders(headers)))
+// evict drops the least recently used responses until the cache fits in its
+// limits.
+func (cache *InMemory) evict() {
+	for (cache.MaxSize > 0 && cache.size > cache.MaxSize) ||
+		(cache.MaxEntries > 0 && len(cache.store) > cache.MaxEntries) {
+		oldest := cache.recency.Back()
+		if oldest == nil {
+			return
+		}
+		key := oldest.Value.(StorageKey)
+		cache.remove(key)
+		cache.evictions++
+		log.Debugf("Evicting %s", key)
+	}
 }
 
-func (cache *InMemory) hashHeaders(headers http.Header) string {
-	jsonData, err := json.Marshal(headers)
-	if err != nil {
-		log.Error(err)
-		return ""
+func (cache *InMemory) index(key StorageKey, response Response) {
+	indexKey := responseIndexKey(response)
+	cache.variants[indexKey] = append(cache.variants[indexKey], key)
+	tagKey(cache.tags, key, response)
+	cache.elements[key] = cache.recency.PushFront(key)
+	cache.size += response.size()
+}
+
+func (cache *InMemory) remove(key StorageKey) {
+	response, ok := cache.store[key]
+	if !ok {
+		return
+	}
+	delete(cache.store, key)
+	untagKey(cache.tags, key, response)
+	cache.recency.Remove(cache.elements[key])
+	delete(cache.elements, key)
+	cache.size -= response.size()
+
+	indexKey := responseIndexKey(response)
+	variants := cache.variants[indexKey]
+	for i, variant := range variants {
+		if variant == key {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
 	}
-	hash := sha256.New()
-	_, err = hash.Write(jsonData)
-	if err != nil {
-		log.Error(err)
-		return ""
+	if len(variants) == 0 {
+		delete(cache.variants, indexKey)
+	} else {
+		cache.variants[indexKey] = variants
 	}
-	return fmt.Sprintf("%x", hash.Sum(nil))
 }
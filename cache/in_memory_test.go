@@ -11,7 +11,7 @@ import (
 func TestGetNotFoundResponse(t *testing.T) {
 	url := "http://localhost"
 	req := httptest.NewRequest(http.MethodGet, url, nil)
-	cache := NewInMemory(3600)
+	cache := NewInMemory(3600, 0, 0)
 	response, ok := cache.Get(req)
 	assert.Equal(t, Response{}, response)
 	assert.Equal(t, false, ok)
@@ -20,8 +20,7 @@ func TestGetNotFoundResponse(t *testing.T) {
 func TestGetResponse(t *testing.T) {
 	url := "http://localhost"
 	req := httptest.NewRequest(http.MethodGet, url, nil)
-	cache := NewInMemory(3600)
-	key := cache.newStorageKeyFromRequest(req)
+	cache := NewInMemory(3600, 0, 0)
 	expectedResponse := Response{
 		URL:        url,
 		Method:     http.MethodGet,
@@ -29,6 +28,7 @@ func TestGetResponse(t *testing.T) {
 		Created:    time.Now().Add(3600 * -1 * time.Second),
 		Expires:    time.Now().Add(3600 * time.Second),
 	}
+	key, _ := newStorageKey(expectedResponse)
 	store := map[StorageKey]Response{key: expectedResponse}
 	cache.SetStore(store)
 	response, ok := cache.Get(req)
@@ -36,8 +36,44 @@ func TestGetResponse(t *testing.T) {
 	assert.Equal(t, true, ok)
 }
 
+func TestGetResponseIgnoresHeadersNotInVary(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	response := Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		RequestHeaders:  http.Header{"User-Agent": {"Firefox"}, "Accept-Encoding": {"gzip"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Encoding"}},
+		Created:         time.Now(),
+	}
+	cache.Save(response)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("User-Agent", "Chrome")
+	req.Header.Set("Cookie", "session=foo")
+	req.Header.Set("Accept-Encoding", "gzip")
+	_, ok := cache.Get(req)
+	assert.True(t, ok)
+
+	req.Header.Set("Accept-Encoding", "br")
+	_, ok = cache.Get(req)
+	assert.False(t, ok)
+}
+
+func TestGetResponseDoesNotMatchOtherMethod(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	cache.Save(Response{
+		URL:        "http://localhost",
+		Method:     http.MethodHead,
+		StatusCode: http.StatusOK,
+		Created:    time.Now(),
+	})
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.False(t, ok)
+}
+
 func TestSave(t *testing.T) {
-	cache := NewInMemory(3600)
+	cache := NewInMemory(3600, 0, 0)
 	store := map[StorageKey]Response{}
 	cache.SetStore(store)
 	response := Response{
@@ -52,16 +88,31 @@ func TestSave(t *testing.T) {
 	assert.Len(t, store, 1)
 }
 
+func TestSaveVaryStar(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	store := map[StorageKey]Response{}
+	cache.SetStore(store)
+	cache.Save(Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Vary": {"*"}},
+		Created:         time.Now(),
+	})
+	assert.Len(t, store, 0)
+}
+
 func TestSaveVariationsOfTheSameResource(t *testing.T) {
-	cache := NewInMemory(3600)
+	cache := NewInMemory(3600, 0, 0)
 	store := map[StorageKey]Response{}
 	cache.SetStore(store)
 
 	response := Response{
-		URL:        "http://localhost",
-		Method:     http.MethodGet,
-		StatusCode: http.StatusOK,
-		Created:    time.Now(),
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Vary": {"X-Foo"}},
+		Created:         time.Now(),
 	}
 	cache.Save(response)
 
@@ -74,29 +125,366 @@ func TestSaveVariationsOfTheSameResource(t *testing.T) {
 	cache.Save(responseWithQueryParams)
 
 	responseWithRequestHeaders := Response{
-		URL:            "http://localhost",
-		Method:         http.MethodGet,
-		StatusCode:     http.StatusOK,
-		RequestHeaders: http.Header{},
-		Created:        time.Now(),
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		RequestHeaders:  http.Header{},
+		ResponseHeaders: http.Header{"Vary": {"X-Foo"}},
+		Created:         time.Now(),
 	}
 	responseWithRequestHeaders.RequestHeaders.Set("X-Foo", "bar")
 	cache.Save(responseWithRequestHeaders)
+
+	responseWithOtherRequestHeaders := Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		RequestHeaders:  http.Header{},
+		ResponseHeaders: http.Header{"Vary": {"X-Foo"}},
+		Created:         time.Now(),
+	}
+	responseWithOtherRequestHeaders.RequestHeaders.Set("X-Bar", "baz")
+	cache.Save(responseWithOtherRequestHeaders)
 	assert.Len(t, store, 3)
 }
 
+func TestSaveReplacesVariantsOfAnotherVary(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	for _, language := range []string{"fr", "en"} {
+		cache.Save(Response{
+			URL:             "http://localhost",
+			Method:          http.MethodGet,
+			RequestHeaders:  http.Header{"Accept-Language": {language}, "Accept-Encoding": {"gzip"}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Body:            []byte(language),
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodHead, Created: time.Now()})
+	cache.Save(Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		RequestHeaders:  http.Header{"Accept-Language": {"fr"}, "Accept-Encoding": {"gzip"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Encoding"}},
+		Body:            []byte("gzip"),
+		Created:         time.Now(),
+	})
+	assert.Len(t, cache.store, 2, "The variants of the previous Vary should be removed, not the other methods")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("Accept-Encoding", "gzip")
+	response, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", string(response.Body))
+	req.Header.Set("Accept-Language", "en")
+	response, ok = cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", string(response.Body))
+
+	cache.Restore(Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		RequestHeaders:  http.Header{"Accept-Language": {"en"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+		Body:            []byte("en"),
+		Created:         time.Now().Add(-time.Minute),
+		Expires:         time.Now().Add(time.Hour),
+	})
+	response, _ = cache.Get(req)
+	assert.Equal(t, "gzip", string(response.Body), "An older variant of another Vary shouldn't be restored")
+}
+
 func TestPurge(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
-	cache := NewInMemory(3600)
-	key := cache.newStorageKeyFromRequest(req)
-	store := map[StorageKey]Response{key: {
+	cache := NewInMemory(3600, 0, 0)
+	response := Response{
 		URL:        req.URL.String(),
 		Method:     req.Method,
 		StatusCode: http.StatusOK,
 		Created:    time.Now().Add(3600 * -1 * time.Second),
 		Expires:    time.Now().Add(3600 * time.Second),
-	}}
+	}
+	key, _ := newStorageKey(response)
+	store := map[StorageKey]Response{key: response}
 	cache.SetStore(store)
-	cache.Purge(req)
+	cache.Purge(req, false)
 	assert.Len(t, store, 0)
 }
+
+func TestNamespacesAreKeptApart(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	for _, namespace := range []string{"", "api"} {
+		cache.Save(Response{
+			URL:        "http://localhost/resource",
+			Method:     http.MethodGet,
+			StatusCode: http.StatusOK,
+			Body:       []byte(namespace),
+			Created:    time.Now(),
+			Namespace:  namespace,
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/resource", nil)
+	response, ok := cache.Get(WithNamespace(req, "api"))
+	assert.True(t, ok)
+	assert.Equal(t, "api", string(response.Body))
+
+	cache.Purge(WithNamespace(req, "api"), false)
+	_, ok = cache.Get(WithNamespace(req, "api"))
+	assert.False(t, ok)
+	response, ok = cache.Get(req)
+	assert.True(t, ok, "Purging a namespace shouldn't purge the others")
+	assert.Equal(t, "", string(response.Body))
+}
+
+func TestHostsAreKeptApart(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	for _, host := range []string{"a.example", "b.example"} {
+		cache.Save(Response{
+			URL:        "http://backend/resource",
+			Method:     http.MethodGet,
+			StatusCode: http.StatusOK,
+			Body:       []byte(host),
+			Created:    time.Now(),
+			Host:       host,
+		})
+	}
+	assert.Equal(t, 2, cache.Stats().Entries)
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend/resource", nil)
+	response, ok := cache.Get(WithHost(req, "B.example"))
+	assert.True(t, ok)
+	assert.Equal(t, "b.example", string(response.Body))
+
+	cache.Purge(WithHost(req, "a.example"), false)
+	_, ok = cache.Get(WithHost(req, "a.example"))
+	assert.False(t, ok)
+	_, ok = cache.Get(WithHost(req, "b.example"))
+	assert.True(t, ok, "Purging a host shouldn't purge the others")
+}
+
+func TestPurgeAllVariants(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	store := map[StorageKey]Response{}
+	cache.SetStore(store)
+	for _, encoding := range []string{"gzip", "br", ""} {
+		cache.Save(Response{
+			URL:             "http://backend/foo",
+			Method:          http.MethodGet,
+			StatusCode:      http.StatusOK,
+			RequestHeaders:  http.Header{"Accept-Encoding": {encoding}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Encoding"}},
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{
+		URL:        "http://backend/bar",
+		Method:     http.MethodGet,
+		StatusCode: http.StatusOK,
+		Created:    time.Now(),
+	})
+	assert.Len(t, store, 4)
+
+	cache.Purge(httptest.NewRequest("PURGE", "/foo", nil), false)
+	assert.Len(t, store, 1)
+}
+
+func TestMatchesVary(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		vary            string
+		requestHeaders  http.Header
+		incomingHeaders http.Header
+		expected        bool
+	}{
+		{
+			desc:            "No Vary header",
+			vary:            "",
+			requestHeaders:  http.Header{"Accept-Language": {"fr"}},
+			incomingHeaders: http.Header{"Accept-Language": {"en"}},
+			expected:        true,
+		},
+		{
+			desc:            "Same value for the varying header",
+			vary:            "Accept-Language",
+			requestHeaders:  http.Header{"Accept-Language": {"fr"}},
+			incomingHeaders: http.Header{"Accept-Language": {"fr"}},
+			expected:        true,
+		},
+		{
+			desc:            "Different value for the varying header",
+			vary:            "accept-language",
+			requestHeaders:  http.Header{"Accept-Language": {"fr"}},
+			incomingHeaders: http.Header{"Accept-Language": {"en"}},
+			expected:        false,
+		},
+		{
+			desc:            "Varying header missing from the request",
+			vary:            "Accept-Language",
+			requestHeaders:  http.Header{"Accept-Language": {"fr"}},
+			incomingHeaders: http.Header{},
+			expected:        false,
+		},
+		{
+			desc:            "Values only differing by whitespaces",
+			vary:            "Accept-Encoding",
+			requestHeaders:  http.Header{"Accept-Encoding": {"gzip,  br"}},
+			incomingHeaders: http.Header{"Accept-Encoding": {"gzip, br"}},
+			expected:        true,
+		},
+		{
+			desc:            "Vary: *",
+			vary:            "*",
+			requestHeaders:  http.Header{},
+			incomingHeaders: http.Header{},
+			expected:        false,
+		},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			response := Response{
+				RequestHeaders:  test.requestHeaders,
+				ResponseHeaders: http.Header{"Vary": {test.vary}},
+			}
+			req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+			req.Header = test.incomingHeaders
+			assert.Equal(t, test.expected, matchesVary(response, req))
+		})
+	}
+}
+
+func TestEvictLeastRecentlyUsedOverMaxEntries(t *testing.T) {
+	cache := NewInMemory(3600, 0, 2)
+	for _, path := range []string{"/a", "/b"} {
+		cache.Save(Response{URL: "http://localhost" + path, Method: http.MethodGet, Created: time.Now()})
+	}
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.True(t, ok)
+
+	cache.Save(Response{URL: "http://localhost/c", Method: http.MethodGet, Created: time.Now()})
+
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.True(t, ok)
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/b", nil))
+	assert.False(t, ok, "/b should have been evicted")
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/c", nil))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), cache.Stats().Evictions)
+}
+
+func TestEvictOverMaxSize(t *testing.T) {
+	body := make([]byte, 1000)
+	response := Response{URL: "http://localhost/a", Method: http.MethodGet, Body: body, Created: time.Now()}
+	cache := NewInMemory(3600, 2*response.size()+10, 0)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cache.Save(Response{URL: "http://localhost" + path, Method: http.MethodGet, Body: body, Created: time.Now()})
+	}
+	assert.Len(t, cache.store, 2)
+	assert.LessOrEqual(t, cache.size, cache.MaxSize)
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.False(t, ok, "/a should have been evicted")
+}
+
+func TestSaveTooLargeResponse(t *testing.T) {
+	cache := NewInMemory(3600, 100, 0)
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodGet, Body: make([]byte, 1000), Created: time.Now()})
+	assert.Len(t, cache.store, 0)
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func TestSaveReplacesSizeOfExistingResponse(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	response := Response{URL: "http://localhost", Method: http.MethodGet, Body: make([]byte, 1000), Created: time.Now()}
+	cache.Save(response)
+	cache.Save(response)
+	assert.Equal(t, response.size(), cache.size)
+	cache.Purge(httptest.NewRequest("PURGE", "/", nil), false)
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func TestJanitorRemovesExpiredResponses(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	cache.Save(Response{URL: "http://localhost/fresh", Method: http.MethodGet, Created: time.Now()})
+	cache.Save(Response{
+		URL:             "http://localhost/expired",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60"}},
+		Created:         time.Now().Add(-time.Hour),
+	})
+	stop := cache.StartJanitor(time.Millisecond, 0)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/expired", nil))
+		return !ok
+	}, time.Second, time.Millisecond)
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/fresh", nil))
+	assert.True(t, ok)
+}
+
+func TestJanitorKeepsExpiredResponsesForStaleRetention(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	cache.Save(Response{
+		URL:             "http://localhost/retained",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60"}},
+		Created:         time.Now().Add(-time.Hour),
+	})
+	cache.Save(Response{
+		URL:             "http://localhost/revalidated",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60, must-revalidate"}},
+		Created:         time.Now().Add(-time.Hour),
+	})
+	cache.Save(Response{
+		URL:             "http://localhost/validated",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60, must-revalidate"}, "Etag": {`"v1"`}},
+		Created:         time.Now().Add(-time.Hour),
+	})
+	cache.removeObsolete(24 * time.Hour)
+
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/retained", nil))
+	assert.True(t, ok)
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/revalidated", nil))
+	assert.False(t, ok, "A response which must be revalidated can't be served expired")
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/validated", nil))
+	assert.True(t, ok, "A response with validators can be revalidated once expired")
+}
+
+func TestJanitorDisabled(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		stop := cache.StartJanitor(interval, 0)
+		stop()
+	}
+}
+
+func TestRestoreKeepsMoreRecentResponses(t *testing.T) {
+	cache := NewInMemory(3600, 0, 0)
+	cache.Save(Response{URL: "http://localhost/recent", Method: http.MethodGet, Body: []byte("recent"), Created: time.Now()})
+	cache.Restore(Response{
+		URL:     "http://localhost/recent",
+		Method:  http.MethodGet,
+		Body:    []byte("restored"),
+		Created: time.Now().Add(-time.Minute),
+		Expires: time.Now().Add(time.Hour),
+	})
+	cache.Restore(Response{
+		URL:     "http://localhost/old",
+		Method:  http.MethodGet,
+		Body:    []byte("restored"),
+		Created: time.Now().Add(-time.Minute),
+		Expires: time.Now().Add(time.Hour),
+	})
+
+	response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/recent", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "recent", string(response.Body))
+	response, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/old", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "restored", string(response.Body))
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"time"
+)
+
+// Inspector is implemented by the caches whose responses can be listed and
+// removed one by one, e.g. from the admin API.
+type Inspector interface {
+	// Entries returns a summary of every cached response
+	Entries() []Entry
+	// Lookup returns the response cached under the key
+	Lookup(key StorageKey) (Response, bool)
+	// Walk calls fn with every cached response and its key, until fn returns an error
+	Walk(fn func(key StorageKey, response Response) error) error
+	// Delete removes the cached responses selected by match, and returns their count
+	Delete(match func(Entry) bool) int
+	// Expire marks the cached responses selected by match stale, and returns their count
+	Expire(match func(Entry) bool) int
+	// Stats returns the number and size of the cached responses, and the
+	// number of responses evicted and purged so far
+	Stats() Stats
+}
+
+// Entry sums up a cached response.
+type Entry struct {
+	Key       StorageKey `json:"key"`
+	Namespace string     `json:"namespace,omitempty"`
+	Host      string     `json:"host,omitempty"`
+	Method    string     `json:"method"`
+	URL       string     `json:"url"`
+	// RequestURI is the path and query of the URL, as requested to the proxy
+	RequestURI string    `json:"requestURI"`
+	StatusCode int       `json:"statusCode"`
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	Tags       []string  `json:"tags,omitempty"`
+}
+
+type Stats struct {
+	Entries   int   `json:"entries"`
+	Size      int64 `json:"size"`
+	Evictions int64 `json:"evictions"`
+	Purges    int64 `json:"purges"`
+}
+
+func newEntry(key StorageKey, response Response, size int64) Entry {
+	return Entry{
+		Key:        key,
+		Namespace:  response.Namespace,
+		Host:       response.Host,
+		Method:     response.Method,
+		URL:        response.URL,
+		RequestURI: requestURI(response.URL),
+		StatusCode: response.StatusCode,
+		Size:       size,
+		Created:    response.Created,
+		Expires:    response.Expires,
+		Tags:       Tags(response.ResponseHeaders),
+	}
+}
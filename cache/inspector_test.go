@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type inspectableCache interface {
+	Cache
+	Inspector
+}
+
+func newTestInspectors(t *testing.T) map[string]inspectableCache {
+	disk, _ := newTestDisk(t, 0)
+	_, newRedis := newTestRedis(t)
+	return map[string]inspectableCache{
+		"memory":  NewInMemory(3600, 0, 0),
+		"sharded": NewSharded(4, 3600, 0, 0),
+		"disk":    disk,
+		"redis":   newRedis(),
+	}
+}
+
+// measuredStats returns the stats of the cache, measuring the Redis one first.
+func measuredStats(cache Inspector) Stats {
+	if redis, ok := cache.(*Redis); ok {
+		redis.measure()
+	}
+	return cache.Stats()
+}
+
+func TestInspector(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/static/a.css", "/static/b.css", "/api/users"} {
+				cache.Save(Response{
+					URL:        "http://backend" + path,
+					Method:     http.MethodGet,
+					StatusCode: http.StatusOK,
+					Body:       []byte("body"),
+					Created:    time.Now(),
+				})
+			}
+
+			entries := cache.Entries()
+			var requestURIs []string
+			for _, entry := range entries {
+				requestURIs = append(requestURIs, entry.RequestURI)
+			}
+			sort.Strings(requestURIs)
+			assert.Equal(t, []string{"/api/users", "/static/a.css", "/static/b.css"}, requestURIs)
+			stats := measuredStats(cache)
+			assert.Equal(t, 3, stats.Entries)
+			assert.Greater(t, stats.Size, int64(0))
+
+			response, ok := cache.Lookup(entries[0].Key)
+			assert.True(t, ok)
+			assert.Equal(t, entries[0].URL, response.URL)
+			assert.Equal(t, "body", readBody(t, response))
+
+			walked := 0
+			assert.NoError(t, cache.Walk(func(key StorageKey, response Response) error {
+				walked++
+				assert.Equal(t, "body", readBody(t, response), key)
+				return nil
+			}))
+			assert.Equal(t, 3, walked)
+
+			deleted := cache.Delete(func(entry Entry) bool { return strings.HasPrefix(entry.RequestURI, "/static/") })
+			assert.Equal(t, 2, deleted)
+			stats = measuredStats(cache)
+			assert.Equal(t, 1, stats.Entries)
+			assert.Equal(t, int64(2), stats.Purges)
+			_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/static/a.css", nil))
+			assert.False(t, ok)
+			_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/api/users", nil))
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestSoftPurge(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{"/url", "/tagged", "/selected", "/obsolete"} {
+				response := Response{
+					URL:             "http://backend" + path,
+					Method:          http.MethodGet,
+					StatusCode:      http.StatusOK,
+					ResponseHeaders: http.Header{},
+					Created:         time.Now(),
+				}
+				if path != "/obsolete" {
+					response.ResponseHeaders.Set("Cache-Control", "max-age=60, stale-if-error=600")
+				}
+				response.ResponseHeaders.Set("Surrogate-Key", path[1:])
+				cache.Save(response)
+			}
+
+			cache.Purge(httptest.NewRequest("PURGE", "/url", nil), true)
+			assert.Equal(t, 1, cache.PurgeTag("tagged", true))
+			assert.Equal(t, 1, cache.Expire(func(entry Entry) bool { return entry.RequestURI == "/selected" }))
+			assert.Equal(t, int64(3), cache.Stats().Purges, "Soft purges should be counted")
+			for _, path := range []string{"/url", "/tagged", "/selected"} {
+				response, ok := cache.Get(httptest.NewRequest(http.MethodGet, path, nil))
+				assert.True(t, ok, path)
+				assert.False(t, response.Expires.After(time.Now()), path)
+				assert.True(t, CanServeStaleIfError(response, httptest.NewRequest(http.MethodGet, path, nil)), path)
+			}
+
+			cache.Purge(httptest.NewRequest("PURGE", "/obsolete", nil), true)
+			response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/obsolete", nil))
+			assert.False(t, ok && response.Expires.After(time.Now()), "Soft purged responses are never fresh")
+		})
+	}
+}
+
+func TestSoftPurgedResponsesAreRetained(t *testing.T) {
+	const retention = time.Hour
+	memory := NewInMemory(3600, 0, 0)
+	disk, _ := newTestDisk(t, 0)
+	_, newRedis := newTestRedis(t)
+	redisCache := newRedis()
+	redisCache.StaleRetention = retention
+	backends := map[string]struct {
+		cache          inspectableCache
+		removeObsolete func(retention time.Duration)
+	}{
+		"memory": {memory, memory.removeObsolete},
+		"disk":   {disk, disk.removeObsolete},
+		// Redis expires the responses by itself
+		"redis": {redisCache, func(time.Duration) {}},
+	}
+	for name, backend := range backends {
+		backend := backend
+		t.Run(name, func(t *testing.T) {
+			backend.cache.Save(Response{
+				URL:             "http://backend/soft",
+				Method:          http.MethodGet,
+				StatusCode:      http.StatusOK,
+				ResponseHeaders: http.Header{"Cache-Control": {"max-age=60"}},
+				Body:            []byte("soft"),
+				Created:         time.Now(),
+			})
+			backend.cache.Purge(httptest.NewRequest("PURGE", "/soft", nil), true)
+			backend.removeObsolete(retention)
+
+			response, ok := backend.cache.Get(httptest.NewRequest(http.MethodGet, "/soft", nil))
+			assert.True(t, ok, "Soft purged responses without stale-if-error are kept for the retention")
+			assert.False(t, response.Expires.After(time.Now()), "Soft purged responses are never fresh")
+			assert.Equal(t, "soft", readBody(t, response))
+
+			backend.removeObsolete(0)
+			if name != "redis" {
+				_, ok = backend.cache.Get(httptest.NewRequest(http.MethodGet, "/soft", nil))
+				assert.False(t, ok, "Soft purged responses are removed once retained")
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"time"
+)
+
+// startJanitor calls removeObsolete every interval, until the returned function
+// is called. An interval of 0 or less disables the janitor.
+func startJanitor(interval time.Duration, removeObsolete func()) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				removeObsolete()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type namespaceContextKey struct{}
+
+type hostContextKey struct{}
+
+// WithNamespace returns a shallow copy of the request whose responses are
+// cached apart from the ones of other namespaces, e.g. the routes of the
+// proxy. The default namespace is empty.
+func WithNamespace(req *http.Request, namespace string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), namespaceContextKey{}, namespace))
+}
+
+// Namespace returns the namespace the responses of the request are cached in.
+func Namespace(req *http.Request) string {
+	namespace, _ := req.Context().Value(namespaceContextKey{}).(string)
+	return namespace
+}
+
+// WithHost returns a shallow copy of the request whose responses are cached
+// apart from the ones of other hosts, whatever the Host header it's then
+// forwarded with, e.g. the one of a backend shared by several hosts.
+func WithHost(req *http.Request, host string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), hostContextKey{}, strings.ToLower(host)))
+}
+
+// Host returns the host the responses of the request are cached for, empty
+// when not set.
+func Host(req *http.Request) string {
+	host, _ := req.Context().Value(hostContextKey{}).(string)
+	return host
+}
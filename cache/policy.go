@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"net/http"
+)
+
+// StoragePolicy overrides how the responses of the backend are stored.
+type StoragePolicy struct {
+	// TTL is the default TTL of the responses in seconds, 0 meaning the one of the cache
+	TTL int
+	// CacheableStatuses replaces the status codes of the responses which can be stored, when not empty
+	CacheableStatuses []int
+	// IgnoreCacheControl ignores the Cache-Control, Expires and Pragma headers of the
+	// responses, which are fresh for their default TTL
+	IgnoreCacheControl bool
+	// ForceCache stores the responses even if their headers forbid it, for their default TTL
+	// when they're already expired
+	ForceCache bool
+}
+
+// NotStoredReason tells why the response can't be stored in cache under the
+// policy, or returns an empty string if it can.
+func (policy StoragePolicy) NotStoredReason(res *http.Response) string {
+	// A partial response would be served in place of the whole one
+	if res.StatusCode == http.StatusPartialContent && !IsSlice(res) {
+		return "partial"
+	}
+	if !policy.isStatusCacheable(res.StatusCode) {
+		return "status"
+	}
+	if _, ok := varyHeaderNames(res.Header); !ok {
+		return "vary"
+	}
+	if policy.IgnoreCacheControl || policy.ForceCache {
+		return ""
+	}
+	cacheControl := ParseCacheControl(res.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if cacheControl.Has(directive) {
+			return directive
+		}
+	}
+	// Expired responses with validators are revalidated instead of fetched again
+	lifetime, ok := explicitFreshnessLifetime(res.Header)
+	if ok && lifetime == 0 && !HasValidators(Response{ResponseHeaders: res.Header}) {
+		return "expired"
+	}
+	return ""
+}
+
+// Apply sets how long the response to store stays fresh under the policy.
+func (policy StoragePolicy) Apply(response *Response) {
+	if policy.TTL != 0 {
+		response.DefaultTTL = policy.TTL
+	}
+	if policy.IgnoreCacheControl {
+		response.IgnoreCacheControl = true
+	}
+	if policy.ForceCache {
+		lifetime, ok := explicitFreshnessLifetime(response.ResponseHeaders)
+		if (ok && lifetime == 0) || ParseCacheControl(response.ResponseHeaders).Has("no-cache") {
+			response.IgnoreCacheControl = true
+		}
+	}
+}
+
+func (policy StoragePolicy) isStatusCacheable(status int) bool {
+	if len(policy.CacheableStatuses) == 0 {
+		return isStatusCacheable(status)
+	}
+	for _, cacheableStatus := range policy.CacheableStatuses {
+		if cacheableStatus == status {
+			return true
+		}
+	}
+	return false
+}
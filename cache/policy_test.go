@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStoragePolicyNotStoredReason(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		policy   StoragePolicy
+		status   int
+		headers  map[string]string
+		expected string
+	}{
+		{desc: "Default policy", status: http.StatusOK, headers: map[string]string{"Cache-Control": "no-store"}, expected: "no-store"},
+		{desc: "Cacheable statuses replaced", policy: StoragePolicy{CacheableStatuses: []int{200}}, status: http.StatusNotFound, expected: "status"},
+		{desc: "Additional cacheable status", policy: StoragePolicy{CacheableStatuses: []int{500}}, status: http.StatusInternalServerError, expected: ""},
+		{desc: "Forced cache", policy: StoragePolicy{ForceCache: true}, status: http.StatusOK, headers: map[string]string{"Cache-Control": "private, no-store"}, expected: ""},
+		{desc: "Ignored Cache-Control", policy: StoragePolicy{IgnoreCacheControl: true}, status: http.StatusOK, headers: map[string]string{"Cache-Control": "max-age=0"}, expected: ""},
+		{desc: "Expired response", status: http.StatusOK, headers: map[string]string{"Cache-Control": "max-age=0"}, expected: "expired"},
+		{desc: "Expired response with ETag", status: http.StatusOK, headers: map[string]string{"Cache-Control": "max-age=0", "ETag": `"v1"`}, expected: ""},
+		{desc: "Expires in the past with Last-Modified", status: http.StatusOK, headers: map[string]string{"Expires": "Thu, 01 Jan 1970 00:00:00 GMT", "Last-Modified": "Thu, 01 Jan 1970 00:00:00 GMT"}, expected: ""},
+		{desc: "Forced cache still varying on every header", policy: StoragePolicy{ForceCache: true}, status: http.StatusOK, headers: map[string]string{"Vary": "*"}, expected: "vary"},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			res := http.Response{StatusCode: test.status, Header: http.Header{}}
+			for k, v := range test.headers {
+				res.Header.Set(k, v)
+			}
+			assert.Equal(t, test.expected, test.policy.NotStoredReason(&res))
+		})
+	}
+}
+
+func TestStoragePolicyApply(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		policy   StoragePolicy
+		headers  http.Header
+		expected time.Duration
+	}{
+		{desc: "Cache-Control over TTL", policy: StoragePolicy{TTL: 60}, headers: http.Header{"Cache-Control": {"max-age=10"}}, expected: 10 * time.Second},
+		{desc: "TTL without Cache-Control", policy: StoragePolicy{TTL: 60}, expected: 60 * time.Second},
+		{desc: "Ignored Cache-Control", policy: StoragePolicy{TTL: 60, IgnoreCacheControl: true}, headers: http.Header{"Cache-Control": {"max-age=10"}}, expected: 60 * time.Second},
+		{desc: "Forced cache of a fresh response", policy: StoragePolicy{TTL: 60, ForceCache: true}, headers: http.Header{"Cache-Control": {"private, max-age=10"}}, expected: 10 * time.Second},
+		{desc: "Forced cache of an expired response", policy: StoragePolicy{TTL: 60, ForceCache: true}, headers: http.Header{"Cache-Control": {"no-cache"}}, expected: 60 * time.Second},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			response := Response{ResponseHeaders: test.headers, Created: time.Now()}
+			test.policy.Apply(&response)
+			assert.Equal(t, test.expected, setExpires(&response, 3600))
+		})
+	}
+}
+
+func TestIgnoredCacheControlDoesNotRevalidate(t *testing.T) {
+	response := Response{
+		ResponseHeaders:    http.Header{"Cache-Control": {"must-revalidate, stale-while-revalidate=60"}},
+		Expires:            time.Now().Add(-time.Second),
+		IgnoreCacheControl: true,
+	}
+	assert.False(t, MustRevalidate(response))
+	assert.Equal(t, response.Expires, staleUntil(response))
+}
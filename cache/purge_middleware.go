@@ -5,6 +5,10 @@ import (
 	"net/http"
 )
 
+// NewPurgeMiddleware purges the responses to the URL of the PURGE requests, or
+// the ones tagged with their Surrogate-Key or Cache-Tag header when set. With
+// a "Soft-Purge: 1" header, the responses are only marked stale, so that they
+// can still be served if the backend fails to revalidate them.
 func NewPurgeMiddleware(cache Cache) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -15,7 +19,14 @@ func NewPurgeMiddleware(cache Cache) func(next http.Handler) http.Handler {
 			}
 
 			log.Debug("-----------------------")
-			cache.Purge(req)
+			soft := req.Header.Get("Soft-Purge") == "1"
+			if tags := Tags(req.Header); len(tags) > 0 {
+				for _, tag := range tags {
+					log.Debugf("Purged %d responses tagged %q", cache.PurgeTag(tag, soft), tag)
+				}
+			} else {
+				cache.Purge(req, soft)
+			}
 			rw.WriteHeader(http.StatusNoContent)
 		})
 	}
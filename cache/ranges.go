@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the number of ranges of a request above which its Range header
+// is ignored, the whole response being sent instead.
+const maxRanges = 32
+
+// ErrRangeNotSatisfiable is returned when none of the ranges of a request
+// overlaps the body of the response.
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ByteRange is a range of Length bytes of a body, from its Start offset.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// End returns the offset of the last byte of the range.
+func (byteRange ByteRange) End() int64 {
+	return byteRange.Start + byteRange.Length - 1
+}
+
+func (byteRange ByteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", byteRange.Start, byteRange.End(), size)
+}
+
+// RangeApplies tells if the Range header of the request applies to a response
+// with the given headers: the request is a GET, and its If-Range, if any,
+// matches the strong entity-tag or the Last-Modified date of the response
+// (RFC 9110, section 13.1.5).
+func RangeApplies(req *http.Request, headers http.Header) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") == "" {
+		return false
+	}
+	ifRange := strings.TrimSpace(req.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return !strings.HasPrefix(ifRange, "W/") && matchesETag(ifRange, headers.Get("ETag"), true)
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	return err == nil && lastModified.Equal(date)
+}
+
+// Ranges returns the byte ranges of the Range header of the request within a
+// body of size bytes, or nil when the header is to be ignored, being invalid,
+// not in bytes, or asking for too many ranges. It returns
+// ErrRangeNotSatisfiable when none of the ranges overlaps the body.
+func Ranges(req *http.Request, size int64) ([]ByteRange, error) {
+	header := strings.TrimSpace(req.Header.Get("Range"))
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+	specs := strings.Split(strings.TrimPrefix(header, "bytes="), ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+	var ranges []ByteRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, nil
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		if first == "" {
+			// Suffix range, of the last bytes of the body
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, nil
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			ranges = append(ranges, ByteRange{Start: size - suffix, Length: suffix})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, ByteRange{Start: start, Length: end - start + 1})
+	}
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// WriteRangeNotSatisfiable answers with a 416 Range Not Satisfiable for a body
+// of size bytes.
+func WriteRangeNotSatisfiable(rw http.ResponseWriter, size int64) int {
+	rw.Header().Del("Content-Length")
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	return http.StatusRequestedRangeNotSatisfiable
+}
+
+// WritePartialContent writes the ranges of a body of size bytes, copied by
+// copyRange, as a 206 Partial Content, in a multipart/byteranges body when
+// there are several (RFC 9110, section 14.6).
+func WritePartialContent(rw http.ResponseWriter, ranges []ByteRange, size int64, copyRange func(io.Writer, ByteRange) error) int {
+	if len(ranges) == 1 {
+		rw.Header().Set("Content-Range", ranges[0].contentRange(size))
+		rw.Header().Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		rw.WriteHeader(http.StatusPartialContent)
+		if err := copyRange(rw, ranges[0]); err != nil {
+			log.Errorf("Writing range %s : %s", ranges[0].contentRange(size), err)
+		}
+		return http.StatusPartialContent
+	}
+
+	contentType := rw.Header().Get("Content-Type")
+	parts := multipart.NewWriter(rw)
+	rw.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	rw.Header().Del("Content-Length")
+	rw.WriteHeader(http.StatusPartialContent)
+	for _, byteRange := range ranges {
+		header := textproto.MIMEHeader{"Content-Range": {byteRange.contentRange(size)}}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		part, err := parts.CreatePart(header)
+		if err == nil {
+			err = copyRange(part, byteRange)
+		}
+		if err != nil {
+			log.Errorf("Writing range %s : %s", byteRange.contentRange(size), err)
+			return http.StatusPartialContent
+		}
+	}
+	if err := parts.Close(); err != nil {
+		log.Errorf("Writing ranges : %s", err)
+	}
+	return http.StatusPartialContent
+}
+
+// writeRanges writes the ranges requested out of the body of the response,
+// or the whole body when the Range header is ignored.
+func writeRanges(rw http.ResponseWriter, req *http.Request, response Response, body io.ReadSeeker) int {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return writeBodyError(rw, response, err)
+	}
+	ranges, err := Ranges(req, size)
+	if errors.Is(err, ErrRangeNotSatisfiable) {
+		return WriteRangeNotSatisfiable(rw, size)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return writeBodyError(rw, response, err)
+	}
+	if ranges == nil {
+		return writeBody(rw, response, body)
+	}
+	return WritePartialContent(rw, ranges, size, func(writer io.Writer, byteRange ByteRange) error {
+		if _, err := body.Seek(byteRange.Start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(writer, body, byteRange.Length)
+		return err
+	})
+}
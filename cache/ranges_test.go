@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRanges(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected []ByteRange
+		err      error
+	}{
+		{"bytes=0-4", []ByteRange{{0, 5}}, nil},
+		{"bytes=5-", []ByteRange{{5, 5}}, nil},
+		{"bytes=-3", []ByteRange{{7, 3}}, nil},
+		{"bytes=-20", []ByteRange{{0, 10}}, nil},
+		{"bytes=8-20", []ByteRange{{8, 2}}, nil},
+		{"bytes=0-1, 4-5", []ByteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=10-20", nil, ErrRangeNotSatisfiable},
+		{"bytes=-0", nil, ErrRangeNotSatisfiable},
+		{"bytes=5-2", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"items=0-4", nil, nil},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", testCase.header)
+		ranges, err := Ranges(req, 10)
+		assert.Equal(t, testCase.expected, ranges, testCase.header)
+		assert.Equal(t, testCase.err, err, testCase.header)
+	}
+}
+
+func TestRangeApplies(t *testing.T) {
+	lastModified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	headers := http.Header{"Etag": {`"v1"`}, "Last-Modified": {lastModified}}
+	testCases := map[string]bool{
+		"":                                 true,
+		`"v1"`:                             true,
+		`"v2"`:                             false,
+		`W/"v1"`:                           false,
+		lastModified:                       true,
+		time.Now().Format(http.TimeFormat): false,
+	}
+	for ifRange, expected := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", "bytes=0-1")
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		assert.Equal(t, expected, RangeApplies(req, headers), ifRange)
+	}
+	assert.False(t, RangeApplies(httptest.NewRequest(http.MethodGet, "/", nil), headers), "No Range")
+}
+
+func writeRangeResponse(rangeHeader string, ifRange string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Range", rangeHeader)
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	recorder := httptest.NewRecorder()
+	WriteResponse(recorder, req, Response{
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"10"}, "Etag": {`"v1"`}},
+		Body:            []byte("0123456789"),
+		Created:         time.Now(),
+	})
+	return recorder
+}
+
+func TestWriteResponseRange(t *testing.T) {
+	recorder := writeRangeResponse("bytes=2-5", "")
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "bytes 2-5/10", recorder.Header().Get("Content-Range"))
+	assert.Equal(t, "4", recorder.Header().Get("Content-Length"))
+	assert.Equal(t, "2345", recorder.Body.String())
+}
+
+func TestWriteResponseMultipleRanges(t *testing.T) {
+	recorder := writeRangeResponse("bytes=0-1,-2", "")
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Content-Length"))
+	mediaType, params, err := mime.ParseMediaType(recorder.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(recorder.Body, params["boundary"])
+	for _, expected := range []struct{ contentRange, body string }{{"bytes 0-1/10", "01"}, {"bytes 8-9/10", "89"}} {
+		part, err := reader.NextPart()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(part)
+		assert.Equal(t, expected.body, string(body))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWriteResponseRangeNotSatisfiable(t *testing.T) {
+	recorder := writeRangeResponse("bytes=20-", "")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, recorder.Code)
+	assert.Equal(t, "bytes */10", recorder.Header().Get("Content-Range"))
+	assert.Empty(t, recorder.Body.String())
+}
+
+func TestWriteResponseIfRangeMismatch(t *testing.T) {
+	recorder := writeRangeResponse("bytes=2-5", `"v2"`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "bytes", recorder.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "0123456789", recorder.Body.String())
+}
+
+func TestWriteDiskResponseRange(t *testing.T) {
+	cache, _ := newTestDisk(t, 0)
+	cache.Save(Response{URL: "http://localhost/file", Method: http.MethodGet, StatusCode: http.StatusOK, Body: []byte("0123456789"), Created: time.Now()})
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	response, _ := cache.Get(req)
+
+	req.Header.Set("Range", "bytes=-4")
+	recorder := httptest.NewRecorder()
+	WriteResponse(recorder, req, response)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "6789", recorder.Body.String())
+}
+
+func TestPartialResponsesAreStoredAsSlicesOnly(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	res := &http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{}, Request: req}
+	assert.Equal(t, "partial", NotStoredReason(res))
+	res.Request = SliceRequest(req, 2, 1024)
+	assert.Equal(t, "bytes=2048-3071", res.Request.Header.Get("Range"))
+	assert.Equal(t, "", NotStoredReason(res))
+}
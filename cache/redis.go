@@ -0,0 +1,478 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisScanCount is the number of keys scanned, and responses fetched, at once
+// when going through every cached response.
+const redisScanCount = 100
+
+// Redis stores the responses in a server speaking the Redis protocol, so that
+// several instances of the proxy share their hits and purges. Every response
+// is stored under its own key, expiring StaleRetention after the response
+// can't be served anymore even stale, and the keys of the variants of a resource, like the
+// ones of the responses sharing a tag, are indexed in a set.
+type Redis struct {
+	DefaultTTL     int
+	StaleRetention time.Duration
+	client         redis.UniversalClient
+	prefix         string
+	mutex          sync.Mutex
+	// measured is the number and size of the responses last measured
+	measured Stats
+}
+
+// NewRedis returns a cache stored through client, under keys starting with
+// prefix, keeping the expired responses for staleRetention past the time they
+// may be served stale.
+func NewRedis(client redis.UniversalClient, prefix string, defaultTTL int, staleRetention time.Duration) *Redis {
+	return &Redis{
+		DefaultTTL:     defaultTTL,
+		StaleRetention: staleRetention,
+		client:         client,
+		prefix:         prefix,
+	}
+}
+
+func (cache *Redis) Get(req *http.Request) (Response, bool) {
+	ctx := req.Context()
+	indexKey := requestIndexKey(req)
+	keys, err := cache.client.SMembers(ctx, cache.variantsKey(indexKey)).Result()
+	if err != nil {
+		log.Errorf("Getting %q : %s", indexKey, err)
+		return Response{}, false
+	}
+	if len(keys) == 0 {
+		log.Debugf("Getting %q : Response not found in cache", indexKey)
+		return Response{}, false
+	}
+
+	responseKeys := make([]string, len(keys))
+	for i, key := range keys {
+		responseKeys[i] = cache.responseKey(StorageKey(key))
+	}
+	values, err := cache.client.MGet(ctx, responseKeys...).Result()
+	if err != nil {
+		log.Errorf("Getting %q : %s", indexKey, err)
+		return Response{}, false
+	}
+	var expiredKeys []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			expiredKeys = append(expiredKeys, keys[i])
+			continue
+		}
+		var response Response
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			log.Errorf("Getting %q : Cannot decode response : %s", keys[i], err)
+			continue
+		}
+		if response.Method == req.Method && matchesVary(response, req) {
+			log.Debugf("Getting %q : Response retrieved", keys[i])
+			return response, true
+		}
+	}
+	if len(expiredKeys) > 0 {
+		cache.client.SRem(ctx, cache.variantsKey(indexKey), expiredKeys...)
+	}
+	log.Debugf("Getting %q : Response not found in cache", indexKey)
+	return Response{}, false
+}
+
+func (cache *Redis) Save(response Response) {
+	key, ok := newStorageKey(response)
+	if !ok {
+		log.Debugf("Saving %q : Response varies on every header, not saved", response.URL)
+		return
+	}
+	ttl := setExpires(&response, cache.DefaultTTL)
+	// Keep the response as long as it may be served stale, and retained past it
+	expiration := time.Until(retainUntil(response, cache.StaleRetention))
+	if expiration <= 0 {
+		log.Debugf("Saving %q : Response already obsolete, not saved", key)
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Saving %q : Cannot encode response : %s", key, err)
+		return
+	}
+
+	ctx := context.Background()
+	variantsKey := cache.variantsKey(responseIndexKey(response))
+	indexKeys := []string{variantsKey}
+	for _, tag := range Tags(response.ResponseHeaders) {
+		indexKeys = append(indexKeys, cache.tagKey(tag))
+	}
+	var variants []StorageKey
+	members, err := cache.client.SMembers(ctx, variantsKey).Result()
+	if err != nil {
+		log.Errorf("Saving %q : Cannot list the variants : %s", key, err)
+	}
+	for _, member := range members {
+		variants = append(variants, StorageKey(member))
+	}
+	outdated := outdatedVariants(response, variants, func(key StorageKey) Response {
+		variant, _ := cache.Lookup(key)
+		return variant
+	})
+	_, err = cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, variant := range outdated {
+			pipe.SRem(ctx, variantsKey, string(variant))
+			pipe.Del(ctx, cache.responseKey(variant))
+		}
+		pipe.Set(ctx, cache.responseKey(key), data, expiration)
+		for _, indexKey := range indexKeys {
+			pipe.SAdd(ctx, indexKey, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Saving %q : %s", key, err)
+		return
+	}
+	// The indexes live as long as their longest living response
+	for _, indexKey := range indexKeys {
+		if current, err := cache.client.PTTL(ctx, indexKey).Result(); err == nil && current < expiration {
+			cache.client.PExpire(ctx, indexKey, expiration)
+		}
+	}
+	for _, variant := range outdated {
+		log.Debugf("Saving %q : Variant %q varying on other headers removed", key, variant)
+	}
+	log.Debugf("Saving %q : Response saved for %s", key, ttl)
+}
+
+// Fill buffers the body of the response, stored in a single value once
+// committed.
+func (cache *Redis) Fill(response Response) BodyWriter {
+	return newBufferedBody(response, cache.Save, 0)
+}
+
+func (cache *Redis) Purge(req *http.Request, soft bool) {
+	ctx := req.Context()
+	variantsKey := cache.variantsKey(requestIndexKey(req))
+	keys, err := cache.client.SMembers(ctx, variantsKey).Result()
+	if err != nil {
+		log.Errorf("Purging %q : %s", req.URL, err)
+		return
+	}
+	if soft {
+		cache.countPurges(ctx, cache.expire(ctx, keys))
+		return
+	}
+	cache.countPurges(ctx, len(keys))
+	keysToDelete := []string{variantsKey}
+	for _, key := range keys {
+		keysToDelete = append(keysToDelete, cache.responseKey(StorageKey(key)))
+		log.Debugf("Purging %s", key)
+	}
+	if err := cache.client.Del(ctx, keysToDelete...).Err(); err != nil {
+		log.Errorf("Purging %q : %s", req.URL, err)
+	}
+}
+
+// PurgeTag removes the responses tagged with tag. Their keys left in the sets
+// of variants are removed on the next Get, like the expired ones.
+func (cache *Redis) PurgeTag(tag string, soft bool) int {
+	ctx := context.Background()
+	tagKey := cache.tagKey(tag)
+	keys, err := cache.client.SMembers(ctx, tagKey).Result()
+	if err != nil {
+		log.Errorf("Purging tag %q : %s", tag, err)
+		return 0
+	}
+	if soft {
+		purged := cache.expire(ctx, keys)
+		cache.countPurges(ctx, purged)
+		return purged
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+	responseKeys := make([]string, len(keys))
+	for i, key := range keys {
+		responseKeys[i] = cache.responseKey(StorageKey(key))
+		log.Debugf("Purging %s tagged %q", key, tag)
+	}
+	var purged *redis.IntCmd
+	_, err = cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		purged = pipe.Del(ctx, responseKeys...)
+		pipe.Del(ctx, tagKey)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Purging tag %q : %s", tag, err)
+		return 0
+	}
+	cache.countPurges(ctx, int(purged.Val()))
+	return int(purged.Val())
+}
+
+func (cache *Redis) Entries() []Entry {
+	var entries []Entry
+	cache.scan(context.Background(), func(key StorageKey, response Response, size int64) {
+		entries = append(entries, newEntry(key, response, size))
+	})
+	return entries
+}
+
+func (cache *Redis) Lookup(key StorageKey) (Response, bool) {
+	data, err := cache.client.Get(context.Background(), cache.responseKey(key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Errorf("Looking up %q : %s", key, err)
+		}
+		return Response{}, false
+	}
+	var response Response
+	if err := json.Unmarshal(data, &response); err != nil {
+		log.Errorf("Looking up %q : Cannot decode response : %s", key, err)
+		return Response{}, false
+	}
+	return response, true
+}
+
+func (cache *Redis) Walk(fn func(key StorageKey, response Response) error) error {
+	var err error
+	cache.scan(context.Background(), func(key StorageKey, response Response, size int64) {
+		if err == nil {
+			err = fn(key, response)
+		}
+	})
+	return err
+}
+
+func (cache *Redis) Delete(match func(Entry) bool) int {
+	ctx := context.Background()
+	deleted := 0
+	_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		cache.scan(ctx, func(key StorageKey, response Response, size int64) {
+			if match(newEntry(key, response, size)) {
+				pipe.Del(ctx, cache.responseKey(key))
+				pipe.SRem(ctx, cache.variantsKey(responseIndexKey(response)), string(key))
+				deleted++
+				log.Debugf("Deleting %s", key)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Deleting : %s", err)
+	}
+	cache.countPurges(ctx, deleted)
+	return deleted
+}
+
+func (cache *Redis) Expire(match func(Entry) bool) int {
+	ctx := context.Background()
+	expired := 0
+	_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		cache.scan(ctx, func(key StorageKey, response Response, size int64) {
+			if match(newEntry(key, response, size)) {
+				cache.markStale(ctx, pipe, key, response)
+				expired++
+				log.Debugf("Expiring %s", key)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Expiring : %s", err)
+	}
+	cache.countPurges(ctx, expired)
+	return expired
+}
+
+// Stats returns the stats of the responses shared by every instance, as last
+// measured. The evictions are left to the maxmemory policy of the server, and
+// not counted.
+func (cache *Redis) Stats() Stats {
+	cache.mutex.Lock()
+	stats := cache.measured
+	cache.mutex.Unlock()
+	purges, err := cache.client.Get(context.Background(), cache.purgesKey()).Int64()
+	if err != nil && err != redis.Nil {
+		log.Errorf("Getting purges : %s", err)
+	}
+	stats.Purges = purges
+	return stats
+}
+
+// StartMeasuring measures the responses stored right away and every interval,
+// until the returned function is called. An interval of 0 or less disables the
+// measures.
+func (cache *Redis) StartMeasuring(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			cache.measure()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// measure counts and measures the responses by the server, without fetching
+// them, rather than by counters which their expiration would leave behind.
+func (cache *Redis) measure() {
+	ctx := context.Background()
+	var stats Stats
+	cache.scanKeys(ctx, func(responseKeys []string) error {
+		lengths := make([]*redis.IntCmd, len(responseKeys))
+		_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, responseKey := range responseKeys {
+				lengths[i] = pipe.StrLen(ctx, responseKey)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, length := range lengths {
+			// Expired since scanned
+			if size := length.Val(); size > 0 {
+				stats.Entries++
+				stats.Size += size
+			}
+		}
+		return nil
+	})
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.measured = stats
+}
+
+// expire marks the responses stored under keys stale, and returns their count.
+func (cache *Redis) expire(ctx context.Context, keys []string) int {
+	expired := 0
+	_, err := cache.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			if response, ok := cache.Lookup(StorageKey(key)); ok {
+				cache.markStale(ctx, pipe, StorageKey(key), response)
+				expired++
+				log.Debugf("Expiring %s", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Expiring : %s", err)
+	}
+	return expired
+}
+
+// markStale stores the response marked stale, for as long as it may be served
+// stale and retained past it, until revalidated.
+func (cache *Redis) markStale(ctx context.Context, pipe redis.Pipeliner, key StorageKey, response Response) {
+	markStale(&response)
+	expiration := time.Until(retainUntil(response, cache.StaleRetention))
+	if expiration <= 0 {
+		pipe.Del(ctx, cache.responseKey(key))
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Expiring %q : Cannot encode response : %s", key, err)
+		return
+	}
+	pipe.Set(ctx, cache.responseKey(key), data, expiration)
+}
+
+// scan calls fn with every cached response, along with the size of its
+// encoded value.
+func (cache *Redis) scan(ctx context.Context, fn func(key StorageKey, response Response, size int64)) {
+	cache.scanKeys(ctx, func(responseKeys []string) error {
+		values, err := cache.client.MGet(ctx, responseKeys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var response Response
+			if err := json.Unmarshal([]byte(data), &response); err != nil {
+				log.Errorf("Scanning %q : Cannot decode response : %s", responseKeys[i], err)
+				continue
+			}
+			key := StorageKey(strings.TrimPrefix(responseKeys[i], cache.responseKey("")))
+			fn(key, response, int64(len(data)))
+		}
+		return nil
+	})
+}
+
+// scanKeys calls fn with the keys of the responses, by batches of at most
+// redisScanCount keys.
+func (cache *Redis) scanKeys(ctx context.Context, fn func(responseKeys []string) error) {
+	iterator := cache.client.Scan(ctx, 0, cache.responseKey("*"), redisScanCount).Iterator()
+	var responseKeys []string
+	for iterator.Next(ctx) {
+		responseKeys = append(responseKeys, iterator.Val())
+	}
+	if err := iterator.Err(); err != nil {
+		log.Errorf("Scanning : %s", err)
+		return
+	}
+	for start := 0; start < len(responseKeys); start += redisScanCount {
+		end := start + redisScanCount
+		if end > len(responseKeys) {
+			end = len(responseKeys)
+		}
+		if err := fn(responseKeys[start:end]); err != nil {
+			log.Errorf("Scanning : %s", err)
+			return
+		}
+	}
+}
+
+func (cache *Redis) responseKey(key StorageKey) string {
+	return cache.prefix + "response:" + string(key)
+}
+
+func (cache *Redis) variantsKey(indexKey string) string {
+	return cache.prefix + "variants:" + indexKey
+}
+
+// countPurges adds purged to the count of purged responses.
+func (cache *Redis) countPurges(ctx context.Context, purged int) {
+	if purged == 0 {
+		return
+	}
+	if err := cache.client.IncrBy(ctx, cache.purgesKey(), int64(purged)).Err(); err != nil {
+		log.Errorf("Counting purges : %s", err)
+	}
+}
+
+func (cache *Redis) purgesKey() string {
+	return cache.prefix + "purges"
+}
+
+func (cache *Redis) tagKey(tag string) string {
+	return cache.prefix + "tag:" + tag
+}
@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, func() *Redis) {
+	server := miniredis.RunT(t)
+	return server, func() *Redis {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedis(client, "caeche:", 3600, 0)
+	}
+}
+
+func TestRedisGetNotFoundResponse(t *testing.T) {
+	_, newCache := newTestRedis(t)
+	response, ok := newCache().Get(httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, Response{}, response)
+	assert.False(t, ok)
+}
+
+func TestRedisSaveAndGet(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	cache.Save(Response{
+		URL:             "http://localhost/foo",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		RequestHeaders:  http.Header{"Accept-Language": {"fr"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Language"}, "Cache-Control": {"max-age=60"}},
+		Body:            []byte("bonjour"),
+		Created:         time.Now(),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Accept-Language", "fr")
+	response, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "bonjour", string(response.Body))
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	req.Header.Set("Accept-Language", "en")
+	_, ok = cache.Get(req)
+	assert.False(t, ok)
+
+	for _, key := range server.Keys() {
+		if key != "caeche:variants:/foo" {
+			ttl := server.TTL(key)
+			assert.True(t, ttl > 59*time.Second && ttl <= 60*time.Second, "Key should expire with the response, got %s", ttl)
+		}
+	}
+}
+
+func TestRedisResponseExpires(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	cache.Save(Response{
+		URL:             "http://localhost/foo",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Cache-Control": {"max-age=60"}},
+		Created:         time.Now(),
+	})
+	server.FastForward(61 * time.Second)
+	_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.False(t, ok)
+}
+
+func TestRedisKeepsExpiredResponsesForStaleRetention(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	cache.StaleRetention = time.Hour
+	for _, p := range []string{"/retained", "/revalidated", "/validated"} {
+		headers := http.Header{"Cache-Control": {"max-age=60"}}
+		if p != "/retained" {
+			headers.Set("Cache-Control", "max-age=60, must-revalidate")
+		}
+		if p == "/validated" {
+			headers.Set("ETag", `"v1"`)
+		}
+		cache.Save(Response{
+			URL:             "http://localhost" + p,
+			Method:          http.MethodGet,
+			ResponseHeaders: headers,
+			Created:         time.Now().Add(-2 * time.Minute),
+		})
+	}
+	response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/retained", nil))
+	assert.True(t, ok)
+	assert.True(t, hasExpired(response))
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/revalidated", nil))
+	assert.False(t, ok, "A response which must be revalidated can't be served expired")
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/validated", nil))
+	assert.True(t, ok, "A response with validators can be revalidated once expired")
+
+	server.FastForward(time.Hour)
+	_, ok = cache.Get(httptest.NewRequest(http.MethodGet, "/retained", nil))
+	assert.False(t, ok)
+}
+
+func TestRedisSharedBetweenInstances(t *testing.T) {
+	_, newCache := newTestRedis(t)
+	first, second := newCache(), newCache()
+	first.Save(Response{URL: "http://localhost/foo", Method: http.MethodGet, Body: []byte("foo"), Created: time.Now()})
+
+	response, ok := second.Get(httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "foo", string(response.Body))
+
+	second.Purge(httptest.NewRequest("PURGE", "/foo", nil), false)
+	_, ok = first.Get(httptest.NewRequest(http.MethodGet, "/foo", nil))
+	assert.False(t, ok, "A purge should apply to every instance")
+}
+
+func TestRedisPurgeRemovesAllVariants(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	for _, language := range []string{"fr", "en"} {
+		cache.Save(Response{
+			URL:             "http://localhost/foo",
+			Method:          http.MethodGet,
+			RequestHeaders:  http.Header{"Accept-Language": {language}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{URL: "http://localhost/bar", Method: http.MethodGet, Created: time.Now()})
+	assert.Len(t, server.Keys(), 5)
+
+	cache.Purge(httptest.NewRequest("PURGE", "/foo", nil), false)
+	assert.Len(t, server.Keys(), 3, "Only /bar and the count of purges are left")
+	assert.Contains(t, server.Keys(), "caeche:purges")
+	assert.Equal(t, int64(2), cache.Stats().Purges)
+}
+
+func TestRedisSaveReplacesVariantsOfAnotherVary(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	for _, language := range []string{"fr", "en"} {
+		cache.Save(Response{
+			URL:             "http://localhost",
+			Method:          http.MethodGet,
+			RequestHeaders:  http.Header{"Accept-Language": {language}, "Accept-Encoding": {"gzip"}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Body:            []byte(language),
+			Created:         time.Now(),
+		})
+	}
+	cache.Save(Response{URL: "http://localhost", Method: http.MethodHead, Created: time.Now()})
+	cache.Save(Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		RequestHeaders:  http.Header{"Accept-Language": {"fr"}, "Accept-Encoding": {"gzip"}},
+		ResponseHeaders: http.Header{"Vary": {"Accept-Encoding"}},
+		Body:            []byte("gzip"),
+		Created:         time.Now(),
+	})
+	assert.Len(t, cache.Entries(), 2, "The variants of the previous Vary should be removed, not the other methods")
+	assert.Len(t, server.Keys(), 3)
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, "caeche:variants:") {
+			members, err := server.Members(key)
+			assert.NoError(t, err)
+			assert.Len(t, members, 2, "The variants removed should be unindexed")
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("Accept-Encoding", "gzip")
+	response, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", string(response.Body))
+	req.Header.Set("Accept-Language", "en")
+	response, ok = cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, "gzip", string(response.Body))
+}
+
+func TestRedisStatsMeasureStoredResponses(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	cache := newCache()
+	for _, p := range []string{"/a", "/b"} {
+		cache.Save(Response{URL: "http://localhost" + p, Method: http.MethodGet, Body: []byte(p), Created: time.Now()})
+	}
+	var size int64
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, "caeche:response:") {
+			value, err := server.Get(key)
+			assert.NoError(t, err)
+			size += int64(len(value))
+		}
+	}
+	assert.Equal(t, 0, cache.Stats().Entries, "The responses are measured every interval")
+	stop := cache.StartMeasuring(time.Hour)
+	defer stop()
+	assert.Eventually(t, func() bool { return cache.Stats().Entries == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, size, cache.Stats().Size)
+}
+
+func TestRedisSaveVaryStar(t *testing.T) {
+	server, newCache := newTestRedis(t)
+	newCache().Save(Response{
+		URL:             "http://localhost",
+		Method:          http.MethodGet,
+		ResponseHeaders: http.Header{"Vary": {"*"}},
+		Created:         time.Now(),
+	})
+	assert.Len(t, server.Keys(), 0)
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// Sharded spreads the responses over several InMemory caches, each one having
+// its own lock, so that concurrent requests for different resources don't
+// contend with each other. All the variants of a resource live in the same
+// shard.
+type Sharded struct {
+	shards []*InMemory
+}
+
+// NewSharded returns a cache made of shardCount shards, sharing equally the
+// maxSize and maxEntries limits. A limit of 0 means unlimited.
+func NewSharded(shardCount int, defaultTTL int, maxSize int64, maxEntries int) *Sharded {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	shardMaxSize := maxSize / int64(shardCount)
+	if maxSize > 0 && shardMaxSize == 0 {
+		shardMaxSize = 1
+	}
+	shardMaxEntries := maxEntries / shardCount
+	if maxEntries > 0 && shardMaxEntries == 0 {
+		shardMaxEntries = 1
+	}
+	shards := make([]*InMemory, shardCount)
+	for i := range shards {
+		shards[i] = NewInMemory(defaultTTL, shardMaxSize, shardMaxEntries)
+	}
+	return &Sharded{shards: shards}
+}
+
+func (cache *Sharded) Get(req *http.Request) (Response, bool) {
+	return cache.shard(requestIndexKey(req)).Get(req)
+}
+
+func (cache *Sharded) Save(response Response) {
+	cache.shard(responseIndexKey(response)).Save(response)
+}
+
+func (cache *Sharded) Restore(response Response) {
+	cache.shard(responseIndexKey(response)).Restore(response)
+}
+
+func (cache *Sharded) Fill(response Response) BodyWriter {
+	return cache.shard(responseIndexKey(response)).Fill(response)
+}
+
+func (cache *Sharded) Purge(req *http.Request, soft bool) {
+	cache.shard(requestIndexKey(req)).Purge(req, soft)
+}
+
+func (cache *Sharded) PurgeTag(tag string, soft bool) int {
+	purged := 0
+	for _, shard := range cache.shards {
+		purged += shard.PurgeTag(tag, soft)
+	}
+	return purged
+}
+
+func (cache *Sharded) Entries() []Entry {
+	var entries []Entry
+	for _, shard := range cache.shards {
+		entries = append(entries, shard.Entries()...)
+	}
+	return entries
+}
+
+func (cache *Sharded) Walk(fn func(key StorageKey, response Response) error) error {
+	for _, shard := range cache.shards {
+		if err := shard.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cache *Sharded) Lookup(key StorageKey) (Response, bool) {
+	for _, shard := range cache.shards {
+		if response, ok := shard.Lookup(key); ok {
+			return response, true
+		}
+	}
+	return Response{}, false
+}
+
+func (cache *Sharded) Delete(match func(Entry) bool) int {
+	deleted := 0
+	for _, shard := range cache.shards {
+		deleted += shard.Delete(match)
+	}
+	return deleted
+}
+
+func (cache *Sharded) Expire(match func(Entry) bool) int {
+	expired := 0
+	for _, shard := range cache.shards {
+		expired += shard.Expire(match)
+	}
+	return expired
+}
+
+func (cache *Sharded) Stats() Stats {
+	var stats Stats
+	for _, shard := range cache.shards {
+		shardStats := shard.Stats()
+		stats.Entries += shardStats.Entries
+		stats.Size += shardStats.Size
+		stats.Evictions += shardStats.Evictions
+		stats.Purges += shardStats.Purges
+	}
+	return stats
+}
+
+// StartJanitor starts the janitor of every shard, until the returned function
+// is called.
+func (cache *Sharded) StartJanitor(interval time.Duration, retention time.Duration) func() {
+	stops := make([]func(), len(cache.shards))
+	for i, shard := range cache.shards {
+		stops[i] = shard.StartJanitor(interval, retention)
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func (cache *Sharded) shard(indexKey string) *InMemory {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(indexKey))
+	return cache.shards[hash.Sum32()%uint32(len(cache.shards))]
+}
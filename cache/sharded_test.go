@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedSplitsLimits(t *testing.T) {
+	cache := NewSharded(4, 3600, 1000, 2)
+	assert.Len(t, cache.shards, 4)
+	for _, shard := range cache.shards {
+		assert.Equal(t, int64(250), shard.MaxSize)
+		assert.Equal(t, 1, shard.MaxEntries)
+	}
+}
+
+func TestShardedGetSavePurge(t *testing.T) {
+	cache := NewSharded(8, 3600, 0, 0)
+	for i := 0; i < 100; i++ {
+		cache.Save(Response{
+			URL:             fmt.Sprintf("http://backend/%d", i),
+			Method:          http.MethodGet,
+			StatusCode:      http.StatusOK,
+			RequestHeaders:  http.Header{"Accept-Language": {"fr"}},
+			ResponseHeaders: http.Header{"Vary": {"Accept-Language"}},
+			Created:         time.Now(),
+		})
+	}
+	usedShards := 0
+	for _, shard := range cache.shards {
+		if len(shard.store) > 0 {
+			usedShards++
+		}
+	}
+	assert.Greater(t, usedShards, 1, "Responses should be spread over several shards")
+
+	req := httptest.NewRequest(http.MethodGet, "/42", nil)
+	req.Header.Set("Accept-Language", "fr")
+	_, ok := cache.Get(req)
+	assert.True(t, ok)
+
+	cache.Purge(httptest.NewRequest("PURGE", "/42", nil), false)
+	_, ok = cache.Get(req)
+	assert.False(t, ok)
+}
+
+// TestShardedConcurrentAccess is meant to be run with -race.
+func TestShardedConcurrentAccess(t *testing.T) {
+	cache := NewSharded(4, 3600, 64*1024, 50)
+	stop := cache.StartJanitor(time.Millisecond, 0)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				path := fmt.Sprintf("/%d", (worker*i)%80)
+				switch i % 3 {
+				case 0:
+					cache.Save(Response{
+						URL:        "http://backend" + path,
+						Method:     http.MethodGet,
+						StatusCode: http.StatusOK,
+						Body:       []byte(path),
+						Created:    time.Now(),
+					})
+				case 1:
+					if response, ok := cache.Get(httptest.NewRequest(http.MethodGet, path, nil)); ok {
+						assert.Equal(t, path, string(response.Body))
+					}
+				case 2:
+					cache.Purge(httptest.NewRequest("PURGE", path, nil), false)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	stop()
+
+	for _, shard := range cache.shards {
+		assert.LessOrEqual(t, len(shard.store), shard.MaxEntries)
+		assert.LessOrEqual(t, shard.size, shard.MaxSize)
+	}
+}
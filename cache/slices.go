@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SliceHeader carries the index of a slice of a resource in the requests
+// fetching it. The slices are cached as 206 Partial Content variants of the
+// resource varying on it, so that they're purged along with the resource.
+const SliceHeader = "Caeche-Slice"
+
+// SliceRequest returns the request for the slice at index of the resource,
+// slices being sliceSize bytes long.
+func SliceRequest(req *http.Request, index int64, sliceSize int64) *http.Request {
+	sliceReq := req.Clone(req.Context())
+	for _, name := range conditionalHeaders {
+		sliceReq.Header.Del(name)
+	}
+	start := index * sliceSize
+	sliceReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+sliceSize-1))
+	sliceReq.Header.Set(SliceHeader, strconv.FormatInt(index, 10))
+	return sliceReq
+}
+
+// IsSlice tells if the response is a slice fetched by a slice request.
+func IsSlice(res *http.Response) bool {
+	return res.StatusCode == http.StatusPartialContent && res.Request != nil && res.Request.Header.Get(SliceHeader) != ""
+}
+
+// VaryOnSlice makes the headers of a slice vary on its index.
+func VaryOnSlice(headers http.Header) {
+	headers.Add("Vary", SliceHeader)
+}
+
+// ParseContentRange returns the range of a partial response, and the size of
+// the whole body.
+func ParseContentRange(header string) (ByteRange, int64, error) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return ByteRange{}, 0, fmt.Errorf("invalid Content-Range %q: %w", header, err)
+	}
+	if start < 0 || end < start || end >= size {
+		return ByteRange{}, 0, errors.New("invalid Content-Range " + strconv.Quote(header))
+	}
+	return ByteRange{Start: start, Length: end - start + 1}, size, nil
+}
+
+// CopySliceHeaders copies the headers of a cached slice of a resource as the
+// ones of the whole resource.
+func CopySliceHeaders(rw http.ResponseWriter, slice Response) {
+	copyHeaders(rw, slice)
+	rw.Header().Del("Content-Range")
+	rw.Header().Del("Content-Length")
+	var vary []string
+	for _, name := range strings.Split(strings.Join(rw.Header().Values("Vary"), ","), ",") {
+		if name = strings.TrimSpace(name); name != "" && http.CanonicalHeaderKey(name) != SliceHeader {
+			vary = append(vary, name)
+		}
+	}
+	rw.Header().Del("Vary")
+	if len(vary) > 0 {
+		rw.Header().Set("Vary", strings.Join(vary, ", "))
+	}
+	rw.Header().Set("Accept-Ranges", "bytes")
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A snapshot is a stream of cached responses: the snapshotMagic header and
+// the version of the format, followed by the records of the responses and an
+// empty record. A record is the length of the JSON of the response without
+// its body, the JSON itself, the length of the body and the body, lengths
+// being uvarints. The bodies are streamed as is, whatever their size.
+const (
+	snapshotMagic   = "caeche-snapshot\n"
+	SnapshotVersion = 1
+	// maxSnapshotMetadata bounds the JSON of a response, to fail early on
+	// corrupted snapshots
+	maxSnapshotMetadata = 16 * 1024 * 1024
+)
+
+// ErrInvalidSnapshot is returned when reading a stream which isn't a snapshot,
+// or of an unsupported version.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Restorer is implemented by the caches whose responses can be restored from
+// a snapshot.
+type Restorer interface {
+	// Restore saves the response as it was cached, keeping its expiration,
+	// unless a more recent version of it is already cached
+	Restore(response Response)
+}
+
+// WriteSnapshot writes the responses of the cache which can still be served,
+// even stale, and returns their count.
+func WriteSnapshot(writer io.Writer, inspector Inspector) (int, error) {
+	buffered := bufio.NewWriter(writer)
+	if _, err := buffered.WriteString(snapshotMagic); err != nil {
+		return 0, err
+	}
+	if err := writeUvarint(buffered, SnapshotVersion); err != nil {
+		return 0, err
+	}
+	written := 0
+	err := inspector.Walk(func(key StorageKey, response Response) error {
+		if isObsolete(response) {
+			return nil
+		}
+		if err := writeSnapshotRecord(buffered, response); err != nil {
+			return fmt.Errorf("writing %s: %w", key, err)
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+	if err := writeUvarint(buffered, 0); err != nil {
+		return written, err
+	}
+	return written, buffered.Flush()
+}
+
+func writeSnapshotRecord(writer *bufio.Writer, response Response) error {
+	body, err := response.OpenBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	response.Body = nil
+	metadata, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if err := writeUvarint(writer, uint64(len(metadata))); err != nil {
+		return err
+	}
+	if _, err := writer.Write(metadata); err != nil {
+		return err
+	}
+	if err := writeUvarint(writer, uint64(size)); err != nil {
+		return err
+	}
+	_, err = io.CopyN(writer, body, size)
+	return err
+}
+
+func writeUvarint(writer *bufio.Writer, value uint64) error {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	_, err := writer.Write(buffer[:binary.PutUvarint(buffer, value)])
+	return err
+}
+
+// ReadSnapshot restores the responses of the snapshot which can still be
+// served, even stale, and returns their count. The responses read before an
+// error are restored.
+func ReadSnapshot(reader io.Reader, restorer Restorer) (int, error) {
+	buffered := bufio.NewReader(reader)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(buffered, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, ErrInvalidSnapshot
+	}
+	version, err := binary.ReadUvarint(buffered)
+	if err != nil {
+		return 0, ErrInvalidSnapshot
+	}
+	if version != SnapshotVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+
+	restored := 0
+	for {
+		response, ok, err := readSnapshotRecord(buffered)
+		if err != nil {
+			return restored, err
+		}
+		if !ok {
+			return restored, nil
+		}
+		if isObsolete(response) {
+			continue
+		}
+		restorer.Restore(response)
+		restored++
+	}
+}
+
+// readSnapshotRecord reads the next response of the snapshot, returning false
+// once they've all been read.
+func readSnapshotRecord(reader *bufio.Reader) (Response, bool, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return Response{}, false, unexpectedEOF(err)
+	}
+	if length == 0 {
+		return Response{}, false, nil
+	}
+	if length > maxSnapshotMetadata {
+		return Response{}, false, fmt.Errorf("%w: response of %d bytes", ErrInvalidSnapshot, length)
+	}
+	metadata := make([]byte, length)
+	if _, err := io.ReadFull(reader, metadata); err != nil {
+		return Response{}, false, unexpectedEOF(err)
+	}
+	var response Response
+	if err := json.Unmarshal(metadata, &response); err != nil {
+		return Response{}, false, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return Response{}, false, unexpectedEOF(err)
+	}
+	// The body is read as it comes rather than allocated upfront, its size
+	// being untrusted
+	if response.Body, err = io.ReadAll(io.LimitReader(reader, int64(size))); err != nil {
+		return Response{}, false, err
+	}
+	if uint64(len(response.Body)) != size {
+		return Response{}, false, io.ErrUnexpectedEOF
+	}
+	response.Created = response.Created.UTC()
+	response.Expires = response.Expires.UTC()
+	return response, true, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for name, source := range newTestInspectors(t) {
+		source := source
+		t.Run(name, func(t *testing.T) {
+			fresh := Response{
+				URL:             "http://backend/fresh",
+				Method:          http.MethodGet,
+				StatusCode:      http.StatusOK,
+				RequestHeaders:  http.Header{"Accept-Encoding": {"gzip"}},
+				ResponseHeaders: http.Header{"Vary": {"Accept-Encoding"}, "Cache-Tag": {"product"}},
+				Body:            []byte("fresh body"),
+				Created:         time.Now().UTC(),
+				Namespace:       "api",
+				DefaultTTL:      60,
+			}
+			source.Save(fresh)
+			staleWhileRevalidate := Response{
+				URL:             "http://backend/stale",
+				Method:          http.MethodGet,
+				StatusCode:      http.StatusOK,
+				ResponseHeaders: http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=3600"}},
+				Body:            []byte("stale body"),
+				Created:         time.Now().UTC().Add(-time.Minute),
+			}
+			source.Save(staleWhileRevalidate)
+			source.Save(Response{
+				URL:             "http://backend/obsolete",
+				Method:          http.MethodGet,
+				StatusCode:      http.StatusOK,
+				ResponseHeaders: http.Header{"Cache-Control": {"max-age=1"}},
+				Body:            []byte("obsolete body"),
+				Created:         time.Now().UTC().Add(-time.Minute),
+			})
+
+			var snapshot bytes.Buffer
+			written, err := WriteSnapshot(&snapshot, source)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, written)
+
+			restored := NewSharded(4, 3600, 0, 0)
+			read, err := ReadSnapshot(&snapshot, restored)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, read)
+			assert.Equal(t, 2, restored.Stats().Entries)
+
+			req := httptest.NewRequest(http.MethodGet, "http://backend/fresh", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			req = WithNamespace(req, "api")
+			response, ok := restored.Get(req)
+			assert.True(t, ok)
+			assert.Equal(t, "fresh body", readBody(t, response))
+			assert.True(t, response.Expires.After(time.Now()))
+			assert.Equal(t, 60, response.DefaultTTL)
+			assert.Equal(t, 1, restored.PurgeTag("product", false))
+
+			response, ok = restored.Get(httptest.NewRequest(http.MethodGet, "http://backend/stale", nil))
+			assert.True(t, ok)
+			assert.True(t, hasExpired(response), "Expiration not kept")
+			assert.Equal(t, "stale body", readBody(t, response))
+		})
+	}
+}
+
+func TestReadInvalidSnapshot(t *testing.T) {
+	source := NewInMemory(3600, 0, 0)
+	source.Save(Response{URL: "http://backend/a", Method: http.MethodGet, StatusCode: http.StatusOK, Body: []byte("a"), Created: time.Now()})
+	source.Save(Response{URL: "http://backend/b", Method: http.MethodGet, StatusCode: http.StatusOK, Body: []byte("b"), Created: time.Now()})
+	var snapshot bytes.Buffer
+	_, err := WriteSnapshot(&snapshot, source)
+	assert.NoError(t, err)
+
+	_, err = ReadSnapshot(bytes.NewReader([]byte("not a snapshot at all")), NewInMemory(3600, 0, 0))
+	assert.ErrorIs(t, err, ErrInvalidSnapshot)
+
+	newerVersion := append([]byte(snapshotMagic), SnapshotVersion+1)
+	_, err = ReadSnapshot(bytes.NewReader(newerVersion), NewInMemory(3600, 0, 0))
+	assert.ErrorIs(t, err, ErrInvalidSnapshot)
+
+	restored := NewInMemory(3600, 0, 0)
+	read, err := ReadSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-3]), restored)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, 1, read)
+	assert.Equal(t, 1, restored.Stats().Entries)
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+)
+
+// errBodyTooLarge aborts the storage of a body exceeding the size limit.
+var errBodyTooLarge = errors.New("body too large")
+
+// BodyWriter stores the body of a response as it's written, the response
+// being saved along with it once committed.
+type BodyWriter interface {
+	io.Writer
+	// Commit saves the response with the body written so far
+	Commit() error
+	// Abort drops the body written so far, without saving the response
+	Abort()
+}
+
+// bufferedBody keeps the body in memory until it's committed, for the caches
+// holding whole bodies anyway.
+type bufferedBody struct {
+	response Response
+	save     func(Response)
+	maxSize  int64
+	buffer   bytes.Buffer
+}
+
+// newBufferedBody returns the writer of the body of the response, saved with
+// save once committed, and refusing bodies larger than maxSize bytes. A
+// maxSize of 0 means unlimited.
+func newBufferedBody(response Response, save func(Response), maxSize int64) *bufferedBody {
+	return &bufferedBody{response: response, save: save, maxSize: maxSize}
+}
+
+func (body *bufferedBody) Write(data []byte) (int, error) {
+	if body.maxSize > 0 && int64(body.buffer.Len()+len(data)) > body.maxSize {
+		return 0, errBodyTooLarge
+	}
+	return body.buffer.Write(data)
+}
+
+func (body *bufferedBody) Commit() error {
+	body.response.Body = body.buffer.Bytes()
+	body.save(body.response)
+	return nil
+}
+
+func (body *bufferedBody) Abort() {
+	body.buffer = bytes.Buffer{}
+}
+
+// fill saves the response to the cache, streaming its body from its reader.
+func fill(cache Cache, response Response) error {
+	body, err := response.OpenBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	response.Body = nil
+	response.bodyPath = ""
+	writer := cache.Fill(response)
+	if _, err := io.Copy(writer, body); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
+}
+
+// Fill stores the body of a response with the BodyWriter of a cache while
+// it's streamed to the client, giving up on storing it, but without ever
+// failing the stream, when it exceeds the maximum object size or the storage
+// fails.
+type Fill struct {
+	writer  BodyWriter
+	maxSize int64
+	written int64
+	err     error
+}
+
+// NewFill returns the fill of writer, storing at most maxSize bytes. A maxSize
+// of 0 means unlimited.
+func NewFill(writer BodyWriter, maxSize int64) *Fill {
+	return &Fill{writer: writer, maxSize: maxSize}
+}
+
+// Write always succeeds, the body being written to the cache only until it
+// fails.
+func (fill *Fill) Write(data []byte) (int, error) {
+	if fill.err != nil {
+		return len(data), nil
+	}
+	fill.written += int64(len(data))
+	if fill.maxSize > 0 && fill.written > fill.maxSize {
+		fill.abort(errBodyTooLarge)
+		return len(data), nil
+	}
+	if _, err := fill.writer.Write(data); err != nil {
+		fill.abort(err)
+	}
+	return len(data), nil
+}
+
+// Commit saves the response unless its body couldn't be stored, and tells if
+// it was saved.
+func (fill *Fill) Commit() bool {
+	if fill.err != nil {
+		log.Debugf("Response not saved : %s", fill.err)
+		return false
+	}
+	if err := fill.writer.Commit(); err != nil {
+		log.Errorf("Response not saved : %s", err)
+		return false
+	}
+	return true
+}
+
+// Abort drops the body written so far, e.g. when the backend failed to send
+// it whole.
+func (fill *Fill) Abort() {
+	fill.abort(errors.New("aborted"))
+}
+
+func (fill *Fill) abort(err error) {
+	if fill.err == nil {
+		fill.err = fmt.Errorf("storing body after %d bytes: %w", fill.written, err)
+		fill.writer.Abort()
+	}
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readBody(t *testing.T, response Response) string {
+	body, err := response.OpenBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func newFilledResponse() Response {
+	return Response{
+		URL:             "http://backend/download",
+		Method:          http.MethodGet,
+		StatusCode:      http.StatusOK,
+		ResponseHeaders: http.Header{},
+		Created:         time.Now(),
+	}
+}
+
+func TestFill(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			fill := NewFill(cache.Fill(newFilledResponse()), 0)
+			_, err := io.Copy(fill, io.MultiReader(strings.NewReader("first chunk, "), strings.NewReader("second chunk")))
+			assert.NoError(t, err)
+			assert.True(t, fill.Commit())
+
+			response, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/download", nil))
+			assert.True(t, ok)
+			assert.Equal(t, "first chunk, second chunk", readBody(t, response))
+		})
+	}
+}
+
+func TestFillAboveMaxObjectSize(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			fill := NewFill(cache.Fill(newFilledResponse()), 8)
+			written, err := io.Copy(fill, strings.NewReader("more than eight bytes"))
+			assert.NoError(t, err, "The body keeps being written")
+			assert.Equal(t, int64(21), written)
+			assert.False(t, fill.Commit())
+
+			_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/download", nil))
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestFillAborted(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			fill := NewFill(cache.Fill(newFilledResponse()), 0)
+			fill.Write([]byte("truncated"))
+			fill.Abort()
+			assert.False(t, fill.Commit())
+
+			_, ok := cache.Get(httptest.NewRequest(http.MethodGet, "/download", nil))
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestFillAboveCacheMaxSize(t *testing.T) {
+	disk, path := newTestDisk(t, 512)
+	for name, cache := range map[string]Cache{"memory": NewInMemory(3600, 512, 0), "disk": disk} {
+		fill := NewFill(cache.Fill(newFilledResponse()), 0)
+		fill.Write(make([]byte, 1024))
+		assert.False(t, fill.Commit(), name)
+	}
+	tempFiles, _ := filepath.Glob(filepath.Join(path, "*.tmp"))
+	assert.Empty(t, tempFiles)
+}
+
+func TestDiskRefreshKeepsBody(t *testing.T) {
+	cache, path := newTestDisk(t, 0)
+	fill := NewFill(cache.Fill(newFilledResponse()), 0)
+	fill.Write([]byte("body"))
+	fill.Commit()
+	req := httptest.NewRequest(http.MethodGet, "/download", nil)
+	response, _ := cache.Get(req)
+
+	cache.Save(Refresh(response, &http.Response{Header: http.Header{"Etag": {`"v2"`}}}, time.Now()))
+	refreshed, ok := cache.Get(req)
+	assert.True(t, ok)
+	assert.Equal(t, `"v2"`, refreshed.ResponseHeaders.Get("Etag"))
+	assert.Equal(t, "body", readBody(t, refreshed))
+	assert.Equal(t, 1, countBodyFiles(t, path))
+}
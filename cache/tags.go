@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// tagHeaders are the response headers listing the tags of a response, by
+// which it can be purged along with the other responses sharing a tag.
+var tagHeaders = map[string]string{
+	"Surrogate-Key": " ",
+	"Cache-Tag":     ",",
+}
+
+// Tags returns the sorted, deduplicated tags listed in the Surrogate-Key
+// header, separated by spaces, and the Cache-Tag header, separated by commas.
+func Tags(headers http.Header) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for name, separator := range tagHeaders {
+		for _, value := range headers.Values(name) {
+			for _, tag := range strings.Split(value, separator) {
+				tag = strings.TrimSpace(tag)
+				if tag != "" && !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// tagKey indexes the key of the response under each of its tags.
+func tagKey(index map[string]map[StorageKey]bool, key StorageKey, response Response) {
+	for _, tag := range Tags(response.ResponseHeaders) {
+		if index[tag] == nil {
+			index[tag] = make(map[StorageKey]bool)
+		}
+		index[tag][key] = true
+	}
+}
+
+// untagKey removes the key of the response from the index of its tags.
+func untagKey(index map[string]map[StorageKey]bool, key StorageKey, response Response) {
+	for _, tag := range Tags(response.ResponseHeaders) {
+		delete(index[tag], key)
+		if len(index[tag]) == 0 {
+			delete(index, tag)
+		}
+	}
+}
+
+// StripTags removes the headers listing the tags of a response, which are
+// meant for the cache only.
+func StripTags(headers http.Header) {
+	for name := range tagHeaders {
+		headers.Del(name)
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTags(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Surrogate-Key", "product-42  category-3")
+	headers.Add("Cache-Tag", "home, product-42")
+	assert.Equal(t, []string{"category-3", "home", "product-42"}, Tags(headers))
+	assert.Empty(t, Tags(http.Header{}))
+
+	StripTags(headers)
+	assert.Empty(t, headers)
+}
+
+func TestPurgeTag(t *testing.T) {
+	for name, cache := range newTestInspectors(t) {
+		cache := cache
+		t.Run(name, func(t *testing.T) {
+			for path, tags := range map[string]string{"/products/42": "product-42 home", "/": "home", "/about": ""} {
+				response := Response{
+					URL:             "http://backend" + path,
+					Method:          http.MethodGet,
+					StatusCode:      http.StatusOK,
+					ResponseHeaders: http.Header{},
+					Created:         time.Now(),
+				}
+				response.ResponseHeaders.Set("Surrogate-Key", tags)
+				cache.Save(response)
+			}
+
+			assert.Equal(t, 2, cache.PurgeTag("home", false))
+			assert.Equal(t, 0, cache.PurgeTag("home", false))
+			assert.Equal(t, 0, cache.PurgeTag("product-42", false), "Purged responses are removed from all their tags")
+			for path, cached := range map[string]bool{"/products/42": false, "/": false, "/about": true} {
+				_, ok := cache.Get(httptest.NewRequest(http.MethodGet, path, nil))
+				assert.Equal(t, cached, ok, path)
+			}
+		})
+	}
+}
+
+func TestWriteResponseStripsTags(t *testing.T) {
+	response := Response{StatusCode: http.StatusOK, ResponseHeaders: http.Header{}, Created: time.Now()}
+	response.ResponseHeaders.Set("Surrogate-Key", "home")
+	response.ResponseHeaders.Set("Content-Type", "text/plain")
+	recorder := httptest.NewRecorder()
+	WriteResponse(recorder, httptest.NewRequest(http.MethodGet, "/", nil), response)
+	assert.Empty(t, recorder.Header().Get("Surrogate-Key"))
+	assert.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+}
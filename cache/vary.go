@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type StorageKey string
+
+// newStorageKey builds the key of a response from its namespace, its method,
+// its host and URL, and the request headers named in its Vary header. It returns false
+// when the response varies on "*", which means it can't be matched against any
+// future request.
+func newStorageKey(response Response) (StorageKey, bool) {
+	names, ok := varyHeaderNames(response.ResponseHeaders)
+	if !ok {
+		return "", false
+	}
+	resource := response.URL
+	if response.Host != "" {
+		// The URL is the one of the backend, shared by the hosts of the route
+		resource = response.Host + "_" + resource
+	}
+	key := fmt.Sprintf("%s_%s_%s", response.Method, resource, hashHeaders(selectHeaders(names, response.RequestHeaders)))
+	return StorageKey(namespaced(response.Namespace, key)), true
+}
+
+// Variant identifies the variant of a resource the request selects, among the
+// ones of a response with the given headers, by the values of the request
+// headers named in its Vary header. It returns false when the response varies
+// on "*", which no request selects.
+func Variant(req *http.Request, responseHeaders http.Header) (string, bool) {
+	names, ok := varyHeaderNames(responseHeaders)
+	if !ok {
+		return "", false
+	}
+	return hashHeaders(selectHeaders(names, req.Header)), true
+}
+
+// selectHeaders returns the normalized values of the named headers.
+func selectHeaders(names []string, headers http.Header) http.Header {
+	selected := http.Header{}
+	for _, name := range names {
+		selected[name] = []string{normalizeHeaderValues(headers.Values(name))}
+	}
+	return selected
+}
+
+// newIndexKey returns the key under which all the variants of a resource are
+// indexed. Only the host requested and the request URI are kept, within its
+// namespace, so that a resource can be found from an incoming request as well
+// as from a request rewritten for the backend.
+func newIndexKey(namespace string, host string, rawURL string) string {
+	return namespaced(namespace, host+requestURI(rawURL))
+}
+
+// requestURI returns the path and query of the URL.
+func requestURI(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsedURL.RequestURI()
+}
+
+func requestIndexKey(req *http.Request) string {
+	return newIndexKey(Namespace(req), Host(req), req.URL.String())
+}
+
+func responseIndexKey(response Response) string {
+	return newIndexKey(response.Namespace, response.Host, response.URL)
+}
+
+// namespaced prefixes the key with its namespace, keeping the keys of the
+// default namespace unchanged.
+func namespaced(namespace string, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + ":" + key
+}
+
+// varyHeaderNames returns the sorted, canonical names of the headers listed in
+// the Vary response header, or false if the response varies on "*".
+func varyHeaderNames(headers http.Header) ([]string, bool) {
+	var names []string
+	seen := map[string]bool{}
+	for _, value := range headers.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			name = http.CanonicalHeaderKey(name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// matchesVary tells if the headers of the request select the given response,
+// i.e. if every header named in its Vary header has the same value as in the
+// request that produced it.
+func matchesVary(response Response, req *http.Request) bool {
+	names, ok := varyHeaderNames(response.ResponseHeaders)
+	if !ok {
+		return false
+	}
+	for _, name := range names {
+		if normalizeHeaderValues(req.Header.Values(name)) != normalizeHeaderValues(response.RequestHeaders.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// outdatedVariants returns the variants of the resource of the response, among
+// the ones cached under keys, which the response replaces as they have its
+// method but vary on other headers, e.g. since the backend changed its Vary
+// header.
+func outdatedVariants(response Response, keys []StorageKey, lookup func(StorageKey) Response) []StorageKey {
+	names, _ := varyHeaderNames(response.ResponseHeaders)
+	var outdated []StorageKey
+	for _, key := range keys {
+		variant := lookup(key)
+		if variant.Method != response.Method {
+			continue
+		}
+		if variantNames, _ := varyHeaderNames(variant.ResponseHeaders); strings.Join(variantNames, ",") != strings.Join(names, ",") {
+			outdated = append(outdated, key)
+		}
+	}
+	return outdated
+}
+
+func normalizeHeaderValues(values []string) string {
+	var normalized []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.Join(strings.Fields(part), " "); part != "" {
+				normalized = append(normalized, part)
+			}
+		}
+	}
+	return strings.Join(normalized, ", ")
+}
+
+func hashHeaders(headers http.Header) string {
+	jsonData, err := json.Marshal(headers)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	hash := sha256.New()
+	_, err = hash.Write(jsonData)
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
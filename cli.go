@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/sdelicata/caeche/config"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runCommand runs the subcommand of the command line, against a running
+// proxy.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "snapshot":
+		return runSnapshot(args)
+	case "warm":
+		return runWarm(args)
+	default:
+		return fmt.Errorf("unknown command %q, expecting \"snapshot\" or \"warm\"", name)
+	}
+}
+
+// adminClient requests the admin API of a running proxy, with the address and
+// credentials of config.toml unless overridden by the flags.
+type adminClient struct {
+	url      *string
+	token    *string
+	certFile *string
+	keyFile  *string
+	insecure *bool
+}
+
+func newAdminClient(flags *flag.FlagSet) *adminClient {
+	cfg, err := config.NewConfigFromFile(configFile)
+	if err != nil {
+		cfg = config.NewConfigWithDefault()
+	}
+	url := ""
+	if cfg.Admin.Port != "" {
+		scheme := "http"
+		if cfg.Admin.CertFile != "" {
+			scheme = "https"
+		}
+		url = scheme + "://localhost:" + cfg.Admin.Port
+	}
+	return &adminClient{
+		url:      flags.String("admin", url, "URL of the admin API"),
+		token:    flags.String("token", cfg.Admin.Token, "token of the admin API"),
+		certFile: flags.String("cert", "", "client certificate of the admin API"),
+		keyFile:  flags.String("key", "", "key of the client certificate"),
+		insecure: flags.Bool("insecure", false, "skip the verification of the certificate of the admin API"),
+	}
+}
+
+// do sends the request to the path of the admin API, and returns the
+// response when successful.
+func (client *adminClient) do(method string, path string, body io.Reader) (*http.Response, error) {
+	if *client.url == "" {
+		return nil, fmt.Errorf("no admin API in %s, set its URL with -admin", configFile)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*client.url, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if *client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+*client.token)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: *client.insecure}
+	if *client.certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(*client.certFile, *client.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("admin API responded with %d : %s", res.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return res, nil
+}
+
+// openOutput opens the file at path to be written, "-" meaning stdout.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+// openInput opens the file at path to be read, "-" meaning stdin.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
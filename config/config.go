@@ -5,25 +5,264 @@ import (
 )
 
 const (
-	DEFAULT_PORT           string = "8080"
-	DEFAULT_READ_TIMEOUT   int    = 10
-	DEFAULT_WRITE_TIMEOUT  int    = 10
-	DEFAULT_BACKEND_SCHEME string = "http"
-	DEFAULT_BACKEND_HOST   string = ":80"
-	DEFAULT_DEFAULT_TTL    int    = 3600
+	DEFAULT_PORT                       string  = "8080"
+	DEFAULT_READ_TIMEOUT               int     = 10
+	DEFAULT_WRITE_TIMEOUT              int     = 10
+	DEFAULT_SHUTDOWN_TIMEOUT           int     = 30
+	DEFAULT_BACKEND_SCHEME             string  = "http"
+	DEFAULT_BACKEND_HOST               string  = ":80"
+	DEFAULT_BACKEND_BALANCING          string  = "round-robin"
+	DEFAULT_HEALTH_CHECK_INTERVAL      int     = 10
+	DEFAULT_HEALTH_CHECK_TIMEOUT       int     = 5
+	DEFAULT_EJECTION_TIME              int     = 30
+	DEFAULT_DEFAULT_TTL                int     = 3600
+	DEFAULT_CACHE_TYPE                 string  = "memory"
+	DEFAULT_CACHE_REDIS_ADDRESS        string  = "localhost:6379"
+	DEFAULT_CACHE_REDIS_PREFIX         string  = "caeche:"
+	DEFAULT_CACHE_REDIS_STATS_INTERVAL int     = 60
+	DEFAULT_CACHE_PATH                 string  = "caeche_data"
+	DEFAULT_CACHE_MAX_SIZE             int64   = 256 * 1024 * 1024
+	DEFAULT_CACHE_MAX_ENTRIES          int     = 0
+	DEFAULT_CACHE_MAX_OBJECT_SIZE      int64   = 64 * 1024 * 1024
+	DEFAULT_CACHE_JANITOR_INTERVAL     int     = 60
+	DEFAULT_CACHE_STALE_RETENTION      int     = 86400
+	DEFAULT_CACHE_SHARDS               int     = 16
+	DEFAULT_CACHE_COALESCING_TIMEOUT   int     = 10
+	DEFAULT_CACHE_DEBUG_HEADER         bool    = false
+	DEFAULT_ADMIN_PUBLIC_PURGE         bool    = false
+	DEFAULT_LOG_LEVEL                  string  = "info"
+	DEFAULT_LOG_FORMAT                 string  = "text"
+	DEFAULT_ACCESS_LOG_OUTPUT          string  = "stdout"
+	DEFAULT_ACCESS_LOG_FORMAT          string  = "combined"
+	DEFAULT_TRACING_ENDPOINT           string  = "localhost:4318"
+	DEFAULT_TRACING_SAMPLE_RATIO       float64 = 1
+	DEFAULT_TRACING_SERVICE_NAME       string  = "caeche"
+	DEFAULT_COMPRESSION_MIN_SIZE       int64   = 1024
+	DEFAULT_COMPRESSION_STORE          bool    = false
 )
 
 type Config struct {
-	Port    string
-	DefaultTTL int
-	ReadTimeout int
+	Port         string
+	DefaultTTL   int
+	ReadTimeout  int
 	WriteTimeout int
+	// ShutdownTimeout is the number of seconds the requests in flight have to complete on shutdown
+	ShutdownTimeout int
+	// Backend receives the requests matching none of the routes
 	Backend BackendConfig
+	// Backends are the named backends the routes forward the requests to
+	Backends map[string]BackendConfig
+	// Routes are matched in order against the requests
+	Routes      []RouteConfig
+	Cache       CacheConfig
+	Compression CompressionConfig
+	Admin       AdminConfig
+	Log         LogConfig
+	Tracing     TracingConfig
 }
 
+var (
+	DEFAULT_COMPRESSION_ENCODINGS     = []string{"br", "zstd", "gzip"}
+	DEFAULT_COMPRESSION_CONTENT_TYPES = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/manifest+json",
+		"application/wasm",
+		"image/svg+xml",
+	}
+)
+
 type BackendConfig struct {
+	// Host is the server of the backend, or the Host header sent to its replicas,
+	// DEFAULT_BACKEND_HOST being the server when both Host and Hosts are empty
 	Host   string
 	Scheme string
+	// Hosts are the replicas of the backend, Host being the only one when empty
+	Hosts []string
+	// Balancing spreads the requests over the replicas: "round-robin", "least-connections"
+	// or "consistent-hash" by URL
+	Balancing string
+	// MaxFails is the number of consecutive failures ejecting a replica, 0 meaning never
+	MaxFails int
+	// EjectionTime is the number of seconds an ejected replica doesn't receive requests
+	EjectionTime int
+	HealthCheck  HealthCheckConfig
+}
+
+// HealthCheckConfig periodically requests the replicas of a backend, those not
+// responding with a 2xx or 3xx status code not receiving requests anymore.
+type HealthCheckConfig struct {
+	// Path is the path requested, empty meaning no health check
+	Path string
+	// Interval is the number of seconds between two checks
+	Interval int
+	// Timeout is the number of seconds a replica has to respond
+	Timeout int
+}
+
+// RouteConfig forwards the requests matching all its non-empty criteria to a
+// named backend. Its responses are cached apart from the ones of other routes.
+type RouteConfig struct {
+	Name string
+	// Host matches the Host header of the requests, "*.domain.com" matching every subdomain
+	Host string
+	// PathPrefix matches the start of the path of the requests
+	PathPrefix string
+	// PathRegex matches the path of the requests
+	PathRegex string
+	// Backend is the name of the backend the requests are forwarded to
+	Backend string
+	// DefaultTTL overrides the global default TTL for the responses of the route, 0 meaning unset
+	DefaultTTL int
+	// Bypass forwards the requests without serving them from cache nor storing their responses
+	Bypass bool
+	// Rules are the cache policy rules of the route, matched before the global ones
+	Rules []RuleConfig
+}
+
+// RuleConfig overrides the cache policy of the requests and responses matching
+// all its non-empty criteria. The first matching rule applies.
+type RuleConfig struct {
+	// PathGlob matches the path of the requests, "*" matching any characters but "/",
+	// and "**" any characters
+	PathGlob string
+	// PathRegex matches the path of the requests
+	PathRegex string
+	// Methods match the method of the requests
+	Methods []string
+	// Statuses match the status code of the responses
+	Statuses []int
+	// ContentTypes match the media type of the responses, "text/*" matching every text type
+	ContentTypes []string
+	// TTL is the default TTL in seconds of the responses, 0 meaning unset
+	TTL int
+	// ForceCache stores the responses even if their headers forbid it
+	ForceCache bool
+	// Bypass doesn't serve the requests from cache nor store their responses
+	Bypass bool
+	// IgnoreCacheControl ignores the Cache-Control and Expires headers of the responses,
+	// which are fresh for their TTL
+	IgnoreCacheControl bool
+	// CacheableStatuses replaces the status codes of the responses which can be stored
+	CacheableStatuses []int
+}
+
+type CacheConfig struct {
+	// Type is the storage of the cache: "memory", "disk" or "redis"
+	Type string
+	// Path is the directory of the "disk" cache
+	Path string
+	// MaxSize is the maximum size of the cache in bytes, 0 meaning unlimited
+	MaxSize int64
+	// MaxEntries is the maximum number of cached responses, 0 meaning unlimited
+	MaxEntries int
+	// MaxObjectSize is the maximum size of a cached body in bytes, 0 meaning unlimited. Larger
+	// bodies are still streamed to the clients, but not stored
+	MaxObjectSize int64
+	// SliceSize serves the range requests from slices of the resources of SliceSize bytes,
+	// fetched with range requests and cached apart, 0 meaning that they're forwarded as is
+	SliceSize int64
+	// SnapshotPath is the file the "memory" cache is saved to on shutdown and restored from
+	// on startup, empty meaning none
+	SnapshotPath string
+	// JanitorInterval is the number of seconds between two removals of the expired responses,
+	// 0 meaning never
+	JanitorInterval int
+	// StaleRetention is the number of seconds the expired responses are kept past the
+	// stale-while-revalidate and stale-if-error windows, to be served when the backend is
+	// unreachable or revalidated with their validators, unless evicted first
+	StaleRetention int
+	// Shards is the number of independently locked parts the cache is split into
+	Shards int
+	// CoalescingTimeout is the number of seconds a cache miss waits for a concurrent fetch
+	// of the same resource before fetching it by itself
+	CoalescingTimeout int
+	// DebugHeader adds the X-Cache header to the responses, telling if they were served from cache
+	DebugHeader bool
+	// Rules are the cache policy rules of every route
+	Rules []RuleConfig
+	Redis RedisConfig
+}
+
+// CompressionConfig negotiates the encoding of the responses with the clients.
+// A single representation of the responses is cached, whatever the
+// Accept-Encoding of the clients, and compressed or decompressed for them.
+type CompressionConfig struct {
+	// Encodings are the encodings the responses are compressed with, by order of preference
+	// among the ones accepted by the clients: "br", "zstd" or "gzip", none meaning no compression
+	Encodings []string
+	// ContentTypes are the media types of the compressed responses, "text/*" matching every text type
+	ContentTypes []string
+	// MinSize is the size in bytes under which the responses aren't compressed
+	MinSize int64
+	// Store caches a variant of the compressible responses per encoding, compressed once,
+	// instead of compressing the cached response for every client
+	Store bool
+}
+
+// AdminConfig exposes the admin API on its own listener, protected by a token,
+// client certificates, or both.
+type AdminConfig struct {
+	// Port is the port of the admin listener, empty meaning no admin API
+	Port string
+	// Token must be sent in the "Authorization: Bearer <token>" header of the requests
+	Token string
+	// CertFile and KeyFile serve the admin API over TLS
+	CertFile string
+	KeyFile  string
+	// ClientCAFile requires the clients to present a certificate signed by one of its CAs
+	ClientCAFile string
+	// PublicPurge serves the PURGE method on the public listener too, to the requests with the
+	// token or a client certificate, as the admin API
+	PublicPurge bool
+}
+
+// LogConfig sets the application logs, and the access log of the requests.
+type LogConfig struct {
+	// Level is the minimum level of the application logs: "debug", "info", "warning" or "error"
+	Level string
+	// Format is the format of the application logs: "text" or "json"
+	Format string
+	Access AccessLogConfig
+}
+
+type AccessLogConfig struct {
+	// Output is "stdout", "stderr" or the path of a file, empty meaning no access log
+	Output string
+	// Format is "combined" for the Apache combined log format, or "json"
+	Format string
+}
+
+// TracingConfig exports OpenTelemetry spans of the requests, the trace context
+// being propagated to the backends in the traceparent header.
+type TracingConfig struct {
+	// Exporter is "otlp" to send the spans to an OTLP/HTTP collector, or "stdout" to print them,
+	// empty meaning no tracing
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string
+	// Insecure sends the spans to the OTLP collector over HTTP instead of HTTPS
+	Insecure bool
+	// SampleRatio is the fraction of the traces started by the proxy which are sampled
+	SampleRatio float64
+	// ServiceName names the proxy in the traces
+	ServiceName string
+}
+
+type RedisConfig struct {
+	Address  string
+	Password string
+	DB       int
+	// Prefix is prepended to every key, so that a server can be shared with other applications
+	Prefix string
+	// StatsInterval is the number of seconds between two measures of the responses stored,
+	// for the stats and metrics, 0 meaning never
+	StatsInterval int
 }
 
 func NewConfigFromFile(filePath string) (Config, error) {
@@ -36,13 +275,59 @@ func NewConfigFromFile(filePath string) (Config, error) {
 
 func NewConfigWithDefault() Config {
 	return Config{
-		Port: DEFAULT_PORT,
-		DefaultTTL: DEFAULT_DEFAULT_TTL,
-		ReadTimeout: DEFAULT_READ_TIMEOUT,
-		WriteTimeout: DEFAULT_WRITE_TIMEOUT,
+		Port:            DEFAULT_PORT,
+		DefaultTTL:      DEFAULT_DEFAULT_TTL,
+		ReadTimeout:     DEFAULT_READ_TIMEOUT,
+		WriteTimeout:    DEFAULT_WRITE_TIMEOUT,
+		ShutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
 		Backend: BackendConfig{
-			Host:   DEFAULT_BACKEND_HOST,
-			Scheme: DEFAULT_BACKEND_SCHEME,
+			Scheme:       DEFAULT_BACKEND_SCHEME,
+			Balancing:    DEFAULT_BACKEND_BALANCING,
+			EjectionTime: DEFAULT_EJECTION_TIME,
+			HealthCheck: HealthCheckConfig{
+				Interval: DEFAULT_HEALTH_CHECK_INTERVAL,
+				Timeout:  DEFAULT_HEALTH_CHECK_TIMEOUT,
+			},
+		},
+		Cache: CacheConfig{
+			Type:              DEFAULT_CACHE_TYPE,
+			Path:              DEFAULT_CACHE_PATH,
+			MaxSize:           DEFAULT_CACHE_MAX_SIZE,
+			MaxEntries:        DEFAULT_CACHE_MAX_ENTRIES,
+			MaxObjectSize:     DEFAULT_CACHE_MAX_OBJECT_SIZE,
+			JanitorInterval:   DEFAULT_CACHE_JANITOR_INTERVAL,
+			StaleRetention:    DEFAULT_CACHE_STALE_RETENTION,
+			Shards:            DEFAULT_CACHE_SHARDS,
+			CoalescingTimeout: DEFAULT_CACHE_COALESCING_TIMEOUT,
+			DebugHeader:       DEFAULT_CACHE_DEBUG_HEADER,
+			Redis: RedisConfig{
+				Address:       DEFAULT_CACHE_REDIS_ADDRESS,
+				Prefix:        DEFAULT_CACHE_REDIS_PREFIX,
+				StatsInterval: DEFAULT_CACHE_REDIS_STATS_INTERVAL,
+			},
+		},
+		Compression: CompressionConfig{
+			// Copied, as decoding a file overwrites them
+			Encodings:    append([]string(nil), DEFAULT_COMPRESSION_ENCODINGS...),
+			ContentTypes: append([]string(nil), DEFAULT_COMPRESSION_CONTENT_TYPES...),
+			MinSize:      DEFAULT_COMPRESSION_MIN_SIZE,
+			Store:        DEFAULT_COMPRESSION_STORE,
+		},
+		Admin: AdminConfig{
+			PublicPurge: DEFAULT_ADMIN_PUBLIC_PURGE,
+		},
+		Log: LogConfig{
+			Level:  DEFAULT_LOG_LEVEL,
+			Format: DEFAULT_LOG_FORMAT,
+			Access: AccessLogConfig{
+				Output: DEFAULT_ACCESS_LOG_OUTPUT,
+				Format: DEFAULT_ACCESS_LOG_FORMAT,
+			},
+		},
+		Tracing: TracingConfig{
+			Endpoint:    DEFAULT_TRACING_ENDPOINT,
+			SampleRatio: DEFAULT_TRACING_SAMPLE_RATIO,
+			ServiceName: DEFAULT_TRACING_SERVICE_NAME,
 		},
 	}
-}
\ No newline at end of file
+}
@@ -13,19 +13,107 @@ func TestFileOverridesDefaultValues(t *testing.T) {
 	const expectedPort = "1234"
 	const expectedReadTimeout = 30
 	const expectedWriteTimeout = 30
+	const expectedShutdownTimeout = 5
 	const expectedBackendHost = "domain.com:80"
 	const expectedBackendScheme = "https"
 	const expectedDefaultTTL = 60
+	const expectedCacheType = "disk"
+	const expectedCachePath = "/var/cache/caeche"
+	const expectedCacheMaxSize = 1024
+	const expectedCacheMaxEntries = 10
+	const expectedCacheMaxObjectSize = 1024
+	const expectedCacheSliceSize = 512
+	const expectedCacheSnapshotPath = "/var/lib/caeche/snapshot"
+	const expectedCacheJanitorInterval = 5
+	const expectedCacheStaleRetention = 600
+	const expectedCacheShards = 4
+	const expectedCacheCoalescingTimeout = 3
+	const expectedCacheDebugHeader = true
+	const expectedCacheRedisAddress = "redis:6379"
+	const expectedCacheRedisPassword = "secret"
+	const expectedCacheRedisDB = 2
+	const expectedCacheRedisPrefix = "proxy:"
+	const expectedCacheRedisStatsInterval = 300
+	const expectedCompressionEncoding = "gzip"
+	const expectedCompressionContentType = "text/html"
+	const expectedCompressionMinSize = 256
+	const expectedCompressionStore = true
+	const expectedAdminPort = "9090"
+	const expectedAdminToken = "secret"
+	const expectedAdminCertFile = "admin.pem"
+	const expectedAdminKeyFile = "admin.key"
+	const expectedAdminClientCAFile = "ca.pem"
+	const expectedAdminPublicPurge = true
+	const expectedLogLevel = "debug"
+	const expectedLogFormat = "json"
+	const expectedAccessLogOutput = "/var/log/caeche/access.log"
+	const expectedAccessLogFormat = "json"
+	const expectedTracingExporter = "otlp"
+	const expectedTracingEndpoint = "collector:4318"
+	const expectedTracingInsecure = true
+	const expectedTracingSampleRatio = 0.25
+	const expectedTracingServiceName = "edge-cache"
 
 	configContent := Config{
-		Port: expectedPort,
-		DefaultTTL: expectedDefaultTTL,
-		ReadTimeout: expectedReadTimeout,
-		WriteTimeout: expectedWriteTimeout,
+		Port:            expectedPort,
+		DefaultTTL:      expectedDefaultTTL,
+		ReadTimeout:     expectedReadTimeout,
+		WriteTimeout:    expectedWriteTimeout,
+		ShutdownTimeout: expectedShutdownTimeout,
 		Backend: BackendConfig{
 			Host:   expectedBackendHost,
 			Scheme: expectedBackendScheme,
 		},
+		Cache: CacheConfig{
+			Type:              expectedCacheType,
+			Path:              expectedCachePath,
+			MaxSize:           expectedCacheMaxSize,
+			MaxEntries:        expectedCacheMaxEntries,
+			MaxObjectSize:     expectedCacheMaxObjectSize,
+			SliceSize:         expectedCacheSliceSize,
+			SnapshotPath:      expectedCacheSnapshotPath,
+			JanitorInterval:   expectedCacheJanitorInterval,
+			StaleRetention:    expectedCacheStaleRetention,
+			Shards:            expectedCacheShards,
+			CoalescingTimeout: expectedCacheCoalescingTimeout,
+			DebugHeader:       expectedCacheDebugHeader,
+			Redis: RedisConfig{
+				Address:       expectedCacheRedisAddress,
+				Password:      expectedCacheRedisPassword,
+				DB:            expectedCacheRedisDB,
+				Prefix:        expectedCacheRedisPrefix,
+				StatsInterval: expectedCacheRedisStatsInterval,
+			},
+		},
+		Compression: CompressionConfig{
+			Encodings:    []string{expectedCompressionEncoding},
+			ContentTypes: []string{expectedCompressionContentType},
+			MinSize:      expectedCompressionMinSize,
+			Store:        expectedCompressionStore,
+		},
+		Admin: AdminConfig{
+			Port:         expectedAdminPort,
+			Token:        expectedAdminToken,
+			CertFile:     expectedAdminCertFile,
+			KeyFile:      expectedAdminKeyFile,
+			ClientCAFile: expectedAdminClientCAFile,
+			PublicPurge:  expectedAdminPublicPurge,
+		},
+		Log: LogConfig{
+			Level:  expectedLogLevel,
+			Format: expectedLogFormat,
+			Access: AccessLogConfig{
+				Output: expectedAccessLogOutput,
+				Format: expectedAccessLogFormat,
+			},
+		},
+		Tracing: TracingConfig{
+			Exporter:    expectedTracingExporter,
+			Endpoint:    expectedTracingEndpoint,
+			Insecure:    expectedTracingInsecure,
+			SampleRatio: expectedTracingSampleRatio,
+			ServiceName: expectedTracingServiceName,
+		},
 	}
 
 	configFile := createTempFileFromConfig(configContent)
@@ -36,8 +124,83 @@ func TestFileOverridesDefaultValues(t *testing.T) {
 	assert.Equal(t, expectedDefaultTTL, config.DefaultTTL, "Wrong default TTL")
 	assert.Equal(t, expectedReadTimeout, config.ReadTimeout, "Wrong read timeout")
 	assert.Equal(t, expectedWriteTimeout, config.WriteTimeout, "Wrong write timeout")
+	assert.Equal(t, expectedShutdownTimeout, config.ShutdownTimeout, "Wrong shutdown timeout")
 	assert.Equal(t, expectedBackendHost, config.Backend.Host, "Wrong backend host")
 	assert.Equal(t, expectedBackendScheme, config.Backend.Scheme, "Wrong backend scheme")
+	assert.Equal(t, expectedCacheType, config.Cache.Type, "Wrong cache type")
+	assert.Equal(t, expectedCachePath, config.Cache.Path, "Wrong cache path")
+	assert.Equal(t, int64(expectedCacheMaxSize), config.Cache.MaxSize, "Wrong cache max size")
+	assert.Equal(t, expectedCacheMaxEntries, config.Cache.MaxEntries, "Wrong cache max entries")
+	assert.Equal(t, int64(expectedCacheMaxObjectSize), config.Cache.MaxObjectSize, "Wrong cache max object size")
+	assert.Equal(t, int64(expectedCacheSliceSize), config.Cache.SliceSize, "Wrong cache slice size")
+	assert.Equal(t, expectedCacheSnapshotPath, config.Cache.SnapshotPath, "Wrong cache snapshot path")
+	assert.Equal(t, expectedCacheJanitorInterval, config.Cache.JanitorInterval, "Wrong cache janitor interval")
+	assert.Equal(t, expectedCacheStaleRetention, config.Cache.StaleRetention, "Wrong cache stale retention")
+	assert.Equal(t, expectedCacheShards, config.Cache.Shards, "Wrong cache shards")
+	assert.Equal(t, expectedCacheCoalescingTimeout, config.Cache.CoalescingTimeout, "Wrong cache coalescing timeout")
+	assert.Equal(t, expectedCacheDebugHeader, config.Cache.DebugHeader, "Wrong cache debug header")
+	assert.Equal(t, expectedCacheRedisAddress, config.Cache.Redis.Address, "Wrong redis address")
+	assert.Equal(t, expectedCacheRedisPassword, config.Cache.Redis.Password, "Wrong redis password")
+	assert.Equal(t, expectedCacheRedisDB, config.Cache.Redis.DB, "Wrong redis DB")
+	assert.Equal(t, expectedCacheRedisPrefix, config.Cache.Redis.Prefix, "Wrong redis prefix")
+	assert.Equal(t, expectedCacheRedisStatsInterval, config.Cache.Redis.StatsInterval, "Wrong redis stats interval")
+	assert.Equal(t, []string{expectedCompressionEncoding}, config.Compression.Encodings, "Wrong compression encodings")
+	assert.Equal(t, []string{expectedCompressionContentType}, config.Compression.ContentTypes, "Wrong compression content types")
+	assert.Equal(t, int64(expectedCompressionMinSize), config.Compression.MinSize, "Wrong compression min size")
+	assert.Equal(t, expectedCompressionStore, config.Compression.Store, "Wrong compression store")
+	assert.Equal(t, DEFAULT_COMPRESSION_ENCODINGS, NewConfigWithDefault().Compression.Encodings, "Default compression encodings overwritten")
+	assert.Equal(t, expectedAdminPort, config.Admin.Port, "Wrong admin port")
+	assert.Equal(t, expectedAdminToken, config.Admin.Token, "Wrong admin token")
+	assert.Equal(t, expectedAdminCertFile, config.Admin.CertFile, "Wrong admin cert file")
+	assert.Equal(t, expectedAdminKeyFile, config.Admin.KeyFile, "Wrong admin key file")
+	assert.Equal(t, expectedAdminClientCAFile, config.Admin.ClientCAFile, "Wrong admin client CA file")
+	assert.Equal(t, expectedAdminPublicPurge, config.Admin.PublicPurge, "Wrong admin public purge")
+	assert.Equal(t, expectedLogLevel, config.Log.Level, "Wrong log level")
+	assert.Equal(t, expectedLogFormat, config.Log.Format, "Wrong log format")
+	assert.Equal(t, expectedAccessLogOutput, config.Log.Access.Output, "Wrong access log output")
+	assert.Equal(t, expectedAccessLogFormat, config.Log.Access.Format, "Wrong access log format")
+	assert.Equal(t, expectedTracingExporter, config.Tracing.Exporter, "Wrong tracing exporter")
+	assert.Equal(t, expectedTracingEndpoint, config.Tracing.Endpoint, "Wrong tracing endpoint")
+	assert.Equal(t, expectedTracingInsecure, config.Tracing.Insecure, "Wrong tracing insecure")
+	assert.Equal(t, expectedTracingSampleRatio, config.Tracing.SampleRatio, "Wrong tracing sample ratio")
+	assert.Equal(t, expectedTracingServiceName, config.Tracing.ServiceName, "Wrong tracing service name")
+}
+
+func TestFileDefinesRoutes(t *testing.T) {
+	configContent := Config{
+		Backends: map[string]BackendConfig{
+			"api": {
+				Host:         "api.domain.com",
+				Scheme:       "http",
+				Hosts:        []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+				Balancing:    "least-connections",
+				MaxFails:     3,
+				EjectionTime: 10,
+				HealthCheck:  HealthCheckConfig{Path: "/health", Interval: 5, Timeout: 1},
+			},
+		},
+		Routes: []RouteConfig{
+			{Name: "api", Host: "*.domain.com", PathPrefix: "/api/", PathRegex: `^/api/v\d+/`, Backend: "api", DefaultTTL: 60},
+			{Name: "admin", PathPrefix: "/admin/", Bypass: true, Rules: []RuleConfig{
+				{PathGlob: "/admin/assets/**", ForceCache: true, TTL: 600},
+			}},
+		},
+		Cache: CacheConfig{
+			Rules: []RuleConfig{
+				{PathRegex: `\.json$`, Methods: []string{"GET"}, Statuses: []int{200}, ContentTypes: []string{"application/json"}, IgnoreCacheControl: true, TTL: 30},
+				{CacheableStatuses: []int{200, 404}},
+			},
+		},
+	}
+
+	configFile := createTempFileFromConfig(configContent)
+	defer os.Remove(configFile)
+	config, err := NewConfigFromFile(configFile)
+
+	assert.NoError(t, err)
+	assert.Equal(t, configContent.Backends, config.Backends, "Wrong backends")
+	assert.Equal(t, configContent.Routes, config.Routes, "Wrong routes")
+	assert.Equal(t, configContent.Cache.Rules, config.Cache.Rules, "Wrong cache rules")
 }
 
 func createTempFileFromConfig(config Config) string {
@@ -52,4 +215,4 @@ func createTempFileFromConfig(config Config) string {
 	tempFile.WriteString(buffer.String())
 
 	return tempFile.Name()
-}
\ No newline at end of file
+}
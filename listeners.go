@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listenersEnv names the listening sockets handed to a new process, in the
+// order of their file descriptors, from 3.
+const listenersEnv = "CAECHE_LISTENERS"
+
+// snapshotEnv is the file descriptor of the pipe the previous process closes
+// once it has saved the snapshot of its cache.
+const snapshotEnv = "CAECHE_SNAPSHOT_FD"
+
+const (
+	proxyListener = "proxy"
+	adminListener = "admin"
+)
+
+// inheritListeners returns the listening sockets handed by the previous
+// process, by name.
+func inheritListeners() (map[string]net.Listener, error) {
+	inherited := map[string]net.Listener{}
+	names := os.Getenv(listenersEnv)
+	if names == "" {
+		return inherited, nil
+	}
+	os.Unsetenv(listenersEnv)
+	for i, name := range strings.Split(names, ",") {
+		file := os.NewFile(uintptr(3+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(inherited)
+			return nil, fmt.Errorf("listener %q: %w", name, err)
+		}
+		log.Infof("Inherited listener %q on %s", name, listener.Addr())
+		inherited[name] = listener
+	}
+	return inherited, nil
+}
+
+// inheritSnapshotPipe returns the pipe the previous process closes once it
+// has saved its snapshot, nil if it doesn't save one.
+func inheritSnapshotPipe() *os.File {
+	fd, err := strconv.Atoi(os.Getenv(snapshotEnv))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(snapshotEnv)
+	return os.NewFile(uintptr(fd), "snapshot")
+}
+
+// listen returns the inherited listener of the name, or a new one on the
+// address.
+func listen(inherited map[string]net.Listener, name string, address string) (net.Listener, error) {
+	if listener, ok := inherited[name]; ok {
+		delete(inherited, name)
+		return listener, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// closeListeners closes the inherited listeners which weren't used.
+func closeListeners(listeners map[string]net.Listener) {
+	for name, listener := range listeners {
+		listener.Close()
+		delete(listeners, name)
+	}
+}
+
+// handOff starts a new process of the proxy, with the same arguments, which
+// inherits the listening sockets. Both processes accept connections until
+// this one is shut down, so that none is refused in between. With snapshot,
+// the new process waits for the returned function to be called, once the
+// snapshot is saved, before restoring it.
+func handOff(listeners map[string]net.Listener, snapshot bool) (func(), error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for name, listener := range listeners {
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			return nil, errors.New("only TCP listeners can be handed off")
+		}
+		file, err := tcpListener.File()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		files = append(files, file)
+	}
+	env := append(os.Environ(), listenersEnv+"="+strings.Join(names, ","))
+	snapshotSaved := func() {}
+	if snapshot {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fmt.Sprintf("%s=%d", snapshotEnv, 3+len(files)))
+		files = append(files, reader)
+		snapshotSaved = func() { writer.Close() }
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = env
+	if err := cmd.Start(); err != nil {
+		snapshotSaved()
+		return nil, err
+	}
+	log.Infof("Started process %d", cmd.Process.Pid)
+	return snapshotSaved, nil
+}
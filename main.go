@@ -1,58 +1,384 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/justinas/alice"
 	"github.com/sdelicata/caeche/cache"
 	"github.com/sdelicata/caeche/config"
 	"github.com/sdelicata/caeche/server"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/net/http2"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func init() {
 	log.SetOutput(os.Stdout)
-	log.SetLevel(log.DebugLevel)
 }
 
+const configFile = "config.toml"
+
 func main() {
-	cfg, err := config.NewConfigFromFile("config.toml")
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := config.NewConfigFromFile(configFile)
 	if err != nil {
 		log.Errorf("Error loading config file : %s", err)
 		return
 	}
 
-	initTransport(cfg.Backend.Scheme)
+	if err := initLogs(cfg.Log); err != nil {
+		log.Errorf("Error initializing logs : %s", err)
+		return
+	}
+	initTransport(cfg)
+	shutdownTracing, err := initTracing(cfg.Tracing)
+	if err != nil {
+		log.Errorf("Error initializing tracing : %s", err)
+		return
+	}
+	defer shutdownTracing()
 
-	cacheInMemory := cache.NewInMemory(cfg.DefaultTTL)
-	reverseProxy := server.NewReverseProxy(cfg, cacheInMemory)
-	purgeMiddleWare := cache.NewPurgeMiddleware(cacheInMemory)
+	responseCache, stopJanitor, err := newCache(cfg)
+	if err != nil {
+		log.Errorf("Error initializing cache : %s", err)
+		return
+	}
+	defer stopJanitor()
+	snapshotPipe := inheritSnapshotPipe()
+	if cfg.Cache.SnapshotPath != "" {
+		restoreSnapshot(cfg.Cache.SnapshotPath, responseCache, snapshotPipe)
+	} else if snapshotPipe != nil {
+		snapshotPipe.Close()
+	}
+	reverseProxy, err := server.NewReverseProxy(cfg, responseCache)
+	if err != nil {
+		log.Errorf("Error initializing routes : %s", err)
+		return
+	}
+	stopHealthChecks := reverseProxy.StartHealthChecks()
+	defer func() { stopHealthChecks() }()
 
-	chain := alice.New(purgeMiddleWare).Then(reverseProxy.GetHandler())
+	inherited, err := inheritListeners()
+	if err != nil {
+		log.Errorf("Error inheriting listeners : %s", err)
+		return
+	}
+	defer closeListeners(inherited)
+	listeners := map[string]net.Listener{}
 
-	s := http.Server{
-		Addr:         ":" + cfg.Port,
-		Handler:      chain,
+	chain, err := newChain(cfg, reverseProxy, responseCache)
+	if err != nil {
+		log.Errorf("Error initializing public purge : %s", err)
+		return
+	}
+	handler := &swappableHandler{}
+	handler.set(chain)
+	tlsConfig, err := server.PublicTLSConfig(cfg.Admin)
+	if err != nil {
+		log.Errorf("Error initializing public purge : %s", err)
+		return
+	}
+	s := &http.Server{
+		Handler:      handler,
+		TLSConfig:    tlsConfig,
 		WriteTimeout: 30 * time.Second,
 		ReadTimeout:  30 * time.Second,
 	}
+	if listeners[proxyListener], err = listen(inherited, proxyListener, ":"+cfg.Port); err != nil {
+		log.Errorf("Error listening : %s", err)
+		return
+	}
 	log.Infoln("Server starting...")
 	if cfg.Backend.Scheme == "https" {
-		log.Fatalln(s.ListenAndServeTLS("cert.pem", "key.pem"))
+		go serve(s, listeners[proxyListener], "cert.pem", "key.pem")
 	} else {
-		log.Fatalln(s.ListenAndServe())
+		go serve(s, listeners[proxyListener], "", "")
+	}
+	servers := []*http.Server{s}
+
+	var admin *server.Admin
+	if cfg.Admin.Port != "" {
+		if admin, err = server.NewAdmin(cfg.Admin, responseCache, reverseProxy); err != nil {
+			log.Errorf("Error initializing admin API : %s", err)
+			return
+		}
+		adminServer, err := newAdminServer(admin)
+		if err != nil {
+			log.Errorf("Error initializing admin API : %s", err)
+			return
+		}
+		if listeners[adminListener], err = listen(inherited, adminListener, ":"+cfg.Admin.Port); err != nil {
+			log.Errorf("Error listening for admin API : %s", err)
+			return
+		}
+		log.Infoln("Admin API starting...")
+		go serve(adminServer, listeners[adminListener], cfg.Admin.CertFile, cfg.Admin.KeyFile)
+		servers = append(servers, adminServer)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Infoln("Reloading config...")
+			reloadedCfg, err := config.NewConfigFromFile(configFile)
+			var reloaded *server.ReverseProxy
+			var chain http.Handler
+			if err == nil {
+				reloaded, err = reverseProxy.Reload(reloadedCfg)
+			}
+			if err == nil {
+				chain, err = newChain(reloadedCfg, reloaded, responseCache)
+			}
+			if err != nil {
+				log.Errorf("Error reloading config, keeping the current one : %s", err)
+				continue
+			}
+			if err := initLogs(reloadedCfg.Log); err != nil {
+				log.Errorf("Error reloading logs : %s", err)
+			}
+			warnRestartRequired(cfg, reloadedCfg)
+			stopHealthChecks()
+			stopHealthChecks = reloaded.StartHealthChecks()
+			handler.set(chain)
+			if admin != nil {
+				admin.SetReverseProxy(reloaded)
+			}
+			// The requests in flight have the shutdown timeout to write to the
+			// access log replaced
+			previous := reverseProxy
+			time.AfterFunc(time.Duration(reloadedCfg.ShutdownTimeout)*time.Second, func() { previous.Release(reloaded) })
+			reverseProxy, cfg = reloaded, reloadedCfg
+			log.Infoln("Config reloaded")
+		case syscall.SIGUSR2:
+			// Both processes would write to the directory of the disk cache
+			if cfg.Cache.Type == "disk" {
+				log.Errorln("Error handing listeners to a new process : the disk cache can't be shared, restart instead")
+				continue
+			}
+			snapshotSaved, err := handOff(listeners, cfg.Cache.SnapshotPath != "")
+			if err != nil {
+				log.Errorf("Error handing listeners to a new process : %s", err)
+				continue
+			}
+			log.Infoln("Listeners handed to a new process")
+			shutdown(servers, time.Duration(cfg.ShutdownTimeout)*time.Second)
+			// The new process restores the cache as it is once the requests in flight are done
+			if cfg.Cache.SnapshotPath != "" {
+				saveSnapshot(cfg.Cache.SnapshotPath, responseCache)
+			}
+			snapshotSaved()
+			return
+		default:
+			shutdown(servers, time.Duration(cfg.ShutdownTimeout)*time.Second)
+			if cfg.Cache.SnapshotPath != "" {
+				saveSnapshot(cfg.Cache.SnapshotPath, responseCache)
+			}
+			return
+		}
 	}
 }
 
-func initTransport(scheme string) {
+// newChain returns the handler of the requests to the proxy, with its
+// middlewares.
+func newChain(cfg config.Config, reverseProxy *server.ReverseProxy, responseCache cache.Cache) (http.Handler, error) {
+	middlewares := []alice.Constructor{reverseProxy.RoutingMiddleware}
+	if cfg.Admin.PublicPurge {
+		purgeMiddleware, err := server.NewPublicPurgeMiddleware(cfg.Admin, responseCache)
+		if err != nil {
+			return nil, err
+		}
+		middlewares = append(middlewares, purgeMiddleware)
+	}
+	return alice.New(middlewares...).Then(reverseProxy.GetHandler()), nil
+}
+
+// swappableHandler serves the requests with the last handler set, replaced
+// as the config is reloaded.
+type swappableHandler struct {
+	handler atomic.Value
+}
+
+func (swappable *swappableHandler) set(handler http.Handler) {
+	swappable.handler.Store(handler)
+}
+
+func (swappable *swappableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	swappable.handler.Load().(http.Handler).ServeHTTP(rw, req)
+}
+
+// newAdminServer returns the server of the admin API, over TLS when a
+// certificate is set.
+func newAdminServer(admin *server.Admin) (*http.Server, error) {
+	tlsConfig, err := admin.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Handler:      admin.GetHandler(),
+		TLSConfig:    tlsConfig,
+		WriteTimeout: 30 * time.Second,
+		ReadTimeout:  30 * time.Second,
+	}, nil
+}
+
+// serve serves the requests accepted by the listener until the server is shut
+// down, over TLS when a certificate is given.
+func serve(s *http.Server, listener net.Listener, certFile string, keyFile string) {
+	var err error
+	if certFile != "" {
+		err = s.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = s.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln(err)
+	}
+}
+
+// shutdown stops accepting connections and waits for the requests in flight
+// to complete, closing their connections after the timeout.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	log.Infof("Shutting down, waiting up to %s for the requests in flight...", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Warnf("Requests still in flight after %s : %s", timeout, err)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+	log.Infoln("Server stopped")
+}
+
+// warnRestartRequired warns about the settings which are only applied on
+// restart, when they changed in the reloaded config.
+func warnRestartRequired(cfg config.Config, reloadedCfg config.Config) {
+	if cfg.Port != reloadedCfg.Port || cfg.Admin != reloadedCfg.Admin {
+		log.Warnln("The listeners and the admin API settings are only applied on restart")
+	}
+	if cfg.Cache.Type != reloadedCfg.Cache.Type || cfg.Cache.Path != reloadedCfg.Cache.Path ||
+		cfg.Cache.MaxSize != reloadedCfg.Cache.MaxSize || cfg.Cache.MaxEntries != reloadedCfg.Cache.MaxEntries ||
+		cfg.Cache.Shards != reloadedCfg.Cache.Shards || cfg.Cache.JanitorInterval != reloadedCfg.Cache.JanitorInterval ||
+		cfg.Cache.StaleRetention != reloadedCfg.Cache.StaleRetention ||
+		cfg.Cache.Redis != reloadedCfg.Cache.Redis {
+		log.Warnln("The cache storage settings are only applied on restart")
+	}
+	if cfg.Tracing != reloadedCfg.Tracing {
+		log.Warnln("The tracing settings are only applied on restart")
+	}
+}
+
+// newCache returns the cache storage selected in the config, with its janitor,
+// or the measures of the Redis cache, started.
+func newCache(cfg config.Config) (cache.Cache, func(), error) {
+	janitorInterval := time.Duration(cfg.Cache.JanitorInterval) * time.Second
+	staleRetention := time.Duration(cfg.Cache.StaleRetention) * time.Second
+	switch cfg.Cache.Type {
+	case "memory":
+		responseCache := cache.NewSharded(cfg.Cache.Shards, cfg.DefaultTTL, cfg.Cache.MaxSize, cfg.Cache.MaxEntries)
+		return responseCache, responseCache.StartJanitor(janitorInterval, staleRetention), nil
+	case "disk":
+		responseCache, err := cache.NewDisk(cfg.Cache.Path, cfg.DefaultTTL, cfg.Cache.MaxSize, cfg.Cache.MaxEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		return responseCache, responseCache.StartJanitor(janitorInterval, staleRetention), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.Cache.Redis.Address,
+			Password: cfg.Cache.Redis.Password,
+			DB:       cfg.Cache.Redis.DB,
+		})
+		// Redis expires the responses by itself
+		responseCache := cache.NewRedis(client, cfg.Cache.Redis.Prefix, cfg.DefaultTTL, staleRetention)
+		stopMeasuring := responseCache.StartMeasuring(time.Duration(cfg.Cache.Redis.StatsInterval) * time.Second)
+		return responseCache, func() {
+			stopMeasuring()
+			client.Close()
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown cache type %q", cfg.Cache.Type)
+	}
+}
+
+// initLogs sets the level and format of the application logs.
+func initLogs(cfg config.LogConfig) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	switch cfg.Format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	return nil
+}
+
+// initTracing registers the provider of the tracers exporting the spans, and
+// returns the function flushing them.
+func initTracing(cfg config.TracingConfig) (func(), error) {
+	tracerProvider, err := server.NewTracerProvider(cfg)
+	if err != nil || tracerProvider == nil {
+		return func() {}, err
+	}
+	otel.SetTracerProvider(tracerProvider)
+	return func() {
+		if err := tracerProvider.Shutdown(context.Background()); err != nil {
+			log.Error(err)
+		}
+	}, nil
+}
+
+func initTransport(cfg config.Config) {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	if scheme == "https" {
+	if usesHTTPS(cfg) {
 		err := http2.ConfigureTransport(http.DefaultTransport.(*http.Transport))
 		if err != nil {
 			log.Error(err)
 		}
 	}
 }
+
+// usesHTTPS tells if any backend is reached over HTTPS.
+func usesHTTPS(cfg config.Config) bool {
+	if cfg.Backend.Scheme == "https" {
+		return true
+	}
+	for _, backend := range cfg.Backends {
+		if backend.Scheme == "https" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sdelicata/caeche/config"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader identifies a request in the access log, the backends and
+// the response. It's generated unless sent by the client.
+const requestIDHeader = "X-Request-Id"
+
+// accessLog writes a line per request handled by the proxy, either in JSON or
+// in the Apache combined log format followed by the request ID, the cache
+// status, the backend latency and the duration.
+type accessLog struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format string
+	// file is the file written, closed with the access log
+	file *os.File
+}
+
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	ClientIP       string    `json:"clientIP"`
+	Method         string    `json:"method"`
+	URL            string    `json:"url"`
+	Protocol       string    `json:"protocol"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	Duration       float64   `json:"duration"`
+	BackendLatency float64   `json:"backendLatency"`
+	Cache          string    `json:"cache"`
+	Route          string    `json:"route"`
+	RequestID      string    `json:"requestID"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"userAgent,omitempty"`
+}
+
+// newAccessLog returns the access log written to stdout, stderr or the file at
+// the output of the config, or nil without output.
+func newAccessLog(cfg config.AccessLogConfig) (*accessLog, error) {
+	if cfg.Format != "json" && cfg.Format != "combined" {
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+	switch cfg.Output {
+	case "":
+		return nil, nil
+	case "stdout":
+		return &accessLog{writer: os.Stdout, format: cfg.Format}, nil
+	case "stderr":
+		return &accessLog{writer: os.Stderr, format: cfg.Format}, nil
+	default:
+		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &accessLog{writer: file, format: cfg.Format, file: file}, nil
+	}
+}
+
+// Close closes the file of the access log, if any, the lines written since
+// being discarded.
+func (accessLog *accessLog) Close() error {
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	accessLog.writer = io.Discard
+	if accessLog.file == nil {
+		return nil
+	}
+	file := accessLog.file
+	accessLog.file = nil
+	return file.Close()
+}
+
+func (accessLog *accessLog) write(entry accessLogEntry) {
+	var line []byte
+	if accessLog.format == "json" {
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			log.Errorf("Cannot encode access log : %s", err)
+			return
+		}
+	} else {
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" \"%s\" \"%s\" %dms %dms",
+			entry.ClientIP,
+			entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method,
+			entry.URL,
+			entry.Protocol,
+			entry.Status,
+			combinedBytes(entry.Bytes),
+			orDash(entry.Referer),
+			orDash(entry.UserAgent),
+			entry.RequestID,
+			entry.Cache,
+			time.Duration(entry.BackendLatency*float64(time.Second)).Milliseconds(),
+			time.Duration(entry.Duration*float64(time.Second)).Milliseconds(),
+		))
+	}
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+	if _, err := accessLog.writer.Write(append(line, '\n')); err != nil {
+		log.Errorf("Cannot write access log : %s", err)
+	}
+}
+
+// responseRecord records what's written to the client, and how long the
+// backend took to respond, for the access log.
+type responseRecord struct {
+	http.ResponseWriter
+	statusCode     int
+	bytes          int64
+	backendLatency time.Duration
+}
+
+func (record *responseRecord) WriteHeader(statusCode int) {
+	if record.statusCode == 0 {
+		record.statusCode = statusCode
+	}
+	record.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (record *responseRecord) Write(data []byte) (int, error) {
+	if record.statusCode == 0 {
+		record.statusCode = http.StatusOK
+	}
+	written, err := record.ResponseWriter.Write(data)
+	record.bytes += int64(written)
+	return written, err
+}
+
+func (record *responseRecord) Flush() {
+	if flusher, ok := record.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// setRequestID keeps the request ID sent by the client, or generates one, and
+// sends it back in the response.
+func setRequestID(rw http.ResponseWriter, req *http.Request) string {
+	requestID := req.Header.Get(requestIDHeader)
+	if requestID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			log.Error(err)
+		}
+		requestID = hex.EncodeToString(id)
+		req.Header.Set(requestIDHeader, requestID)
+	}
+	rw.Header().Set(requestIDHeader, requestID)
+	return requestID
+}
+
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func combinedBytes(bytes int64) string {
+	if bytes == 0 {
+		return "-"
+	}
+	return fmt.Sprint(bytes)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogInJSON(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(requestIDHeader, req.Header.Get(requestIDHeader))
+		rw.Write([]byte("body"))
+	}))
+	var output bytes.Buffer
+	reverseProxy.accessLog = &accessLog{writer: &output, format: "json"}
+	handler := reverseProxy.GetHandler()
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/resource?page=2", nil))
+	requestID := recorder.Header().Get(requestIDHeader)
+	assert.Len(t, requestID, 32)
+	req := httptest.NewRequest(http.MethodGet, "/resource?page=2", nil)
+	req.Header.Set(requestIDHeader, "client-id")
+	recorder = serve(handler, req)
+	assert.Equal(t, []string{"client-id"}, recorder.Header().Values(requestIDHeader), "The request ID of the cached response isn't replayed")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 2)
+	var miss, hit accessLogEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &miss))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &hit))
+	assert.Equal(t, "192.0.2.1", miss.ClientIP)
+	assert.Equal(t, http.MethodGet, miss.Method)
+	assert.Equal(t, "/resource?page=2", miss.URL)
+	assert.Equal(t, http.StatusOK, miss.Status)
+	assert.Equal(t, int64(4), miss.Bytes)
+	assert.Equal(t, "MISS", miss.Cache)
+	assert.Equal(t, "default", miss.Route)
+	assert.Equal(t, requestID, miss.RequestID)
+	assert.Greater(t, miss.BackendLatency, float64(0))
+	assert.Equal(t, "HIT", hit.Cache)
+	assert.Equal(t, int64(4), hit.Bytes)
+	assert.Equal(t, float64(0), hit.BackendLatency)
+	assert.Equal(t, "client-id", hit.RequestID)
+}
+
+func TestAccessLogInCombinedFormat(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.NotFoundHandler())
+	var output bytes.Buffer
+	reverseProxy.accessLog = &accessLog{writer: &output, format: "combined"}
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.Header.Set("User-Agent", "curl/7.79.1")
+	req.Header.Set(requestIDHeader, "abc")
+	serve(reverseProxy.GetHandler(), req)
+
+	assert.Regexp(t, `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} \+0000\] "GET /missing HTTP/1\.1" 404 19 "-" "curl/7\.79\.1" "abc" "MISS" \d+ms \d+ms\n$`, output.String())
+}
+
+func TestNewAccessLog(t *testing.T) {
+	_, err := newAccessLog(config.AccessLogConfig{Output: "stdout", Format: "xml"})
+	assert.Error(t, err)
+
+	accessLog, err := newAccessLog(config.AccessLogConfig{Format: "json"})
+	assert.NoError(t, err)
+	assert.Nil(t, accessLog, "No output means no access log")
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err = newAccessLog(config.AccessLogConfig{Output: path, Format: "json"})
+	assert.NoError(t, err)
+	accessLog.write(accessLogEntry{Method: http.MethodGet})
+	content, _ := os.ReadFile(path)
+	assert.Contains(t, string(content), `"method":"GET"`)
+}
+
+func TestReleaseClosesReplacedAccessLog(t *testing.T) {
+	reverseProxy, cfg := newTestReverseProxy(t, http.NotFoundHandler())
+	reloadedCfg := *cfg
+	reloadedCfg.Log.Access = config.AccessLogConfig{Output: filepath.Join(t.TempDir(), "access.log"), Format: "json"}
+	first, err := reverseProxy.Reload(reloadedCfg)
+	assert.NoError(t, err)
+	kept, err := first.Reload(reloadedCfg)
+	assert.NoError(t, err)
+	first.Release(kept)
+	assert.NotNil(t, kept.accessLog.file, "An unchanged access log is kept open")
+
+	reloadedCfg.Log.Access.Output = filepath.Join(t.TempDir(), "access.log")
+	replacing, err := kept.Reload(reloadedCfg)
+	assert.NoError(t, err)
+	file := kept.accessLog.file
+	kept.Release(replacing)
+	assert.Nil(t, kept.accessLog.file)
+	assert.Error(t, file.Close(), "The replaced access log file should be closed")
+	kept.accessLog.write(accessLogEntry{Method: http.MethodGet})
+	assert.NotNil(t, replacing.accessLog.file)
+
+	stdout := &accessLog{writer: os.Stdout, format: "json"}
+	assert.NoError(t, stdout.Close())
+	_, err = os.Stdout.Stat()
+	assert.NoError(t, err, "Stdout is never closed")
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Admin serves the JSON API managing the cache, on its own listener.
+type Admin struct {
+	config       config.AdminConfig
+	cache        cachePackage.Cache
+	mutex        sync.RWMutex
+	reverseProxy *ReverseProxy
+	warmer       *warmer
+}
+
+// selector selects cached responses by exact storage key, by prefix or regex
+// of their request URI, by tag, or all of them, optionally on a single route.
+// Soft purges only mark the responses stale.
+type selector struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Regex  string `json:"regex"`
+	Tag    string `json:"tag"`
+	Route  string `json:"route"`
+	All    bool   `json:"all"`
+	Soft   bool   `json:"soft"`
+}
+
+type entryDetails struct {
+	cachePackage.Entry
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+}
+
+// NewAdmin returns the admin API of the proxy, refusing to expose it without
+// token nor client certificates.
+func NewAdmin(cfg config.AdminConfig, cache cachePackage.Cache, reverseProxy *ReverseProxy) (*Admin, error) {
+	if cfg.Token == "" && cfg.ClientCAFile == "" {
+		return nil, errors.New("the admin API requires a token or a client CA")
+	}
+	if cfg.ClientCAFile != "" && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		return nil, errors.New("client certificates require the admin API to be served over TLS")
+	}
+	return &Admin{
+		config:       cfg,
+		cache:        cache,
+		reverseProxy: reverseProxy,
+		warmer:       newWarmer(),
+	}, nil
+}
+
+// SetReverseProxy replaces the reverse proxy whose backends are checked, once
+// its config has been reloaded.
+func (admin *Admin) SetReverseProxy(reverseProxy *ReverseProxy) {
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+	admin.reverseProxy = reverseProxy
+}
+
+func (admin *Admin) proxy() *ReverseProxy {
+	admin.mutex.RLock()
+	defer admin.mutex.RUnlock()
+	return admin.reverseProxy
+}
+
+func (admin *Admin) GetHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/entries", admin.listEntries)
+	mux.HandleFunc("/entry", admin.inspectEntry)
+	mux.HandleFunc("/purge", admin.purge)
+	mux.HandleFunc("/snapshot", admin.snapshot)
+	mux.HandleFunc("/warm", admin.warm)
+	mux.HandleFunc("/stats", admin.stats)
+	mux.HandleFunc("/health", admin.health)
+	mux.Handle("/metrics", admin.proxy().metrics.handler())
+	return admin.authenticate(mux)
+}
+
+// TLSConfig returns the TLS config of the admin listener, verifying the
+// client certificates when a client CA is set.
+func (admin *Admin) TLSConfig() (*tls.Config, error) {
+	return clientTLSConfig(admin.config, tls.RequireAndVerifyClientCert)
+}
+
+// PublicTLSConfig returns the TLS config of the public listener, verifying
+// the client certificates which are given when the PURGE requests must be
+// authenticated by them.
+func PublicTLSConfig(cfg config.AdminConfig) (*tls.Config, error) {
+	if !cfg.PublicPurge {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	return clientTLSConfig(cfg, tls.VerifyClientCertIfGiven)
+}
+
+func clientTLSConfig(cfg config.AdminConfig, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	caCerts, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCerts) {
+		return nil, fmt.Errorf("no certificate found in %s", cfg.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = clientAuth
+	return tlsConfig, nil
+}
+
+// NewPublicPurgeMiddleware serves the PURGE requests on the public listener,
+// authenticated as the requests to the admin API are: with the admin token,
+// a client certificate signed by the client CA, or both when both are set.
+func NewPublicPurgeMiddleware(cfg config.AdminConfig, cache cachePackage.Cache) (func(next http.Handler) http.Handler, error) {
+	if cfg.Token == "" && cfg.ClientCAFile == "" {
+		return nil, errors.New("the public PURGE requires an admin token or a client CA")
+	}
+	purge := cachePackage.NewPurgeMiddleware(cache)
+	return func(next http.Handler) http.Handler {
+		purgeHandler := purge(next)
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Method != "PURGE" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			if !hasValidToken(cfg, req) {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(rw, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			if cfg.ClientCAFile != "" && (req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+				http.Error(rw, "client certificate required", http.StatusForbidden)
+				return
+			}
+			purgeHandler.ServeHTTP(rw, req)
+		})
+	}, nil
+}
+
+// authenticate rejects the requests without the token, when set. Client
+// certificates are verified by the TLS listener.
+func (admin *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !hasValidToken(admin.config, req) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(rw, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// hasValidToken tells if the request carries the admin token, when set.
+func hasValidToken(cfg config.AdminConfig, req *http.Request) bool {
+	if cfg.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1
+}
+
+func (admin *Admin) listEntries(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	inspector, ok := admin.inspector(rw)
+	if !ok {
+		return
+	}
+	query := req.URL.Query()
+	match, err := selector{
+		Prefix: query.Get("prefix"),
+		Regex:  query.Get("regex"),
+		Tag:    query.Get("tag"),
+		Route:  query.Get("route"),
+		All:    query.Get("prefix") == "" && query.Get("regex") == "" && query.Get("tag") == "",
+	}.matcher()
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err)
+		return
+	}
+	entries := []cachePackage.Entry{}
+	for _, entry := range inspector.Entries() {
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"count": len(entries), "entries": entries})
+}
+
+func (admin *Admin) inspectEntry(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	inspector, ok := admin.inspector(rw)
+	if !ok {
+		return
+	}
+	key := cachePackage.StorageKey(req.URL.Query().Get("key"))
+	response, ok := inspector.Lookup(key)
+	if !ok {
+		writeJSONError(rw, http.StatusNotFound, fmt.Errorf("no entry %q", key))
+		return
+	}
+	var entry cachePackage.Entry
+	for _, candidate := range inspector.Entries() {
+		if candidate.Key == key {
+			entry = candidate
+			break
+		}
+	}
+	writeJSON(rw, http.StatusOK, entryDetails{
+		Entry:           entry,
+		RequestHeaders:  response.RequestHeaders,
+		ResponseHeaders: response.ResponseHeaders,
+	})
+}
+
+func (admin *Admin) purge(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodPost) {
+		return
+	}
+	var purge selector
+	if err := json.NewDecoder(req.Body).Decode(&purge); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("invalid purge request: %w", err))
+		return
+	}
+	match, err := purge.matcher()
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err)
+		return
+	}
+	var purged int
+	if purge.Tag != "" && purge.Route == "" {
+		// Every cache indexes its responses by tag
+		purged = admin.cache.PurgeTag(purge.Tag, purge.Soft)
+	} else {
+		inspector, ok := admin.inspector(rw)
+		if !ok {
+			return
+		}
+		if purge.Soft {
+			purged = inspector.Expire(match)
+		} else {
+			purged = inspector.Delete(match)
+		}
+	}
+	log.Infof("Purged %d responses from the admin API", purged)
+	writeJSON(rw, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func (admin *Admin) stats(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	stats := map[string]interface{}{"requests": admin.proxy().statuses.snapshot()}
+	if inspector, ok := admin.cache.(cachePackage.Inspector); ok {
+		stats["cache"] = inspector.Stats()
+	}
+	writeJSON(rw, http.StatusOK, stats)
+}
+
+// snapshot streams a snapshot of the cached responses on GET, and restores
+// the responses of the snapshot sent on PUT.
+func (admin *Admin) snapshot(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		inspector, ok := admin.inspector(rw)
+		if !ok {
+			return
+		}
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		written, err := cachePackage.WriteSnapshot(rw, inspector)
+		if err != nil {
+			log.Errorf("Writing snapshot : %s", err)
+			return
+		}
+		log.Infof("Exported %d responses from the admin API", written)
+	case http.MethodPut:
+		restorer, ok := admin.cache.(cachePackage.Restorer)
+		if !ok {
+			writeJSONError(rw, http.StatusNotImplemented, errors.New("the cache can't be restored from a snapshot"))
+			return
+		}
+		restored, err := cachePackage.ReadSnapshot(req.Body, restorer)
+		log.Infof("Restored %d responses from the admin API", restored)
+		if err != nil {
+			writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("restored %d responses before an error: %w", restored, err))
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]int{"restored": restored})
+	default:
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		writeJSONError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+// warm starts warming the cache with the URLs posted on POST, returns the
+// report of the current or last warm on GET, and stops it on DELETE.
+func (admin *Admin) warm(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, admin.warmer.status())
+	case http.MethodPost:
+		var warmRequest WarmRequest
+		if err := json.NewDecoder(req.Body).Decode(&warmRequest); err != nil {
+			writeJSONError(rw, http.StatusBadRequest, fmt.Errorf("invalid warm request: %w", err))
+			return
+		}
+		if len(warmRequest.URLs) == 0 && len(warmRequest.Sitemaps) == 0 {
+			writeJSONError(rw, http.StatusBadRequest, errors.New("urls or sitemaps are required"))
+			return
+		}
+		if err := admin.warmer.start(admin.proxy().GetHandler(), warmRequest); err != nil {
+			writeJSONError(rw, http.StatusConflict, err)
+			return
+		}
+		log.Infof("Started warming the cache from the admin API")
+		writeJSON(rw, http.StatusAccepted, admin.warmer.status())
+	case http.MethodDelete:
+		admin.warmer.stop()
+		writeJSON(rw, http.StatusOK, admin.warmer.status())
+	default:
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodPost+", "+http.MethodDelete)
+		writeJSONError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+// health tells if every backend has at least one available replica, and
+// responds with a 503 otherwise.
+func (admin *Admin) health(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethod(rw, req, http.MethodGet) {
+		return
+	}
+	status, statusCode := "ok", http.StatusOK
+	backends := map[string][]replicaHealth{}
+	for _, pool := range admin.proxy().router.pools {
+		replicas := pool.health()
+		backends[pool.name] = replicas
+		available := false
+		for _, replica := range replicas {
+			available = available || replica.Available
+		}
+		if !available {
+			status, statusCode = "degraded", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(rw, statusCode, map[string]interface{}{"status": status, "backends": backends})
+}
+
+func (admin *Admin) inspector(rw http.ResponseWriter) (cachePackage.Inspector, bool) {
+	inspector, ok := admin.cache.(cachePackage.Inspector)
+	if !ok {
+		writeJSONError(rw, http.StatusNotImplemented, errors.New("the cache can't be inspected"))
+	}
+	return inspector, ok
+}
+
+// matcher returns the function matching the entries selected, requiring
+// exactly one of key, prefix, regex, tag or all.
+func (selector selector) matcher() (func(cachePackage.Entry) bool, error) {
+	criteria := 0
+	for _, set := range []bool{selector.Key != "", selector.Prefix != "", selector.Regex != "", selector.Tag != "", selector.All} {
+		if set {
+			criteria++
+		}
+	}
+	if criteria != 1 {
+		return nil, errors.New("exactly one of key, prefix, regex, tag or all is required")
+	}
+	var match func(cachePackage.Entry) bool
+	switch {
+	case selector.Key != "":
+		match = func(entry cachePackage.Entry) bool { return entry.Key == cachePackage.StorageKey(selector.Key) }
+	case selector.Prefix != "":
+		match = func(entry cachePackage.Entry) bool { return strings.HasPrefix(entry.RequestURI, selector.Prefix) }
+	case selector.Regex != "":
+		regex, err := regexp.Compile(selector.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		match = func(entry cachePackage.Entry) bool { return regex.MatchString(entry.RequestURI) }
+	case selector.Tag != "":
+		match = func(entry cachePackage.Entry) bool { return containsString(entry.Tags, selector.Tag) }
+	default:
+		match = func(entry cachePackage.Entry) bool { return true }
+	}
+	if selector.Route == "" {
+		return match, nil
+	}
+	return func(entry cachePackage.Entry) bool {
+		return entry.Namespace == selector.Route && match(entry)
+	}, nil
+}
+
+func allowMethod(rw http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		rw.Header().Set("Allow", method)
+		writeJSONError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, statusCode int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		log.Error(err)
+	}
+}
+
+func writeJSONError(rw http.ResponseWriter, statusCode int, err error) {
+	writeJSON(rw, statusCode, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+func newTestAdmin(t *testing.T) (http.Handler, http.Handler, *ReverseProxy) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/static/") {
+			rw.Header().Set("Surrogate-Key", "static")
+		}
+		rw.Write([]byte("body"))
+	}))
+	admin, err := NewAdmin(config.AdminConfig{Token: testAdminToken}, reverseProxy.cache, reverseProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admin.GetHandler(), reverseProxy.GetHandler(), reverseProxy
+}
+
+func adminRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func decodeJSON(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestAdminRequiresAuthentication(t *testing.T) {
+	_, err := NewAdmin(config.AdminConfig{}, nil, nil)
+	assert.Error(t, err)
+	_, err = NewAdmin(config.AdminConfig{ClientCAFile: "ca.pem"}, nil, nil)
+	assert.Error(t, err, "Client certificates require TLS")
+
+	admin, _, _ := newTestAdmin(t)
+	recorder := serve(admin, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, serve(admin, req).Code)
+
+	assert.Equal(t, http.StatusOK, serve(admin, adminRequest(http.MethodGet, "/stats", "")).Code)
+}
+
+func TestAdminClientCertificates(t *testing.T) {
+	ca := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ca.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	admin, err := NewAdmin(config.AdminConfig{ClientCAFile: caFile, CertFile: "cert.pem", KeyFile: "key.pem"}, nil, nil)
+	assert.NoError(t, err)
+	tlsConfig, err := admin.TLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+	assert.Len(t, tlsConfig.ClientCAs.Subjects(), 1)
+}
+
+func TestPublicPurgeRequiresAuthentication(t *testing.T) {
+	_, err := NewPublicPurgeMiddleware(config.AdminConfig{PublicPurge: true}, nil)
+	assert.Error(t, err)
+
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte("body"))
+	}))
+	purgeMiddleware, err := NewPublicPurgeMiddleware(config.AdminConfig{Token: testAdminToken, PublicPurge: true}, reverseProxy.cache)
+	assert.NoError(t, err)
+	handler := reverseProxy.RoutingMiddleware(purgeMiddleware(reverseProxy.GetHandler()))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+
+	recorder := serve(handler, httptest.NewRequest("PURGE", "/resource", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "An unauthenticated PURGE shouldn't purge")
+
+	assert.Equal(t, http.StatusNoContent, serve(handler, adminRequest("PURGE", "/resource", "")).Code)
+	serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	purgeMiddleware, err = NewPublicPurgeMiddleware(config.AdminConfig{ClientCAFile: "ca.pem", PublicPurge: true}, reverseProxy.cache)
+	assert.NoError(t, err)
+	handler = reverseProxy.RoutingMiddleware(purgeMiddleware(reverseProxy.GetHandler()))
+	assert.Equal(t, http.StatusForbidden, serve(handler, httptest.NewRequest("PURGE", "/resource", nil)).Code)
+}
+
+func TestAdminEntriesAndPurge(t *testing.T) {
+	admin, proxy, _ := newTestAdmin(t)
+	for _, path := range []string{"/static/a.css", "/static/b.css", "/api/users", "/api/groups"} {
+		serve(proxy, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	recorder := serve(admin, adminRequest(http.MethodGet, "/entries?prefix=/static/", ""))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	listed := decodeJSON(t, recorder)
+	assert.Equal(t, float64(2), listed["count"])
+	assert.Equal(t, float64(2), decodeJSON(t, serve(admin, adminRequest(http.MethodGet, "/entries?tag=static", "")))["count"])
+
+	key := listed["entries"].([]interface{})[0].(map[string]interface{})["key"].(string)
+	recorder = serve(admin, adminRequest(http.MethodGet, "/entry?key="+key, ""))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "/static/a.css", decodeJSON(t, recorder)["requestURI"])
+	assert.Equal(t, http.StatusNotFound, serve(admin, adminRequest(http.MethodGet, "/entry?key=unknown", "")).Code)
+
+	testCases := []struct {
+		body           string
+		expectedStatus int
+		expectedPurged float64
+	}{
+		{body: `{"key": "` + key + `"}`, expectedStatus: http.StatusOK, expectedPurged: 1},
+		{body: `{"regex": "^/api/(users|unknown)$"}`, expectedStatus: http.StatusOK, expectedPurged: 1},
+		{body: `{"prefix": "/static/", "soft": true}`, expectedStatus: http.StatusOK, expectedPurged: 1},
+		{body: `{"tag": "static", "route": "other"}`, expectedStatus: http.StatusOK, expectedPurged: 0},
+		{body: `{"tag": "static"}`, expectedStatus: http.StatusOK, expectedPurged: 1},
+		{body: `{"prefix": "/static/", "regex": "."}`, expectedStatus: http.StatusBadRequest},
+		{body: `{"regex": "("}`, expectedStatus: http.StatusBadRequest},
+		{body: `{"prefix": "/static/", "route": "other"}`, expectedStatus: http.StatusOK, expectedPurged: 0},
+		{body: `{"all": true}`, expectedStatus: http.StatusOK, expectedPurged: 1},
+	}
+	for _, test := range testCases {
+		recorder := serve(admin, adminRequest(http.MethodPost, "/purge", test.body))
+		assert.Equal(t, test.expectedStatus, recorder.Code, test.body)
+		if test.expectedStatus == http.StatusOK {
+			assert.Equal(t, test.expectedPurged, decodeJSON(t, recorder)["purged"], test.body)
+		}
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(admin, adminRequest(http.MethodGet, "/purge", "")).Code)
+}
+
+func TestAdminStats(t *testing.T) {
+	admin, proxy, _ := newTestAdmin(t)
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/resource", nil))
+
+	stats := decodeJSON(t, serve(admin, adminRequest(http.MethodGet, "/stats", "")))
+	assert.Equal(t, map[string]interface{}{"HIT": float64(1), "MISS": float64(1)}, stats["requests"])
+	assert.Equal(t, float64(1), stats["cache"].(map[string]interface{})["entries"])
+
+	recorder := serve(admin, adminRequest(http.MethodGet, "/metrics", ""))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `caeche_requests_total{cache="HIT",code="200",route="default"} 1`)
+}
+
+func TestAdminHealth(t *testing.T) {
+	admin, _, reverseProxy := newTestAdmin(t)
+	recorder := serve(admin, adminRequest(http.MethodGet, "/health", ""))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ok", decodeJSON(t, recorder)["status"])
+
+	reverseProxy.router.defaultRoute.pool.replicas[0].unhealthy = 1
+	recorder = serve(admin, adminRequest(http.MethodGet, "/health", ""))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "degraded", decodeJSON(t, recorder)["status"])
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	admin, proxy, _ := newTestAdmin(t)
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/static/a.css", nil))
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+
+	recorder := serve(admin, adminRequest(http.MethodGet, "/snapshot", ""))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	snapshot := recorder.Body.String()
+
+	restoredAdmin, restoredProxy, _ := newTestAdmin(t)
+	recorder = serve(restoredAdmin, adminRequest(http.MethodPut, "/snapshot", snapshot))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, float64(2), decodeJSON(t, recorder)["restored"])
+	recorder = serve(restoredProxy, httptest.NewRequest(http.MethodGet, "/static/a.css", nil))
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "hit")
+
+	assert.Equal(t, http.StatusBadRequest, serve(restoredAdmin, adminRequest(http.MethodPut, "/snapshot", "invalid")).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(admin, adminRequest(http.MethodPost, "/snapshot", "")).Code)
+}
+
+func TestAdminWarm(t *testing.T) {
+	admin, proxy, _ := newTestAdmin(t)
+	recorder := serve(admin, adminRequest(http.MethodPost, "/warm", `{"urls": ["http://example.com/static/a.css"]}`))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, true, decodeJSON(t, recorder)["running"])
+
+	var report map[string]interface{}
+	for i := 0; i < 100; i++ {
+		report = decodeJSON(t, serve(admin, adminRequest(http.MethodGet, "/warm", "")))
+		if report["running"] == false {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, false, report["running"])
+	assert.Equal(t, float64(1), report["succeeded"])
+	recorder = serve(proxy, httptest.NewRequest(http.MethodGet, "/static/a.css", nil))
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "hit")
+
+	assert.Equal(t, http.StatusBadRequest, serve(admin, adminRequest(http.MethodPost, "/warm", `{}`)).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(admin, adminRequest(http.MethodPost, "/warm", "invalid")).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(admin, adminRequest(http.MethodPut, "/warm", "")).Code)
+}
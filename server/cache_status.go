@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const cacheStatusName = "caeche"
+
+// cacheStatus describes how the cache handled a request. It's written in the
+// Cache-Status header (RFC 9211), in the X-Cache debug header and in the logs.
+type cacheStatus struct {
+	// flag sums up the status: HIT, STALE, REVALIDATED, MISS or BYPASS
+	flag string
+	// hit tells if the response was served from cache without going forward
+	hit bool
+	// forward tells why the request was forwarded to the backend
+	forward string
+	// forwardStatus is the status code of the backend response
+	forwardStatus int
+	// stored tells if the backend response was stored in cache
+	stored bool
+	// collapsed tells if the request waited for a concurrent one
+	collapsed bool
+	// ttl is the remaining freshness lifetime of the response, negative if stale
+	ttl *time.Duration
+	// detail tells more about the status, e.g. why the response was not stored
+	detail string
+}
+
+func hitStatus(expires time.Time) cacheStatus {
+	return cacheStatus{flag: "HIT", hit: true, ttl: ttlUntil(expires)}
+}
+
+func staleStatus(expires time.Time, detail string) cacheStatus {
+	return cacheStatus{flag: "STALE", hit: true, ttl: ttlUntil(expires), detail: detail}
+}
+
+func forwardedStaleStatus(expires time.Time, forwardStatus int, detail string) cacheStatus {
+	return cacheStatus{flag: "STALE", forward: "stale", forwardStatus: forwardStatus, ttl: ttlUntil(expires), detail: detail}
+}
+
+func revalidatedStatus() cacheStatus {
+	return cacheStatus{flag: "REVALIDATED", forward: "stale", forwardStatus: http.StatusNotModified}
+}
+
+func missStatus(forward string, forwardStatus int, stored bool, detail string) cacheStatus {
+	return cacheStatus{flag: "MISS", forward: forward, forwardStatus: forwardStatus, stored: stored, detail: detail}
+}
+
+func bypassStatus(forward string, forwardStatus int) cacheStatus {
+	return cacheStatus{flag: "BYPASS", forward: forward, forwardStatus: forwardStatus}
+}
+
+// String formats the status as a Cache-Status header value.
+func (status cacheStatus) String() string {
+	parameters := []string{cacheStatusName}
+	if status.hit {
+		parameters = append(parameters, "hit")
+	}
+	if status.forward != "" {
+		parameters = append(parameters, "fwd="+status.forward)
+	}
+	if status.forwardStatus != 0 {
+		parameters = append(parameters, fmt.Sprintf("fwd-status=%d", status.forwardStatus))
+	}
+	if status.ttl != nil {
+		parameters = append(parameters, fmt.Sprintf("ttl=%d", int(status.ttl.Seconds())))
+	}
+	if status.stored {
+		parameters = append(parameters, "stored")
+	}
+	if status.collapsed {
+		parameters = append(parameters, "collapsed")
+	}
+	if status.detail != "" {
+		parameters = append(parameters, "detail="+status.detail)
+	}
+	return strings.Join(parameters, "; ")
+}
+
+// setCacheStatusHeaders adds the Cache-Status header to the response, after
+// the ones set by upstream caches, and the X-Cache header if enabled.
+func (reverseProxy *ReverseProxy) setCacheStatusHeaders(rw http.ResponseWriter, status cacheStatus) {
+	rw.Header().Add("Cache-Status", status.String())
+	if reverseProxy.config.Cache.DebugHeader {
+		rw.Header().Set("X-Cache", status.flag)
+	}
+}
+
+func ttlUntil(expires time.Time) *time.Duration {
+	ttl := time.Until(expires)
+	return &ttl
+}
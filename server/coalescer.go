@@ -0,0 +1,120 @@
+package server
+
+import (
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"net/http"
+	"sync"
+)
+
+// maxLearnedVaries bounds the number of resources whose Vary header is
+// remembered, the oldest being forgotten all at once past it.
+const maxLearnedVaries = 10000
+
+// coalescer lets concurrent cache misses on the same variant of a resource
+// wait for a single backend fetch, instead of all of them hitting the backend.
+// The variants are told apart by the Vary header learned from the previous
+// fetches of the resource.
+type coalescer struct {
+	mutex  sync.Mutex
+	calls  map[string]*coalescedFetch
+	varies map[string][]string
+}
+
+// coalescedFetch is a backend fetch led by a request, that the concurrent
+// requests for the same variant of the resource wait for.
+type coalescedFetch struct {
+	coalescer *coalescer
+	resource  string
+	// fetched is closed once the fetched response is in cache
+	fetched chan struct{}
+	// varied is closed once the variant fetched is known, or the fetch done
+	varied chan struct{}
+	once   sync.Once
+	// headers and variant are the headers of the fetched response, and the
+	// variant of the resource they select for the leading request
+	headers http.Header
+	variant string
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalescedFetch), varies: make(map[string][]string)}
+}
+
+// join tells if the caller leads the fetch of the variant of the resource
+// identified by key the request selects. The leader must call done once the
+// fetched response is in cache; the others wait for the fetched channel of the
+// returned fetch to be closed before looking it up.
+func (coalescer *coalescer) join(key string, req *http.Request) (leader bool, call *coalescedFetch, done func()) {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	call = &coalescedFetch{coalescer: coalescer, resource: key, fetched: make(chan struct{}), varied: make(chan struct{})}
+	callKey := key
+	if vary, ok := coalescer.varies[key]; ok {
+		variant, ok := cachePackage.Variant(req, http.Header{"Vary": vary})
+		if !ok {
+			// The responses varying on "*" aren't cached, there's nothing to wait for
+			return true, call, func() { call.announce(nil, "") }
+		}
+		callKey = variantKey(key, variant)
+	}
+	if existing, ok := coalescer.calls[callKey]; ok {
+		return false, existing, nil
+	}
+	coalescer.calls[callKey] = call
+	return true, call, func() {
+		call.announce(nil, "")
+		coalescer.mutex.Lock()
+		for _, callKey := range []string{callKey, variantKey(key, call.variant)} {
+			if coalescer.calls[callKey] == call {
+				delete(coalescer.calls, callKey)
+			}
+		}
+		coalescer.mutex.Unlock()
+		close(call.fetched)
+	}
+}
+
+func variantKey(key string, variant string) string {
+	return key + " variant " + variant
+}
+
+// learn remembers the Vary header of the responses of the resource identified
+// by key, so that its variants are fetched apart.
+func (coalescer *coalescer) learn(key string, headers http.Header) {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	coalescer.learnLocked(key, headers)
+}
+
+func (coalescer *coalescer) learnLocked(key string, headers http.Header) {
+	vary := headers.Values("Vary")
+	if len(vary) == 0 {
+		delete(coalescer.varies, key)
+		return
+	}
+	if _, ok := coalescer.varies[key]; !ok && len(coalescer.varies) >= maxLearnedVaries {
+		coalescer.varies = make(map[string][]string)
+	}
+	coalescer.varies[key] = append([]string(nil), vary...)
+}
+
+// announce tells the requests waiting for the fetch which variant of the
+// resource is fetched, as soon as the headers of the response are known, so
+// that the ones selecting another variant don't wait for it. Only the first
+// call counts.
+func (call *coalescedFetch) announce(headers http.Header, variant string) {
+	call.once.Do(func() {
+		if headers != nil {
+			// The requests selecting the same variant join the fetch from now on
+			coalescer := call.coalescer
+			coalescer.mutex.Lock()
+			coalescer.learnLocked(call.resource, headers)
+			if _, ok := coalescer.calls[variantKey(call.resource, variant)]; !ok && coalescer.varies[call.resource] != nil {
+				coalescer.calls[variantKey(call.resource, variant)] = call
+			}
+			coalescer.mutex.Unlock()
+		}
+		call.headers, call.variant = headers, variant
+		close(call.varied)
+	})
+}
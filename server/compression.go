@@ -0,0 +1,485 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// upstreamEncoding is the Accept-Encoding the requests are normalized to when
+// the responses are encoded for every client, so that a single representation
+// of them is cached whatever the encodings the clients accept.
+const upstreamEncoding = "gzip"
+
+// compression negotiates the encoding of the responses with the clients,
+// compressing and decompressing them on the fly or, when storing encoded
+// variants, compressing them once before they're cached.
+type compression struct {
+	encodings    []string
+	contentTypes []string
+	minSize      int64
+	store        bool
+}
+
+func newCompression(compressionConfig config.CompressionConfig) (*compression, error) {
+	encodings := make([]string, 0, len(compressionConfig.Encodings))
+	for _, encoding := range compressionConfig.Encodings {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding == "" || !isSupportedEncoding(encoding) {
+			return nil, fmt.Errorf("unsupported compression encoding %q", encoding)
+		}
+		encodings = append(encodings, encoding)
+	}
+	return &compression{
+		encodings:    encodings,
+		contentTypes: compressionConfig.ContentTypes,
+		minSize:      compressionConfig.MinSize,
+		store:        compressionConfig.Store,
+	}, nil
+}
+
+// normalize replaces the Accept-Encoding header of the request, which is part
+// of the cache key of the responses varying on it, by the encoding of the
+// representation to fetch and cache. It returns the encodings the client
+// accepts, which the response is encoded for. The header is left as is when
+// compression is disabled, and a range request only asks for an encoding the
+// client accepts, the ranges applying to the encoded representation.
+func (compression *compression) normalize(req *http.Request) acceptEncoding {
+	accepted := parseAcceptEncoding(req.Header.Get("Accept-Encoding"))
+	if len(compression.encodings) == 0 {
+		return accepted
+	}
+	normalized := upstreamEncoding
+	if compression.store || (req.Header.Get("Range") != "" && !accepted.accepts(normalized)) {
+		if normalized = accepted.preferred(compression.encodings); normalized == "" {
+			normalized = "identity"
+		}
+	}
+	req.Header.Set("Accept-Encoding", normalized)
+	return accepted
+}
+
+type acceptEncodingContextKey struct{}
+
+// withAcceptEncoding binds the request to the encodings its client accepts,
+// its Accept-Encoding header being normalized.
+func withAcceptEncoding(req *http.Request, accepted acceptEncoding) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), acceptEncodingContextKey{}, accepted))
+}
+
+// withoutUnacceptedRange returns the request without its Range header when
+// the response is encoded in an encoding the client doesn't accept, so that
+// the whole body is decoded for it rather than ranges of the encoded one.
+func withoutUnacceptedRange(req *http.Request, response cachePackage.Response) *http.Request {
+	accepted, ok := req.Context().Value(acceptEncodingContextKey{}).(acceptEncoding)
+	if !ok || req.Header.Get("Range") == "" || accepted.accepts(contentEncoding(response.ResponseHeaders)) {
+		return req
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	return req
+}
+
+// writer returns the writer encoding the response to the request for the
+// client, in one of the encodings it accepts.
+func (compression *compression) writer(rw http.ResponseWriter, req *http.Request, accepted acceptEncoding) *encodingWriter {
+	return &encodingWriter{ResponseWriter: rw, compression: compression, method: req.Method, accepted: accepted}
+}
+
+// storeEncoded encodes the fetched response in the encoding it was requested
+// with, so that a variant of it is cached per encoding, when storing encoded
+// variants.
+func (compression *compression) storeEncoded(res *http.Response) {
+	if !compression.store || !compression.compressible(res.StatusCode, res.Header) {
+		return
+	}
+	headers := res.Header
+	addVary(headers, "Accept-Encoding")
+	stored := contentEncoding(headers)
+	target := res.Request.Header.Get("Accept-Encoding")
+	if target == "identity" {
+		target = ""
+	}
+	if stored == target || !isSupportedEncoding(stored) {
+		return
+	}
+	body, err := transcode(res.Body, stored, target)
+	if err != nil {
+		log.Errorf("Encoding %s : %s", res.Request.URL, err)
+		return
+	}
+	res.Body = body
+	res.ContentLength = -1
+	setEncodingHeaders(headers, target)
+}
+
+// compressible tells if the response is worth compressing: its status code
+// allows to transform it, its media type is compressible, and it's already
+// compressed or not known to be smaller than the minimum size.
+func (compression *compression) compressible(statusCode int, headers http.Header) bool {
+	if !isTransformable(statusCode, headers) || !matchesContentType(compression.contentTypes, headers.Get("Content-Type")) {
+		return false
+	}
+	if contentEncoding(headers) != "" {
+		return true
+	}
+	size, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	return err != nil || size >= compression.minSize
+}
+
+// isTransformable tells if the encoding of the response can be changed, which
+// isn't the case of partial responses, of the ones without a body, nor of the
+// ones forbidding it with the no-transform directive.
+func isTransformable(statusCode int, headers http.Header) bool {
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusPartialContent ||
+		statusCode == http.StatusNotModified || headers.Get("Content-Range") != "" {
+		return false
+	}
+	for _, directive := range strings.Split(strings.Join(headers.Values("Cache-Control"), ","), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptEncoding holds the quality values of the encodings accepted by a
+// client, in its Accept-Encoding header (RFC 9110, section 12.5.3).
+type acceptEncoding map[string]float64
+
+func parseAcceptEncoding(header string) acceptEncoding {
+	accepted := acceptEncoding{}
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		encoding := normalizeEncoding(params[0])
+		if encoding == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q >= 0 && q <= 1 {
+					quality = q
+				}
+			}
+		}
+		accepted[encoding] = quality
+	}
+	return accepted
+}
+
+// quality returns the quality value of the encoding, the identity one being
+// acceptable unless explicitly excluded. A client without Accept-Encoding
+// gets the identity encoding only.
+func (accepted acceptEncoding) quality(encoding string) float64 {
+	if encoding == "" {
+		encoding = "identity"
+	}
+	if quality, ok := accepted[encoding]; ok {
+		return quality
+	}
+	if quality, ok := accepted["*"]; ok {
+		if encoding == "identity" && quality == 0 {
+			return 1
+		}
+		return quality
+	}
+	if encoding == "identity" {
+		return 1
+	}
+	return 0
+}
+
+func (accepted acceptEncoding) accepts(encoding string) bool {
+	return accepted.quality(encoding) > 0
+}
+
+// preferred returns the encoding among the given ones that the client
+// prefers, the first one winning ties, or an empty string if it accepts none.
+func (accepted acceptEncoding) preferred(encodings []string) string {
+	preferred, best := "", 0.0
+	for _, encoding := range encodings {
+		if quality := accepted.quality(encoding); quality > best {
+			preferred, best = encoding, quality
+		}
+	}
+	return preferred
+}
+
+// encodingWriter writes a response in an encoding the client accepts,
+// decompressing it if the client doesn't support its encoding, and
+// compressing it on the fly when it's compressible. The encoders are guarded
+// by a mutex, the response being flushed while it's written.
+type encodingWriter struct {
+	http.ResponseWriter
+	compression *compression
+	method      string
+	accepted    acceptEncoding
+	wroteHeader bool
+	mutex       sync.Mutex
+	encoder     encoder
+	// decoding is written the encoded body, decompressed in the background
+	decoding *io.PipeWriter
+	decoded  chan struct{}
+	closed   bool
+}
+
+func (writer *encodingWriter) WriteHeader(statusCode int) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+		writer.negotiate(statusCode)
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+// negotiate sets the encoding of the response, once its headers are known.
+func (writer *encodingWriter) negotiate(statusCode int) {
+	headers := writer.Header()
+	if !isTransformable(statusCode, headers) {
+		return
+	}
+	stored := contentEncoding(headers)
+	target := stored
+	if !writer.accepted.accepts(stored) {
+		target = ""
+	}
+	if target == "" && writer.compression.compressible(statusCode, headers) {
+		target = writer.accepted.preferred(writer.compression.encodings)
+	}
+	if target == stored || !isSupportedEncoding(stored) {
+		return
+	}
+	log.Debugf("Encoding response from %q to %q", stored, target)
+	addVary(headers, "Accept-Encoding")
+	setEncodingHeaders(headers, target)
+	if writer.method == http.MethodHead {
+		return
+	}
+
+	if target != "" {
+		var err error
+		if writer.encoder, err = newEncoder(target, writer.ResponseWriter); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if stored != "" {
+		reader, pipe := io.Pipe()
+		writer.decoding = pipe
+		writer.decoded = make(chan struct{})
+		go writer.decode(stored, reader)
+	}
+}
+
+func (writer *encodingWriter) decode(encoding string, reader *io.PipeReader) {
+	defer close(writer.decoded)
+	decoder, err := newDecoder(encoding, reader)
+	if err == nil {
+		_, err = io.Copy(writerFunc(writer.write), decoder)
+		decoder.Close()
+	}
+	if err != nil {
+		log.Errorf("Decoding %s response : %s", encoding, err)
+	}
+	// Stop the writes of the body, if not done yet
+	reader.CloseWithError(err)
+}
+
+func (writer *encodingWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if writer.decoding != nil {
+		return writer.decoding.Write(data)
+	}
+	return writer.write(data)
+}
+
+// write writes decoded data, encoding it if needed.
+func (writer *encodingWriter) write(data []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.encoder != nil {
+		return writer.encoder.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *encodingWriter) Flush() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.encoder != nil {
+		if err := writer.encoder.Flush(); err != nil {
+			log.Error(err)
+		}
+	}
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes what's left of the encoded body, once the whole response has
+// been written.
+func (writer *encodingWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+	writer.closed = true
+	if writer.decoding != nil {
+		writer.decoding.Close()
+		<-writer.decoded
+	}
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.encoder != nil {
+		return writer.encoder.Close()
+	}
+	return nil
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (write writerFunc) Write(data []byte) (int, error) {
+	return write(data)
+}
+
+// encoder compresses what's written to it, until it's closed.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(encoding string, writer io.Writer) (encoder, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(writer), nil
+	case "br":
+		return brotli.NewWriterLevel(writer, 5), nil
+	case "zstd":
+		return zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+func newDecoder(encoding string, reader io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(reader)
+	case "br":
+		return io.NopCloser(brotli.NewReader(reader)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// transcode returns the body in the to encoding, from the from one, empty
+// meaning the identity encoding. It's encoded in the background as it's read.
+func transcode(body io.ReadCloser, from string, to string) (io.ReadCloser, error) {
+	var decoded io.ReadCloser = body
+	if from != "" {
+		decoder, err := newDecoder(from, body)
+		if err != nil {
+			return nil, err
+		}
+		decoded = &transcodedBody{Reader: decoder, closers: []io.Closer{decoder, body}}
+	}
+	if to == "" {
+		return decoded, nil
+	}
+	reader, pipe := io.Pipe()
+	go func() {
+		encoder, err := newEncoder(to, pipe)
+		if err == nil {
+			if _, err = io.Copy(encoder, decoded); err == nil {
+				err = encoder.Close()
+			}
+		}
+		pipe.CloseWithError(err)
+	}()
+	return &transcodedBody{Reader: reader, closers: []io.Closer{reader, decoded}}, nil
+}
+
+// transcodedBody closes the readers it's read through along with it.
+type transcodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (body *transcodedBody) Close() error {
+	var err error
+	for _, closer := range body.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// setEncodingHeaders sets the headers of a response encoded in encoding,
+// empty meaning the identity one. Its length isn't known anymore, ranges
+// don't apply to it, and its entity-tag can only be weak, the representation
+// being different from the one of the backend.
+func setEncodingHeaders(headers http.Header, encoding string) {
+	if encoding == "" {
+		headers.Del("Content-Encoding")
+	} else {
+		headers.Set("Content-Encoding", encoding)
+	}
+	headers.Del("Content-Length")
+	headers.Del("Accept-Ranges")
+	if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		headers.Set("ETag", "W/"+etag)
+	}
+}
+
+// contentEncoding returns the encoding of the response, empty meaning the
+// identity one.
+func contentEncoding(headers http.Header) string {
+	encoding := normalizeEncoding(headers.Get("Content-Encoding"))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "x-gzip" {
+		return "gzip"
+	}
+	return encoding
+}
+
+// isSupportedEncoding tells if the proxy can encode and decode the encoding,
+// empty meaning the identity one.
+func isSupportedEncoding(encoding string) bool {
+	return encoding == "" || encoding == "gzip" || encoding == "br" || encoding == "zstd"
+}
+
+func addVary(headers http.Header, name string) {
+	for _, value := range strings.Split(strings.Join(headers.Values("Vary"), ","), ",") {
+		if value = strings.TrimSpace(value); value == "*" || strings.EqualFold(value, name) {
+			return
+		}
+	}
+	headers.Add("Vary", name)
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var compressibleBody = strings.Repeat("<p>Lorem ipsum dolor sit amet</p>\n", 100)
+
+func decodeBody(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	encoding := recorder.Header().Get("Content-Encoding")
+	if encoding == "" {
+		return recorder.Body.String()
+	}
+	decoder, err := newDecoder(encoding, recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	body, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPreferredEncoding(t *testing.T) {
+	encodings := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"GZIP;q=1, br;q=0.5", "gzip"},
+		{"zstd, gzip", "zstd"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, parseAcceptEncoding(test.header).preferred(encodings), test.header)
+	}
+
+	assert.True(t, parseAcceptEncoding("").accepts(""))
+	assert.False(t, parseAcceptEncoding("").accepts("gzip"))
+	assert.False(t, parseAcceptEncoding("gzip, identity;q=0").accepts(""))
+	assert.True(t, parseAcceptEncoding("*;q=0").accepts(""))
+}
+
+func TestResponsesAreCompressedForEveryClient(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		assert.Equal(t, upstreamEncoding, req.Header.Get("Accept-Encoding"))
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write([]byte(compressibleBody))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	for _, test := range []struct{ acceptEncoding, expected string }{
+		{"gzip, deflate, br", "br"},
+		{"zstd", "zstd"},
+		{"gzip", "gzip"},
+		{"", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		recorder := serve(handler, req)
+		assert.Equal(t, test.expected, recorder.Header().Get("Content-Encoding"), test.acceptEncoding)
+		assert.Equal(t, compressibleBody, decodeBody(t, recorder), test.acceptEncoding)
+		if test.expected != "" {
+			assert.Less(t, recorder.Body.Len(), len(compressibleBody))
+			assert.Equal(t, `W/"v1"`, recorder.Header().Get("ETag"))
+			assert.Empty(t, recorder.Header().Get("Content-Length"))
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestCompressedResponsesAreDecompressedForClients(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		var body bytes.Buffer
+		encoder := gzip.NewWriter(&body)
+		encoder.Write([]byte(compressibleBody))
+		encoder.Close()
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Write(body.Bytes())
+	}))
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := serve(handler, req)
+	assert.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, decodeBody(t, recorder))
+
+	recorder = serve(handler, httptest.NewRequest(http.MethodGet, "/data", nil))
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, recorder.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	recorder = serve(handler, req)
+	assert.Equal(t, "br", recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, decodeBody(t, recorder))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestIncompressibleAndPartialResponsesAreNotCompressed(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".png") {
+			rw.Header().Set("Content-Type", "image/png")
+		} else {
+			rw.Header().Set("Content-Type", "text/plain")
+		}
+		rw.Write([]byte(compressibleBody))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/image.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := serve(handler, req)
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, recorder.Body.String())
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/text", nil))
+	req = httptest.NewRequest(http.MethodGet, "/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-9")
+	recorder = serve(handler, req)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody[:10], recorder.Body.String())
+}
+
+func TestAcceptEncodingIsKeptWhenCompressionIsDisabled(t *testing.T) {
+	var acceptEncodings []string
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		acceptEncodings = append(acceptEncodings, req.Header.Get("Accept-Encoding"))
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Write([]byte(compressibleBody))
+	}))
+	reverseProxy.compression.encodings = nil
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/text", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	recorder := serve(handler, req)
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, recorder.Body.String())
+	assert.Equal(t, []string{"identity"}, acceptEncodings)
+}
+
+func TestRangesAreOnlyServedInAcceptedEncodings(t *testing.T) {
+	var acceptEncodings []string
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		acceptEncodings = append(acceptEncodings, req.Header.Get("Accept-Encoding"))
+		var body bytes.Buffer
+		encoder := gzip.NewWriter(&body)
+		encoder.Write([]byte(compressibleBody))
+		encoder.Close()
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Write(body.Bytes())
+	}))
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	serve(handler, req)
+
+	req = httptest.NewRequest(http.MethodGet, "/text", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusOK, recorder.Code, "The gzip body can't be ranged for a client not accepting it")
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressibleBody, recorder.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/other", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	serve(handler, req)
+	assert.Equal(t, []string{upstreamEncoding, "identity"}, acceptEncodings)
+}
+
+func TestEncodedVariantsAreStored(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Header().Set("Content-Type", "text/css")
+		rw.Write([]byte(compressibleBody))
+	}))
+	reverseProxy.compression.store = true
+	handler := reverseProxy.GetHandler()
+
+	for _, acceptEncoding := range []string{"br", "gzip", "br, gzip", "", "identity"} {
+		req := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		recorder := serve(handler, req)
+		assert.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+		assert.Equal(t, compressibleBody, decodeBody(t, recorder), acceptEncoding)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+
+	req := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	recorder := serve(handler, req)
+	assert.Equal(t, "br", recorder.Header().Get("Content-Encoding"))
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "hit")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const metricsNamespace = "caeche"
+
+// metrics are the Prometheus metrics of the proxy, in a registry of their own.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	backendDuration *prometheus.HistogramVec
+	backendErrors   *prometheus.CounterVec
+}
+
+func newMetrics(cache cachePackage.Cache) *metrics {
+	metrics := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests handled, by route, cache status (HIT, STALE, REVALIDATED, MISS or BYPASS) and status code.",
+		}, []string{"route", "cache", "code"}),
+		backendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_request_duration_seconds",
+			Help:      "Time until the response headers of the backends, by route, backend and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "backend", "code"}),
+		backendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_errors_total",
+			Help:      "Failed requests to the backends, by route, backend and type of error.",
+		}, []string{"route", "backend", "type"}),
+	}
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.backendDuration,
+		metrics.backendErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if inspector, ok := cache.(cachePackage.Inspector); ok {
+		metrics.registry.MustRegister(newCacheCollector(inspector))
+	}
+	return metrics
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (metrics *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (metrics *metrics) observeRequest(route route, statusCode int, status cacheStatus) {
+	metrics.requests.WithLabelValues(route.label(), status.flag, strconv.Itoa(statusCode)).Inc()
+}
+
+// observeFetch records the outcome of a request to a replica of the backend
+// of the route, the server errors of the latter counting as errors.
+func (metrics *metrics) observeFetch(route route, res *http.Response, err error, duration time.Duration) {
+	if err != nil {
+		metrics.observeBackendError(route, backendErrorType(err))
+		return
+	}
+	metrics.backendDuration.WithLabelValues(route.label(), route.pool.name, strconv.Itoa(res.StatusCode)).Observe(duration.Seconds())
+	if res.StatusCode >= http.StatusInternalServerError {
+		metrics.observeBackendError(route, "server_error")
+	}
+}
+
+func (metrics *metrics) observeBackendError(route route, errorType string) {
+	metrics.backendErrors.WithLabelValues(route.label(), route.pool.name, errorType).Inc()
+}
+
+// backendErrorType sums up why a request to a backend failed.
+func backendErrorType(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoReplicaAvailable):
+		return "no_replica"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	default:
+		return "other"
+	}
+}
+
+// cacheCollector collects the stats of the cache on every scrape.
+type cacheCollector struct {
+	inspector cachePackage.Inspector
+	entries   *prometheus.Desc
+	size      *prometheus.Desc
+	evictions *prometheus.Desc
+	purges    *prometheus.Desc
+}
+
+func newCacheCollector(inspector cachePackage.Inspector) *cacheCollector {
+	return &cacheCollector{
+		inspector: inspector,
+		entries:   prometheus.NewDesc(metricsNamespace+"_cache_entries", "Responses in cache.", nil, nil),
+		size:      prometheus.NewDesc(metricsNamespace+"_cache_size_bytes", "Size of the responses in cache.", nil, nil),
+		evictions: prometheus.NewDesc(metricsNamespace+"_cache_evictions_total", "Responses evicted from the cache to fit in its limits.", nil, nil),
+		purges:    prometheus.NewDesc(metricsNamespace+"_cache_purges_total", "Responses purged from the cache, or marked stale by soft purges.", nil, nil),
+	}
+}
+
+func (collector *cacheCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.entries
+	descs <- collector.size
+	descs <- collector.evictions
+	descs <- collector.purges
+}
+
+func (collector *cacheCollector) Collect(metrics chan<- prometheus.Metric) {
+	stats := collector.inspector.Stats()
+	metrics <- prometheus.MustNewConstMetric(collector.entries, prometheus.GaugeValue, float64(stats.Entries))
+	metrics <- prometheus.MustNewConstMetric(collector.size, prometheus.GaugeValue, float64(stats.Size))
+	metrics <- prometheus.MustNewConstMetric(collector.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	metrics <- prometheus.MustNewConstMetric(collector.purges, prometheus.CounterValue, float64(stats.Purges))
+}
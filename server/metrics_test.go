@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/error" {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Write([]byte("body"))
+	}))
+	handler := reverseProxy.GetHandler()
+	serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/error", nil))
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	deadURL, _ := url.Parse(dead.URL)
+	reverseProxy.router.defaultRoute.pool.replicas[0].host = deadURL.Host
+	serve(handler, httptest.NewRequest(http.MethodGet, "/unreachable", nil))
+
+	recorder := serve(reverseProxy.metrics.handler(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	for _, line := range []string{
+		`caeche_requests_total{cache="MISS",code="200",route="default"} 1`,
+		`caeche_requests_total{cache="HIT",code="200",route="default"} 1`,
+		`caeche_requests_total{cache="MISS",code="500",route="default"} 1`,
+		`caeche_requests_total{cache="MISS",code="502",route="default"} 1`,
+		`caeche_backend_request_duration_seconds_count{backend="default",code="200",route="default"} 1`,
+		`caeche_backend_errors_total{backend="default",route="default",type="server_error"} 1`,
+		`caeche_backend_errors_total{backend="default",route="default",type="connection_refused"} 1`,
+		`caeche_cache_entries 1`,
+		`caeche_cache_purges_total 0`,
+	} {
+		assert.Contains(t, recorder.Body.String(), line+"\n")
+	}
+}
+
+func TestBackendErrorType(t *testing.T) {
+	testCases := map[error]string{
+		errNoReplicaAvailable:                                "no_replica",
+		fmt.Errorf("fetching: %w", context.Canceled):         "canceled",
+		&url.Error{Op: "Get", Err: context.DeadlineExceeded}: "timeout",
+		errors.New("unexpected EOF"):                         "other",
+	}
+	for err, expected := range testCases {
+		assert.Equal(t, expected, backendErrorType(err), err.Error())
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sdelicata/caeche/config"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicasPerHost is the number of points of every replica on the consistent
+// hashing ring, spreading the URLs evenly.
+const replicasPerHost = 100
+
+var errNoReplicaAvailable = errors.New("no replica of the backend available")
+
+// replica is a server of a backend pool.
+type replica struct {
+	host string
+	// active is the number of requests in flight
+	active int64
+	// unhealthy is set by the health checks
+	unhealthy int32
+	// fails is the number of consecutive failures
+	fails int32
+	// ejectedUntil is the time in Unix nanoseconds until which the replica is ejected
+	ejectedUntil int64
+}
+
+func (replica *replica) isAvailable(now time.Time) bool {
+	return atomic.LoadInt32(&replica.unhealthy) == 0 && now.UnixNano() >= atomic.LoadInt64(&replica.ejectedUntil)
+}
+
+// pool spreads the requests over the replicas of a backend, routing around
+// the ones failing the health checks or ejected after consecutive failures.
+type pool struct {
+	name string
+	// host identifies the backend in the URLs of the cached responses,
+	// whichever replica they came from
+	host string
+	// hostHeader is sent to every replica instead of its own host, when set
+	hostHeader   string
+	scheme       string
+	replicas     []*replica
+	balancing    string
+	next         uint32
+	ring         []ringPoint
+	maxFails     int32
+	ejectionTime time.Duration
+	healthCheck  config.HealthCheckConfig
+}
+
+type ringPoint struct {
+	hash    uint32
+	replica *replica
+}
+
+func newPool(name string, backend config.BackendConfig) (*pool, error) {
+	hosts := backend.Hosts
+	switch {
+	case len(hosts) == 0 && backend.Host == "":
+		hosts = []string{config.DEFAULT_BACKEND_HOST}
+	case len(hosts) == 0:
+		hosts = []string{backend.Host}
+	}
+	pool := &pool{
+		name:         name,
+		host:         hosts[0],
+		scheme:       backend.Scheme,
+		balancing:    backend.Balancing,
+		maxFails:     int32(backend.MaxFails),
+		ejectionTime: time.Duration(backend.EjectionTime) * time.Second,
+		healthCheck:  backend.HealthCheck,
+	}
+	if backend.Host != "" {
+		pool.host = backend.Host
+		pool.hostHeader = backend.Host
+	}
+	if pool.scheme == "" {
+		pool.scheme = config.DEFAULT_BACKEND_SCHEME
+	}
+	if pool.balancing == "" {
+		pool.balancing = config.DEFAULT_BACKEND_BALANCING
+	}
+	if pool.ejectionTime == 0 {
+		pool.ejectionTime = time.Duration(config.DEFAULT_EJECTION_TIME) * time.Second
+	}
+	if pool.healthCheck.Interval == 0 {
+		pool.healthCheck.Interval = config.DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if pool.healthCheck.Timeout == 0 {
+		pool.healthCheck.Timeout = config.DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	for _, host := range hosts {
+		pool.replicas = append(pool.replicas, &replica{host: host})
+	}
+
+	switch pool.balancing {
+	case "round-robin", "least-connections":
+	case "consistent-hash":
+		for _, replica := range pool.replicas {
+			for i := 0; i < replicasPerHost; i++ {
+				pool.ring = append(pool.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", replica.host, i)), replica: replica})
+			}
+		}
+		sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	default:
+		return nil, fmt.Errorf("unknown balancing %q", pool.balancing)
+	}
+	return pool, nil
+}
+
+// pick returns an available replica for the request, except the ones already
+// tried.
+func (pool *pool) pick(req *http.Request, tried map[*replica]bool) (*replica, error) {
+	now := time.Now()
+	isCandidate := func(replica *replica) bool {
+		return !tried[replica] && replica.isAvailable(now)
+	}
+	switch pool.balancing {
+	case "least-connections":
+		var picked *replica
+		start := int(atomic.AddUint32(&pool.next, 1))
+		for i := range pool.replicas {
+			replica := pool.replicas[(start+i)%len(pool.replicas)]
+			if isCandidate(replica) && (picked == nil || atomic.LoadInt64(&replica.active) < atomic.LoadInt64(&picked.active)) {
+				picked = replica
+			}
+		}
+		if picked != nil {
+			return picked, nil
+		}
+	case "consistent-hash":
+		hash := hashString(req.URL.RequestURI())
+		start := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= hash })
+		for i := range pool.ring {
+			if point := pool.ring[(start+i)%len(pool.ring)]; isCandidate(point.replica) {
+				return point.replica, nil
+			}
+		}
+	default:
+		start := int(atomic.AddUint32(&pool.next, 1))
+		for i := range pool.replicas {
+			if replica := pool.replicas[(start+i)%len(pool.replicas)]; isCandidate(replica) {
+				return replica, nil
+			}
+		}
+	}
+	return nil, errNoReplicaAvailable
+}
+
+// report records the outcome of a request to the replica, ejecting the latter
+// after too many consecutive failures.
+func (pool *pool) report(replica *replica, failed bool) {
+	if !failed {
+		atomic.StoreInt32(&replica.fails, 0)
+		return
+	}
+	fails := atomic.AddInt32(&replica.fails, 1)
+	if pool.maxFails > 0 && fails >= pool.maxFails {
+		log.Warnf("Ejecting replica %s for %s after %d failures", replica.host, pool.ejectionTime, fails)
+		atomic.StoreInt64(&replica.ejectedUntil, time.Now().Add(pool.ejectionTime).UnixNano())
+		atomic.StoreInt32(&replica.fails, 0)
+	}
+}
+
+// startHealthChecks checks the replicas every interval, until the returned
+// function is called. It does nothing without health check path.
+func (pool *pool) startHealthChecks(client *http.Client) func() {
+	if pool.healthCheck.Path == "" {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Duration(pool.healthCheck.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			pool.checkHealth(client)
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (pool *pool) checkHealth(client *http.Client) {
+	var wg sync.WaitGroup
+	for _, member := range pool.replicas {
+		wg.Add(1)
+		go func(replica *replica) {
+			defer wg.Done()
+			healthy := pool.isHealthy(client, replica)
+			var unhealthy int32
+			if !healthy {
+				unhealthy = 1
+			}
+			if previous := atomic.SwapInt32(&replica.unhealthy, unhealthy); previous != unhealthy {
+				log.Warnf("Replica %s is now %s", replica.host, map[bool]string{true: "healthy", false: "unhealthy"}[healthy])
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+func (pool *pool) isHealthy(client *http.Client, replica *replica) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pool.healthCheck.Timeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pool.scheme+"://"+replica.host+pool.healthCheck.Path, nil)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Debugf("Health check of %s failed : %s", replica.host, err)
+		return false
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	return res.StatusCode < http.StatusBadRequest
+}
+
+// replicaHealth describes the state of a replica of a backend.
+type replicaHealth struct {
+	Host      string `json:"host"`
+	Healthy   bool   `json:"healthy"`
+	Ejected   bool   `json:"ejected"`
+	Available bool   `json:"available"`
+	Active    int64  `json:"active"`
+}
+
+// health returns the state of every replica.
+func (pool *pool) health() []replicaHealth {
+	now := time.Now()
+	replicas := make([]replicaHealth, len(pool.replicas))
+	for i, replica := range pool.replicas {
+		replicas[i] = replicaHealth{
+			Host:      replica.host,
+			Healthy:   atomic.LoadInt32(&replica.unhealthy) == 0,
+			Ejected:   now.UnixNano() < atomic.LoadInt64(&replica.ejectedUntil),
+			Available: replica.isAvailable(now),
+			Active:    atomic.LoadInt64(&replica.active),
+		}
+	}
+	return replicas
+}
+
+// releasingBody releases its replica once closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+func hashString(value string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(value))
+	return hash.Sum32()
+}
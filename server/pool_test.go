@@ -0,0 +1,114 @@
+package server
+
+import (
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, backend config.BackendConfig) *pool {
+	pool, err := newPool("test", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func pickHost(t *testing.T, pool *pool, target string) string {
+	replica, err := pool.pick(httptest.NewRequest(http.MethodGet, target, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replica.host
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(t, config.BackendConfig{Hosts: []string{"a", "b", "c"}})
+	picked := map[string]int{}
+	for i := 0; i < 6; i++ {
+		picked[pickHost(t, pool, "/")]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, picked)
+}
+
+func TestPoolDefaultBackendReplicas(t *testing.T) {
+	cfg := config.NewConfigWithDefault()
+	cfg.Backend.Hosts = []string{"10.0.0.1:8080", "10.0.0.2:8080"}
+	pool := newTestPool(t, cfg.Backend)
+	assert.Equal(t, "10.0.0.1:8080", pool.host)
+	assert.Empty(t, pool.hostHeader, "The replicas should receive their own host without configured host")
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, []string{pool.replicas[0].host, pool.replicas[1].host})
+
+	pool = newTestPool(t, config.NewConfigWithDefault().Backend)
+	assert.Equal(t, config.DEFAULT_BACKEND_HOST, pool.host)
+	assert.Equal(t, config.DEFAULT_BACKEND_HOST, pool.replicas[0].host)
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	pool := newTestPool(t, config.BackendConfig{Hosts: []string{"a", "b", "c"}, Balancing: "least-connections"})
+	pool.replicas[0].active = 2
+	pool.replicas[1].active = 1
+	pool.replicas[2].active = 3
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "b", pickHost(t, pool, "/"))
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	pool := newTestPool(t, config.BackendConfig{Hosts: []string{"a", "b", "c"}, Balancing: "consistent-hash"})
+	host := pickHost(t, pool, "/resource?id=1")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, host, pickHost(t, pool, "/resource?id=1"))
+	}
+
+	for _, replica := range pool.replicas {
+		if replica.host == host {
+			replica.unhealthy = 1
+		}
+	}
+	assert.NotEqual(t, host, pickHost(t, pool, "/resource?id=1"), "An unavailable replica should be skipped")
+}
+
+func TestPoolEjectsFailingReplica(t *testing.T) {
+	pool := newTestPool(t, config.BackendConfig{Hosts: []string{"a", "b"}, MaxFails: 2, EjectionTime: 60})
+	a := pool.replicas[0]
+	pool.report(a, true)
+	pool.report(a, false)
+	pool.report(a, true)
+	assert.True(t, a.isAvailable(time.Now()), "Only consecutive failures should eject a replica")
+
+	pool.report(a, true)
+	assert.False(t, a.isAvailable(time.Now()))
+	assert.True(t, a.isAvailable(time.Now().Add(61*time.Second)))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "b", pickHost(t, pool, "/"))
+	}
+
+	pool.replicas[1].unhealthy = 1
+	_, err := pool.pick(httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	assert.Equal(t, errNoReplicaAvailable, err)
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	var healthy int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/health", req.URL.Path)
+		if atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	pool := newTestPool(t, config.BackendConfig{Host: serverURL.Host, HealthCheck: config.HealthCheckConfig{Path: "/health"}})
+
+	pool.checkHealth(http.DefaultClient)
+	assert.True(t, pool.replicas[0].isAvailable(time.Now()))
+	atomic.StoreInt32(&healthy, 0)
+	pool.checkHealth(http.DefaultClient)
+	assert.False(t, pool.replicas[0].isAvailable(time.Now()))
+}
@@ -1,27 +1,103 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	cachePackage "github.com/sdelicata/caeche/cache"
 	"github.com/sdelicata/caeche/config"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type ReverseProxy struct {
-	config config.Config
-	cache  cachePackage.Cache
+	config      config.Config
+	cache       cachePackage.Cache
+	client      *http.Client
+	coalescer   *coalescer
+	unsliced    *unslicedResources
+	router      *router
+	statuses    *statusCounter
+	metrics     *metrics
+	accessLog   *accessLog
+	compression *compression
+	tracer      trace.Tracer
+	propagator  propagation.TextMapPropagator
 }
 
-func NewReverseProxy(config config.Config, cache cachePackage.Cache) *ReverseProxy {
-	return &ReverseProxy{
-		config: config,
-		cache:  cache,
+func NewReverseProxy(config config.Config, cache cachePackage.Cache) (*ReverseProxy, error) {
+	reverseProxy := &ReverseProxy{
+		cache: cache,
+		client: &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		coalescer:  newCoalescer(),
+		unsliced:   newUnslicedResources(),
+		statuses:   newStatusCounter(),
+		metrics:    newMetrics(cache),
+		tracer:     otel.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
 	}
+	return reverseProxy.Reload(config)
+}
+
+// Reload returns a reverse proxy with the routes, backends and cache rules of
+// the config, sharing the cache, stats and metrics of this one, so that it
+// replaces it without losing them. The health checks of its backends are to
+// be started, and the ones of this proxy stopped.
+func (reverseProxy *ReverseProxy) Reload(config config.Config) (*ReverseProxy, error) {
+	router, err := newRouter(config)
+	if err != nil {
+		return nil, err
+	}
+	// The access log is kept open when unchanged, the requests in flight
+	// still writing to it otherwise
+	accessLog := reverseProxy.accessLog
+	if accessLog == nil || config.Log.Access != reverseProxy.config.Log.Access {
+		if accessLog, err = newAccessLog(config.Log.Access); err != nil {
+			return nil, err
+		}
+	}
+	compression, err := newCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	reloaded := *reverseProxy
+	reloaded.config = config
+	reloaded.router = router
+	reloaded.accessLog = accessLog
+	reloaded.compression = compression
+	return &reloaded, nil
+}
+
+// Release closes the access log of this proxy once replaced by reloaded,
+// unless the latter kept it.
+func (reverseProxy *ReverseProxy) Release(reloaded *ReverseProxy) {
+	if reverseProxy.accessLog == nil || reverseProxy.accessLog == reloaded.accessLog {
+		return
+	}
+	if err := reverseProxy.accessLog.Close(); err != nil {
+		log.Errorf("Cannot close access log : %s", err)
+	}
+}
+
+// RoutingMiddleware matches the route of the requests before the next
+// handlers, so that they work on the cache namespace of the route.
+func (reverseProxy *ReverseProxy) RoutingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, _ = reverseProxy.route(req)
+		next.ServeHTTP(rw, req)
+	})
 }
 
 func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
@@ -30,49 +106,107 @@ func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
 		start := time.Now().UTC()
 		var cacheHit bool
 		var cachedResponse cachePackage.Response
+		var leader bool
+		var call *coalescedFetch
+		// prefetched is the response of the backend to a slice request ignoring its range
+		var prefetched *http.Response
+		var prefetchStart time.Time
+		record := &responseRecord{ResponseWriter: rw}
+		rw = record
+		setRequestID(rw, req)
+		// A single representation of the responses is fetched and cached,
+		// encoded for the client as it's written
+		accepted := reverseProxy.compression.normalize(req)
+		req = withAcceptEncoding(req, accepted)
+		encoder := reverseProxy.compression.writer(rw, req, accepted)
+		defer encoder.Close()
+		rw = encoder
+		// Only the proxy fetches slices
+		req.Header.Del(cachePackage.SliceHeader)
+		req, span := reverseProxy.startRequestSpan(req)
+		defer span.End()
 
-		// Prepare request to forward
-		req.Host = reverseProxy.config.Backend.Host
-		req.URL.Host = reverseProxy.config.Backend.Host
-		req.URL.Scheme = reverseProxy.config.Backend.Scheme
+		// Prepare request to forward to the backend of its route
+		req, route := reverseProxy.route(req)
+		req.Host = route.pool.host
+		req.URL.Host = route.pool.host
+		req.URL.Scheme = route.pool.scheme
 		req.RequestURI = ""
 
 		// Serve cache when it's possible
-		acceptCache := cachePackage.AcceptsCache(req)
+		matchedRule, _ := requestRule(route.rules, req)
+		bypass := route.bypass || matchedRule.bypass
+		acceptCache := !bypass && cachePackage.AcceptsCache(req)
 		if acceptCache {
-			cachedResponse, cacheHit = reverseProxy.cache.Get(req)
+			cachedResponse, cacheHit = reverseProxy.getCached(req)
 			if cacheHit && cachePackage.IsValidForRequest(cachedResponse, req) {
-				if cachePackage.IsNotModified(req) {
-					rw.WriteHeader(http.StatusNotModified)
+				reverseProxy.serveCachedResponse(rw, req, cachedResponse, start, hitStatus(cachedResponse.Expires))
+				return
+			}
+
+			// Serve stale cache while it's revalidated in the background
+			if cacheHit && cachePackage.CanServeStaleWhileRevalidate(cachedResponse, req) {
+				reverseProxy.revalidate(req, cachedResponse)
+				reverseProxy.serveStaleResponse(rw, req, cachedResponse, start, staleStatus(cachedResponse.Expires, "stale-while-revalidate"))
+				return
+			}
+
+			// Serve range requests from slices of the resource, if enabled and
+			// supported by its backend
+			if reverseProxy.config.Cache.SliceSize > 0 && req.Method == http.MethodGet && req.Header.Get("Range") != "" &&
+				!reverseProxy.unsliced.has(coalescingKey(req)) {
+				prefetchStart = time.Now().UTC()
+				var served bool
+				if served, prefetched = reverseProxy.serveSlices(rw, req, start); served {
+					return
+				}
+			}
+
+			// Wait for a concurrent fetch of the same variant of the resource, if any
+			if cacheHit {
+				reverseProxy.coalescer.learn(coalescingKey(req), cachedResponse.ResponseHeaders)
+			}
+			var done func()
+			var fetched bool
+			if prefetched == nil {
+				leader, call, done, fetched = reverseProxy.joinFetch(req)
+			}
+			if leader {
+				defer done()
+			} else if fetched {
+				coalescedResponse, ok := reverseProxy.getCached(req)
+				if ok && cachePackage.IsValidForRequest(coalescedResponse, req) {
+					status := hitStatus(coalescedResponse.Expires)
+					status.collapsed = true
+					reverseProxy.serveCachedResponse(rw, req, coalescedResponse, start, status)
 					return
 				}
-				cachePackage.WriteResponse(rw, cachedResponse)
-				logRequest(req, start, cachedResponse.StatusCode, "HIT")
-				return
 			}
 		}
 
-		// If not, forward the request to the backend
-		res, err := reverseProxy.fetch(req)
+		// If not, forward the request to the backend, revalidating the cached response if possible
+		forward := forwardReason(req, bypass, acceptCache, cacheHit)
+		revalidating := cacheHit && cachePackage.HasValidators(cachedResponse) && prefetched == nil
+		fetchStart := prefetchStart
+		res, err := prefetched, error(nil)
+		if prefetched == nil {
+			fetchStart = time.Now().UTC()
+			res, err = reverseProxy.fetchConditionally(req, cachedResponse, revalidating)
+		}
+		fetched := time.Now().UTC()
+		record.backendLatency = fetched.Sub(fetchStart)
 
 		// Error while fetching from backend: serve stale cache or 502
 		if err != nil {
 			log.Error(err)
-			if cacheHit {
-				log.Debug("Serving stale response")
-				rw.Header().Set("Warning", "110 Caeche/1.0.0 \"This response comes from a stale cache\"") // https://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html#sec13.1.2
-				cachePackage.WriteResponse(rw, cachedResponse)
-				logRequest(req, start, cachedResponse.StatusCode, "HIT")
+			if cacheHit && !cachePackage.MustRevalidate(cachedResponse) {
+				reverseProxy.serveStaleResponse(rw, req, cachedResponse, start, forwardedStaleStatus(cachedResponse.Expires, 0, "backend-unreachable"))
 				return
 			}
+			status := missStatus(forward, 0, false, "backend-unreachable")
+			reverseProxy.setCacheStatusHeaders(rw, status)
 			rw.WriteHeader(http.StatusBadGateway)
-			log.Infof("[%+v] %q %s (%d) %+v",
-				start.UTC(),
-				req.Method,
-				req.URL,
-				http.StatusBadGateway,
-				time.Since(start),
-			)
+			reverseProxy.logRequest(rw, req, start, http.StatusBadGateway, status)
 			return
 		} else {
 			defer func() {
@@ -83,12 +217,33 @@ func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
 			}()
 		}
 
+		// Server error from backend: serve stale cache if allowed
+		if res.StatusCode >= http.StatusInternalServerError && cacheHit && cachePackage.CanServeStaleIfError(cachedResponse, req) {
+			log.Debugf("Backend responded with %d", res.StatusCode)
+			reverseProxy.serveStaleResponse(rw, req, cachedResponse, start, forwardedStaleStatus(cachedResponse.Expires, res.StatusCode, "stale-if-error"))
+			return
+		}
+
+		// Cached response not modified: refresh and serve it
+		if revalidating && res.StatusCode == http.StatusNotModified {
+			refreshedResponse := reverseProxy.refresh(cachedResponse, res, start, fetched)
+			reverseProxy.serveCachedResponse(rw, req, refreshedResponse, start, revalidatedStatus())
+			return
+		}
+		reverseProxy.compression.storeEncoded(res)
+		if leader {
+			variant, _ := cachePackage.Variant(req, res.Header)
+			call.announce(res.Header.Clone(), variant)
+		}
+
 		// Serve fetched response
 		for name, values := range res.Header {
 			for _, value := range values {
 				rw.Header().Set(name, value)
 			}
 		}
+		// The tags are stored along with the response, for the cache only
+		cachePackage.StripTags(rw.Header())
 
 		var trailerKeys []string
 		for key := range res.Trailer {
@@ -98,6 +253,15 @@ func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
 			rw.Header().Set("Trailer", strings.Join(trailerKeys, ","))
 		}
 
+		var status cacheStatus
+		if acceptCache {
+			notStoredReason := notStoredReason(res)
+			status = missStatus(forward, res.StatusCode, notStoredReason == "", notStoredReason)
+		} else {
+			status = bypassStatus(forward, res.StatusCode)
+		}
+		reverseProxy.setCacheStatusHeaders(rw, status)
+
 		done := make(chan bool)
 		go func() {
 			for {
@@ -112,11 +276,19 @@ func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
 
 		rw.WriteHeader(res.StatusCode)
 
-		var buffer bytes.Buffer
-		mrw := io.MultiWriter(rw, &buffer)
-		_, err = io.Copy(mrw, res.Body)
+		// Store the body in cache while it's written, if the response is cacheable
+		var fill *cachePackage.Fill
+		var body io.Writer = rw
+		if acceptCache {
+			if fill = reverseProxy.fill(res, start, fetched); fill != nil {
+				body = io.MultiWriter(rw, fill)
+			}
+		}
+		_, writeSpan := reverseProxy.tracer.Start(req.Context(), "WriteResponse")
+		_, err = io.Copy(body, res.Body)
+		writeSpan.End()
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf("Writing %s : %s", req.URL, err)
 		}
 
 		for key, values := range res.Trailer {
@@ -128,56 +300,384 @@ func (reverseProxy *ReverseProxy) GetHandler() http.Handler {
 
 		close(done)
 
-		// Save cache if the response is cacheable
-		if acceptCache && cachePackage.IsCacheable(res) {
-			date, err := http.ParseTime(res.Header.Get("Date"))
+		if fill != nil {
 			if err != nil {
-				date = start
+				fill.Abort()
 			}
-			reverseProxy.cache.Save(cachePackage.Response{
-				URL:             res.Request.URL.String(),
-				Method:          res.Request.Method,
-				StatusCode:      res.StatusCode,
-				RequestHeaders:  res.Request.Header,
-				ResponseHeaders: res.Header,
-				Body:            buffer.Bytes(),
-				Created:         date,
-			})
-		}
-
-		logRequest(req, start, res.StatusCode, "MISS")
+			fill.Commit()
+		}
+
+		reverseProxy.logRequest(rw, req, start, res.StatusCode, status)
 	})
 }
 
+// revalidate fetches the response of the request again in the background and
+// saves it, unless it's already being fetched.
+func (reverseProxy *ReverseProxy) revalidate(req *http.Request, cachedResponse cachePackage.Response) {
+	// The variants of a resource are revalidated apart
+	reverseProxy.coalescer.learn(coalescingKey(req), cachedResponse.ResponseHeaders)
+	leader, _, done := reverseProxy.coalescer.join(coalescingKey(req), req)
+	if !leader {
+		return
+	}
+	req = detach(req)
+	// The whole response is revalidated, whatever the range requested
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	go func() {
+		defer done()
+		log.Debugf("Revalidating %s in background", req.URL)
+		start := time.Now().UTC()
+		revalidating := cachePackage.HasValidators(cachedResponse)
+		res, err := reverseProxy.fetchConditionally(req, cachedResponse, revalidating)
+		fetched := time.Now().UTC()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		defer res.Body.Close()
+		if revalidating && res.StatusCode == http.StatusNotModified {
+			reverseProxy.refresh(cachedResponse, res, start, fetched)
+			return
+		}
+		reverseProxy.compression.storeEncoded(res)
+		fill := reverseProxy.fill(res, start, fetched)
+		if fill == nil {
+			return
+		}
+		if _, err := io.Copy(fill, res.Body); err != nil {
+			log.Error(err)
+			fill.Abort()
+		}
+		fill.Commit()
+	}()
+}
+
+// fill returns the fill storing the fetched response in cache along with its
+// body, as the latter is written to it, or nil if the response isn't
+// cacheable under the rules of its route. The response headers are stored on
+// commit, with the trailers added to them by then.
+func (reverseProxy *ReverseProxy) fill(res *http.Response, requestTime time.Time, responseTime time.Time) *cachePackage.Fill {
+	if notStoredReason(res) != "" {
+		return nil
+	}
+	response := newCachedResponse(res, requestTime, responseTime)
+	return cachePackage.NewFill(reverseProxy.cache.Fill(response), reverseProxy.config.Cache.MaxObjectSize)
+}
+
+// newCachedResponse returns the fetched response to store in cache, without
+// its body, under the rules of its route.
+func newCachedResponse(res *http.Response, requestTime time.Time, responseTime time.Time) cachePackage.Response {
+	route, _ := routeOf(res.Request)
+	// The request ID echoed by the backend belongs to this request only
+	res.Header.Del(requestIDHeader)
+	response := cachePackage.Response{
+		URL:             res.Request.URL.String(),
+		Method:          res.Request.Method,
+		StatusCode:      res.StatusCode,
+		RequestHeaders:  res.Request.Header,
+		ResponseHeaders: res.Header,
+		Created:         cachePackage.CreationTime(res.Header, requestTime, responseTime),
+		Namespace:       route.name,
+		Host:            cachePackage.Host(res.Request),
+		DefaultTTL:      route.defaultTTL,
+	}
+	matchedRule, _ := responseRule(route.rules, res)
+	matchedRule.policy.Apply(&response)
+	return response
+}
+
+// notStoredReason tells why the response can't be stored in cache under the
+// rules of its route, or returns an empty string if it can.
+func notStoredReason(res *http.Response) string {
+	route, _ := routeOf(res.Request)
+	matchedRule, _ := responseRule(route.rules, res)
+	if matchedRule.bypass {
+		return "bypass"
+	}
+	reason := matchedRule.policy.NotStoredReason(res)
+	if reason != "" {
+		log.Debugf("Response non cacheable : %s", reason)
+	}
+	return reason
+}
+
+// refresh updates the cached response with the 304 Not Modified it was
+// revalidated with, and saves it.
+func (reverseProxy *ReverseProxy) refresh(cachedResponse cachePackage.Response, res *http.Response, requestTime time.Time, responseTime time.Time) cachePackage.Response {
+	res.Header.Del(requestIDHeader)
+	refreshedResponse := cachePackage.Refresh(cachedResponse, res, cachePackage.CreationTime(res.Header, requestTime, responseTime))
+	reverseProxy.cache.Save(refreshedResponse)
+	return refreshedResponse
+}
+
+// joinFetch joins the fetch of the variant of the resource the request
+// selects, leading it unless it's already in flight. Otherwise, it waits for
+// the fetch and tells if it's done, the response being in cache. A fetch of
+// another variant, learned from its response, is left for the one of the
+// request.
+func (reverseProxy *ReverseProxy) joinFetch(req *http.Request) (leader bool, call *coalescedFetch, done func(), fetched bool) {
+	for attempt := 0; attempt < 2; attempt++ {
+		leader, call, done = reverseProxy.coalescer.join(coalescingKey(req), req)
+		if leader {
+			return true, call, done, false
+		}
+		fetched, otherVariant := reverseProxy.waitForConcurrentFetch(req, call)
+		if !otherVariant {
+			return false, call, nil, fetched
+		}
+	}
+	return false, nil, nil, false
+}
+
+// waitForConcurrentFetch waits for the leading fetch of a resource to be done,
+// and returns false if it took longer than the coalescing timeout, or fetches
+// another variant of the resource than the one of the request.
+func (reverseProxy *ReverseProxy) waitForConcurrentFetch(req *http.Request, call *coalescedFetch) (fetched bool, otherVariant bool) {
+	timer := time.NewTimer(time.Duration(reverseProxy.config.Cache.CoalescingTimeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-call.varied:
+		if call.headers != nil {
+			if variant, ok := cachePackage.Variant(req, call.headers); !ok || variant != call.variant {
+				log.Debug("A concurrent fetch is fetching another variant")
+				return false, true
+			}
+		}
+	case <-timer.C:
+		log.Debug("Timeout while waiting for a concurrent fetch")
+		return false, false
+	}
+	select {
+	case <-call.fetched:
+		return true, false
+	case <-timer.C:
+		log.Debug("Timeout while waiting for a concurrent fetch")
+		return false, false
+	}
+}
+
+// fetchConditionally forwards the request to the backend, replacing its
+// conditional headers by the validators of the cached response when
+// revalidating it.
+func (reverseProxy *ReverseProxy) fetchConditionally(req *http.Request, cachedResponse cachePackage.Response, revalidating bool) (*http.Response, error) {
+	if !revalidating {
+		return reverseProxy.fetch(req)
+	}
+	log.Debug("Revalidating cached response")
+	replaced := cachePackage.SetValidators(req, cachedResponse)
+	defer cachePackage.RestoreConditionalHeaders(req, replaced)
+	return reverseProxy.fetch(req)
+}
+
+// fetch forwards the request to a replica of the backend of its route, trying
+// the other ones on error if the request is idempotent.
 func (reverseProxy *ReverseProxy) fetch(req *http.Request) (*http.Response, error) {
-	log.Debugf("Fetching %s", req.URL)
-	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
-	req.Header.Set("X-Forwarded-For", remoteAddr)
-	http.DefaultClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
+	route, _ := routeOf(req)
+	ctx, span := reverseProxy.tracer.Start(req.Context(), "ReverseProxy.fetch",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(routeKey.String(route.label()), backendKey.String(route.pool.name)),
+	)
+	defer span.End()
+	tried := map[*replica]bool{}
+	var lastErr error
+	for {
+		replica, err := route.pool.pick(req, tried)
+		if err != nil {
+			if lastErr != nil {
+				err = lastErr
+			} else {
+				reverseProxy.metrics.observeBackendError(route, backendErrorType(err))
+			}
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		tried[replica] = true
+		fetchStart := time.Now()
+		res, err := reverseProxy.fetchFrom(ctx, route.pool, replica, req)
+		reverseProxy.metrics.observeFetch(route, res, err, time.Since(fetchStart))
+		route.pool.report(replica, err != nil || isReplicaFailure(res.StatusCode))
+		if err == nil {
+			span.SetAttributes(semconv.NetPeerNameKey.String(replica.host), semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+			return res, nil
+		}
+		span.RecordError(err, trace.WithAttributes(semconv.NetPeerNameKey.String(replica.host)))
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		log.Warnf("Fetching %s from %s failed, trying another replica : %s", req.URL, replica.host, err)
+		lastErr = err
 	}
-	res, err := http.DefaultClient.Do(req)
-	delete(req.Header, "X-Forwarded-For")
+}
+
+// fetchFrom forwards the request to the replica, in the trace of ctx. The
+// returned response keeps the request as is, so that it's cached whichever
+// replica it came from.
+func (reverseProxy *ReverseProxy) fetchFrom(ctx context.Context, pool *pool, replica *replica, req *http.Request) (*http.Response, error) {
+	outReq := req.Clone(ctx)
+	outReq.URL.Host = replica.host
+	outReq.Host = replica.host
+	if pool.hostHeader != "" {
+		outReq.Host = pool.hostHeader
+	}
+	log.Debugf("Fetching %s", outReq.URL)
+	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
+	outReq.Header.Set("X-Forwarded-For", remoteAddr)
+	reverseProxy.propagator.Inject(ctx, propagation.HeaderCarrier(outReq.Header))
+
+	atomic.AddInt64(&replica.active, 1)
+	res, err := reverseProxy.client.Do(outReq)
 	if err != nil {
+		atomic.AddInt64(&replica.active, -1)
 		return nil, err
 	}
+	res.Request = req
+	res.Body = &releasingBody{ReadCloser: res.Body, release: func() { atomic.AddInt64(&replica.active, -1) }}
 	removeHopByHop(&res.Header)
 	return res, nil
 }
 
+// StartHealthChecks checks the replicas of every backend, until the returned
+// function is called.
+func (reverseProxy *ReverseProxy) StartHealthChecks() func() {
+	stops := make([]func(), len(reverseProxy.router.pools))
+	for i, pool := range reverseProxy.router.pools {
+		stops[i] = pool.startHealthChecks(reverseProxy.client)
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// isReplicaFailure tells if the status code denotes a replica unable to
+// handle requests.
+func isReplicaFailure(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
+func (reverseProxy *ReverseProxy) serveCachedResponse(rw http.ResponseWriter, req *http.Request, response cachePackage.Response, start time.Time, status cacheStatus) {
+	reverseProxy.setCacheStatusHeaders(rw, status)
+	_, span := reverseProxy.tracer.Start(req.Context(), "WriteResponse")
+	defer span.End()
+	if cachePackage.IsPreconditionFailed(req, response) {
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		reverseProxy.logRequest(rw, req, start, http.StatusPreconditionFailed, status)
+		return
+	}
+	if cachePackage.IsNotModified(req, response) {
+		cachePackage.WriteNotModified(rw, response)
+		reverseProxy.logRequest(rw, req, start, http.StatusNotModified, status)
+		return
+	}
+	statusCode := cachePackage.WriteResponse(rw, withoutUnacceptedRange(req, response), response)
+	reverseProxy.logRequest(rw, req, start, statusCode, status)
+}
+
+func (reverseProxy *ReverseProxy) serveStaleResponse(rw http.ResponseWriter, req *http.Request, response cachePackage.Response, start time.Time, status cacheStatus) {
+	log.Debug("Serving stale response")
+	reverseProxy.setCacheStatusHeaders(rw, status)
+	_, span := reverseProxy.tracer.Start(req.Context(), "WriteResponse")
+	defer span.End()
+	statusCode := cachePackage.WriteStaleResponse(rw, withoutUnacceptedRange(req, response), response)
+	reverseProxy.logRequest(rw, req, start, statusCode, status)
+}
+
+// route returns the request bound to its route, matching the latter unless
+// already done.
+func (reverseProxy *ReverseProxy) route(req *http.Request) (*http.Request, route) {
+	if route, ok := routeOf(req); ok {
+		return req, route
+	}
+	route := reverseProxy.router.match(req)
+	log.Debugf("Routing %s%s to %q", req.Host, req.URL.Path, route.name)
+	return withRoute(cachePackage.WithHost(req, req.Host), route), route
+}
+
+// detach returns a copy of the request outliving the client connection, still
+// bound to its route.
+func detach(req *http.Request) *http.Request {
+	route, _ := routeOf(req)
+	detached := cachePackage.WithHost(req.Clone(context.Background()), cachePackage.Host(req))
+	return withRoute(detached, route)
+}
+
+// forwardReason tells why the request is forwarded to the backend, following
+// the fwd values of the Cache-Status header (RFC 9211).
+func forwardReason(req *http.Request, bypass bool, acceptCache bool, cacheHit bool) string {
+	if bypass {
+		return "bypass"
+	}
+	if !acceptCache {
+		return cachePackage.BypassReason(req)
+	}
+	if cacheHit {
+		return "stale"
+	}
+	return "uri-miss"
+}
+
+// coalescingKey identifies the concurrent fetches of the same resource, its
+// variants being told apart by the coalescer.
+func coalescingKey(req *http.Request) string {
+	key := req.Method + " " + req.URL.String()
+	if slice := req.Header.Get(cachePackage.SliceHeader); slice != "" {
+		key += " slice " + slice
+	}
+	return key
+}
+
 func removeHopByHop(headers *http.Header) {
 	for _, hopByHopHeader := range []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "TE", "Trailers", "Transfer-Encoding", "Upgrade"} {
 		delete(*headers, hopByHopHeader)
 	}
 }
 
-func logRequest(req *http.Request, start time.Time, statusCode int, flag string) {
-	log.Infof("[%+v] \"%s\" %s (%d) %+v [%s]",
-		start.UTC(),
-		req.Method,
-		req.URL,
-		statusCode,
-		time.Since(start),
-		flag,
+// logRequest counts the request in the stats and metrics, and writes it to
+// the access log.
+func (reverseProxy *ReverseProxy) logRequest(rw http.ResponseWriter, req *http.Request, start time.Time, statusCode int, status cacheStatus) {
+	// The response is complete: what the encoder holds is written before
+	// the bytes sent are counted
+	if encoder, ok := rw.(*encodingWriter); ok {
+		if err := encoder.Close(); err != nil {
+			log.Errorf("Encoding %s : %s", req.URL, err)
+		}
+		rw = encoder.ResponseWriter
+	}
+	reverseProxy.statuses.add(status.flag)
+	route, _ := routeOf(req)
+	reverseProxy.metrics.observeRequest(route, statusCode, status)
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(
+		semconv.HTTPStatusCodeKey.Int(statusCode),
+		routeKey.String(route.label()),
+		cacheStatusKey.String(status.flag),
 	)
+	if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	if reverseProxy.accessLog == nil {
+		return
+	}
+	entry := accessLogEntry{
+		Time:      start,
+		ClientIP:  clientIP(req),
+		Method:    req.Method,
+		URL:       req.URL.RequestURI(),
+		Protocol:  req.Proto,
+		Status:    statusCode,
+		Duration:  time.Since(start).Seconds(),
+		Cache:     status.flag,
+		Route:     route.label(),
+		RequestID: req.Header.Get(requestIDHeader),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if record, ok := rw.(*responseRecord); ok {
+		entry.Bytes = record.bytes
+		entry.BackendLatency = record.backendLatency.Seconds()
+	}
+	reverseProxy.accessLog.write(entry)
 }
@@ -0,0 +1,668 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestReverseProxy(t *testing.T, backend http.Handler) (*ReverseProxy, *config.Config) {
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+	backendURL, _ := url.Parse(server.URL)
+
+	cfg := config.NewConfigWithDefault()
+	cfg.Backend.Host = backendURL.Host
+	cfg.Backend.Scheme = backendURL.Scheme
+	reverseProxy, err := NewReverseProxy(cfg, cache.NewInMemory(cfg.DefaultTTL, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reverseProxy, &reverseProxy.config
+}
+
+func serve(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestConcurrentMissesAreCoalesced(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("body"))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/resource", nil))
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "body", recorder.Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestCoalescedMissesFallThroughAfterTimeout(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		rw.Write([]byte("body"))
+	}))
+	cfg.Cache.CoalescingTimeout = 1
+	handler := reverseProxy.GetHandler()
+
+	go serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, "body", recorder.Body.String())
+	assert.Less(t, int64(time.Since(start)), int64(1400*time.Millisecond))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestConcurrentMissesAreCoalescedByVariant(t *testing.T) {
+	var mutex sync.Mutex
+	fetches := map[string]int{}
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		language := req.Header.Get("Accept-Language")
+		mutex.Lock()
+		fetches[language]++
+		mutex.Unlock()
+		rw.Header().Set("Vary", "Accept-Language")
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		rw.Write([]byte(language))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	get := func(language string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+		req.Header.Set("Accept-Language", language)
+		return serve(handler, req)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, "fr", get("fr").Body.String())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for _, language := range []string{"fr", "en", "en", "en"} {
+		language := language
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, language, get(language).Body.String())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"fr": 1, "en": 1}, fetches)
+}
+
+func TestCoalescerJoin(t *testing.T) {
+	coalescer := newCoalescer()
+	french := httptest.NewRequest(http.MethodGet, "/", nil)
+	french.Header.Set("Accept-Language", "fr")
+	english := httptest.NewRequest(http.MethodGet, "/", nil)
+	english.Header.Set("Accept-Language", "en")
+
+	leader, call, done := coalescer.join("key", french)
+	assert.True(t, leader)
+
+	follower, followerCall, _ := coalescer.join("key", english)
+	assert.False(t, follower, "The variants are unknown until fetched")
+	assert.Equal(t, call, followerCall)
+
+	other, _, otherDone := coalescer.join("other", french)
+	assert.True(t, other)
+	otherDone()
+
+	call.announce(http.Header{"Vary": {"Accept-Language"}}, "fr")
+	call.announce(nil, "")
+	<-followerCall.varied
+	assert.Equal(t, "fr", followerCall.variant)
+
+	leader, _, englishDone := coalescer.join("key", english)
+	assert.True(t, leader, "Another variant should be fetched apart once the Vary header is known")
+	englishDone()
+
+	done()
+	<-call.fetched
+
+	leader, _, done = coalescer.join("key", french)
+	assert.True(t, leader, "A new fetch should be led once the previous one is done")
+	done()
+}
+
+func TestServeStaleWhileRevalidate(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetch := atomic.AddInt32(&fetches, 1)
+		rw.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=60")
+		if fetch == 1 {
+			rw.Header().Set("Date", time.Now().Add(-20*time.Second).UTC().Format(http.TimeFormat))
+		}
+		rw.Write([]byte(fmt.Sprintf("fetch %d", fetch)))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/swr", nil))
+	assert.Equal(t, "fetch 1", recorder.Body.String())
+
+	recorder = serve(handler, httptest.NewRequest(http.MethodGet, "/swr", nil))
+	assert.Equal(t, "fetch 1", recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Warning"), "110")
+	assert.NotEmpty(t, recorder.Header().Get("Age"))
+
+	assert.Eventually(t, func() bool {
+		return serve(handler, httptest.NewRequest(http.MethodGet, "/swr", nil)).Body.String() == "fetch 2"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestServeStaleIfError(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=10, stale-if-error=60")
+		rw.Header().Set("Date", time.Now().Add(-20*time.Second).UTC().Format(http.TimeFormat))
+		rw.Write([]byte("original"))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/sie", nil))
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/sie", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "original", recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Warning"), "110")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestServerErrorWithoutStaleIfError(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=10")
+		rw.Header().Set("Date", time.Now().Add(-20*time.Second).UTC().Format(http.TimeFormat))
+		rw.Write([]byte("original"))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/no-sie", nil))
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/no-sie", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestRevalidateExpiredResponseWithBackend(t *testing.T) {
+	var fetches, fullResponses int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetch := atomic.AddInt32(&fetches, 1)
+		rw.Header().Set("Cache-Control", "max-age=10")
+		rw.Header().Set("ETag", `"v1"`)
+		if fetch == 1 {
+			rw.Header().Set("Date", time.Now().Add(-20*time.Second).UTC().Format(http.TimeFormat))
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fullResponses, 1)
+		rw.Write([]byte("body"))
+	}))
+	handler := reverseProxy.GetHandler()
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/etag", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/etag", nil)
+	req.Header.Set("If-None-Match", `"v0"`)
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "body", recorder.Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fullResponses))
+
+	// The refreshed response is fresh again
+	recorder = serve(handler, httptest.NewRequest(http.MethodGet, "/etag", nil))
+	assert.Equal(t, "body", recorder.Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestAnswerConditionalRequestFromCache(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write([]byte("body"))
+	}))
+	handler := reverseProxy.GetHandler()
+	serve(handler, httptest.NewRequest(http.MethodGet, "/conditional", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/conditional", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, `"v1"`, recorder.Header().Get("ETag"))
+
+	req = httptest.NewRequest(http.MethodGet, "/conditional", nil)
+	req.Header.Set("If-None-Match", `"v0"`)
+	recorder = serve(handler, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "body", recorder.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/conditional", nil)
+	req.Header.Set("If-Match", `"v0"`)
+	recorder = serve(handler, req)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+}
+
+func TestCacheStatusHeaders(t *testing.T) {
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/private" {
+			rw.Header().Set("Cache-Control", "private")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+		}
+		rw.Write([]byte("body"))
+	}))
+	cfg.Cache.DebugHeader = true
+	handler := reverseProxy.GetHandler()
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, "caeche; fwd=uri-miss; fwd-status=200; stored", recorder.Header().Get("Cache-Status"))
+	assert.Equal(t, "MISS", recorder.Header().Get("X-Cache"))
+
+	recorder = serve(handler, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Regexp(t, `^caeche; hit; ttl=(59|60)$`, recorder.Header().Get("Cache-Status"))
+	assert.Equal(t, "HIT", recorder.Header().Get("X-Cache"))
+	assert.Equal(t, "0", recorder.Header().Get("Age"))
+
+	recorder = serve(handler, httptest.NewRequest(http.MethodGet, "/private", nil))
+	assert.Equal(t, "caeche; fwd=uri-miss; fwd-status=200; detail=private", recorder.Header().Get("Cache-Status"))
+
+	recorder = serve(handler, httptest.NewRequest(http.MethodPost, "/status", nil))
+	assert.Equal(t, "caeche; fwd=method; fwd-status=200", recorder.Header().Get("Cache-Status"))
+	assert.Equal(t, "BYPASS", recorder.Header().Get("X-Cache"))
+}
+
+func TestNoDebugHeaderByDefault(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("body"))
+	}))
+	recorder := serve(reverseProxy.GetHandler(), httptest.NewRequest(http.MethodGet, "/default", nil))
+	assert.NotEmpty(t, recorder.Header().Get("Cache-Status"))
+	assert.Empty(t, recorder.Header().Get("X-Cache"))
+}
+
+func TestRoutesAreCachedApart(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte("default"))
+	}))
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte("api"))
+	}))
+	t.Cleanup(api.Close)
+	apiURL, _ := url.Parse(api.URL)
+	cfg.Backends = map[string]config.BackendConfig{"api": {Host: apiURL.Host, Scheme: apiURL.Scheme}}
+	cfg.Routes = []config.RouteConfig{
+		{Name: "api", Host: "api.domain.com", Backend: "api"},
+		{Name: "live", PathPrefix: "/live", Bypass: true},
+	}
+	reverseProxy.router, _ = newRouter(*cfg)
+	handler := reverseProxy.RoutingMiddleware(cache.NewPurgeMiddleware(reverseProxy.cache)(reverseProxy.GetHandler()))
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "default", serve(handler, httptest.NewRequest(http.MethodGet, "http://www.domain.com/resource", nil)).Body.String())
+		assert.Equal(t, "api", serve(handler, httptest.NewRequest(http.MethodGet, "http://api.domain.com/resource", nil)).Body.String())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	serve(handler, httptest.NewRequest("PURGE", "http://api.domain.com/resource", nil))
+	assert.Equal(t, "api", serve(handler, httptest.NewRequest(http.MethodGet, "http://api.domain.com/resource", nil)).Body.String())
+	assert.Equal(t, "default", serve(handler, httptest.NewRequest(http.MethodGet, "http://www.domain.com/resource", nil)).Body.String())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches), "Only the response of the api route should be purged")
+
+	for i := 0; i < 2; i++ {
+		recorder := serve(handler, httptest.NewRequest(http.MethodGet, "http://www.domain.com/live", nil))
+		assert.Equal(t, "caeche; fwd=bypass; fwd-status=200", recorder.Header().Get("Cache-Status"))
+	}
+	assert.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+}
+
+func TestHostsAreCachedApart(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(fmt.Sprintf("body %d", atomic.AddInt32(&fetches, 1))))
+	}))
+	handler := reverseProxy.RoutingMiddleware(cache.NewPurgeMiddleware(reverseProxy.cache)(reverseProxy.GetHandler()))
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "body 1", serve(handler, httptest.NewRequest(http.MethodGet, "http://a.example/x", nil)).Body.String())
+		assert.Equal(t, "body 2", serve(handler, httptest.NewRequest(http.MethodGet, "http://B.example/x", nil)).Body.String())
+	}
+	assert.Equal(t, "body 2", serve(handler, httptest.NewRequest(http.MethodGet, "http://b.example/x", nil)).Body.String())
+
+	serve(handler, httptest.NewRequest("PURGE", "http://a.example/x", nil))
+	assert.Equal(t, "body 3", serve(handler, httptest.NewRequest(http.MethodGet, "http://a.example/x", nil)).Body.String())
+	assert.Equal(t, "body 2", serve(handler, httptest.NewRequest(http.MethodGet, "http://b.example/x", nil)).Body.String())
+}
+
+func TestFetchRoutesAroundDeadReplicas(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Header().Set("Cache-Control", "max-age=10, stale-if-error=60")
+		rw.Header().Set("Date", time.Now().Add(-20*time.Second).UTC().Format(http.TimeFormat))
+		rw.Write([]byte("body"))
+	}))
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	deadURL, _ := url.Parse(dead.URL)
+	cfg.Backend.Hosts = []string{deadURL.Host, cfg.Backend.Host}
+	cfg.Backend.Host = ""
+	cfg.Backend.MaxFails = 1
+	reverseProxy.router, _ = newRouter(*cfg)
+	handler := reverseProxy.GetHandler()
+
+	for i := 0; i < 3; i++ {
+		recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/replicas", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Warning"))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+
+	// Stale cache is only served when every replica is down
+	for _, replica := range reverseProxy.router.defaultRoute.pool.replicas {
+		replica.unhealthy = 1
+	}
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/replicas", nil))
+	assert.Equal(t, "body", recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Warning"), "110")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+}
+
+func TestCachePolicyRules(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		switch req.URL.Path {
+		case "/private/page":
+			rw.Header().Set("Cache-Control", "private")
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		rw.Write([]byte("body"))
+	}))
+	cfg.Cache.Rules = []config.RuleConfig{
+		{PathGlob: "/private/*", ForceCache: true},
+		{PathGlob: "/live/**", Bypass: true},
+		{CacheableStatuses: []int{200}},
+	}
+	reverseProxy.router, _ = newRouter(*cfg)
+	handler := reverseProxy.GetHandler()
+
+	testCases := []struct {
+		path            string
+		expectedFetches int32
+		expectedStatus  string
+	}{
+		{path: "/private/page", expectedFetches: 1, expectedStatus: "caeche; hit; ttl=3600"},
+		{path: "/live/feed", expectedFetches: 2, expectedStatus: "caeche; fwd=bypass; fwd-status=200"},
+		{path: "/missing", expectedFetches: 2, expectedStatus: "caeche; fwd=uri-miss; fwd-status=404; detail=status"},
+	}
+	for _, test := range testCases {
+		atomic.StoreInt32(&fetches, 0)
+		var recorder *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			recorder = serve(handler, httptest.NewRequest(http.MethodGet, test.path, nil))
+		}
+		assert.Equal(t, test.expectedFetches, atomic.LoadInt32(&fetches), test.path)
+		assert.Regexp(t, "^"+strings.Replace(test.expectedStatus, "3600", "(3599|3600)", 1)+"$", recorder.Header().Get("Cache-Status"), test.path)
+	}
+}
+
+func TestTagsArePurgedAndHiddenFromClients(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Surrogate-Key", "product-42")
+		rw.Write([]byte("body"))
+	}))
+	handler := cache.NewPurgeMiddleware(reverseProxy.cache)(reverseProxy.GetHandler())
+
+	for i := 0; i < 2; i++ {
+		recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/products/42", nil))
+		assert.Empty(t, recorder.Header().Get("Surrogate-Key"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	req := httptest.NewRequest("PURGE", "/", nil)
+	req.Header.Set("Surrogate-Key", "product-42")
+	assert.Equal(t, http.StatusNoContent, serve(handler, req).Code)
+	serve(handler, httptest.NewRequest(http.MethodGet, "/products/42", nil))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestSoftPurgedResponsesAreServedOnError(t *testing.T) {
+	var failing int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		rw.Write([]byte("body"))
+	}))
+	handler := reverseProxy.RoutingMiddleware(cache.NewPurgeMiddleware(reverseProxy.cache)(reverseProxy.GetHandler()))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/deployed", nil))
+
+	req := httptest.NewRequest("PURGE", "/deployed", nil)
+	req.Header.Set("Soft-Purge", "1")
+	serve(handler, req)
+	atomic.StoreInt32(&failing, 1)
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/deployed", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "body", recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "fwd=stale; fwd-status=500")
+}
+
+func TestBodiesAboveMaxObjectSizeAreStreamedButNotCached(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	cfg.Cache.MaxObjectSize = 512
+	handler := reverseProxy.GetHandler()
+
+	for i := 0; i < 2; i++ {
+		recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/large", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, 1024, recorder.Body.Len())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	cfg.Cache.MaxObjectSize = 2048
+	serve(handler, httptest.NewRequest(http.MethodGet, "/large", nil))
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/large", nil))
+	assert.Equal(t, strings.Repeat("a", 1024), recorder.Body.String())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+}
+
+func TestRangeRequestsAreServedFromCachedResponse(t *testing.T) {
+	var fetches int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte("0123456789"))
+	}))
+	handler := reverseProxy.GetHandler()
+	serve(handler, httptest.NewRequest(http.MethodGet, "/file", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "bytes 3-5/10", recorder.Header().Get("Content-Range"))
+	assert.Equal(t, "345", recorder.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestPartialResponsesAreNotCachedAsWhole(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "file", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	handler := reverseProxy.GetHandler()
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	assert.Equal(t, "01", serve(handler, req).Body.String())
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/file", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "0123456789", recorder.Body.String())
+}
+
+func TestRangeRequestsAreServedFromSlices(t *testing.T) {
+	var ranges []string
+	var mutex sync.Mutex
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mutex.Unlock()
+		rw.Header().Set("ETag", `"v1"`)
+		http.ServeContent(rw, req, "file", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	cfg.Cache.SliceSize = 4
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "bytes 3-5/10", recorder.Header().Get("Content-Range"))
+	assert.Equal(t, "345", recorder.Body.String())
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7"}, ranges)
+	assert.Empty(t, recorder.Header().Get("Vary"))
+
+	req.Header.Set("Range", "bytes=4-")
+	recorder = serve(handler, req)
+	assert.Equal(t, "456789", recorder.Body.String())
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7", "bytes=8-11"}, ranges)
+
+	req.Header.Set("Range", "bytes=-2")
+	recorder = serve(handler, req)
+	assert.Equal(t, "89", recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "hit")
+
+	req.Header.Set("Range", "bytes=0-1")
+	req.Header.Set("If-Range", `"v0"`)
+	recorder = serve(handler, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "10", recorder.Header().Get("Content-Length"))
+	assert.Equal(t, "0123456789", recorder.Body.String())
+	assert.Len(t, ranges, 3, "Every slice comes from cache")
+
+	assert.Equal(t, http.StatusOK, serve(handler, httptest.NewRequest(http.MethodGet, "/file", nil)).Code)
+	assert.Equal(t, "", ranges[3], "Whole responses are fetched whole")
+}
+
+func TestRangesIgnoredByTheBackendAreNotSliced(t *testing.T) {
+	var ranges []string
+	var mutex sync.Mutex
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mutex.Unlock()
+		if req.URL.Path == "/private" {
+			rw.Header().Set("Cache-Control", "no-store")
+		}
+		rw.Write([]byte("0123456789"))
+	}))
+	cfg.Cache.SliceSize = 4
+	handler := reverseProxy.GetHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	recorder := serve(handler, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "0123456789", recorder.Body.String())
+	assert.Equal(t, "caeche; fwd=uri-miss; fwd-status=200; stored", recorder.Header().Get("Cache-Status"))
+	assert.Equal(t, []string{"bytes=0-3"}, ranges, "The whole response to the slice request should be served")
+	recorder = serve(handler, req)
+	assert.Equal(t, "345", recorder.Body.String())
+	assert.Len(t, ranges, 1, "The whole response should be cached")
+
+	ranges = nil
+	req = httptest.NewRequest(http.MethodGet, "/private", nil)
+	req.Header.Set("Range", "bytes=3-5")
+	serve(handler, req)
+	serve(handler, req)
+	assert.Equal(t, []string{"bytes=0-3", "bytes=3-5"}, ranges, "The resource should be remembered as not sliced")
+}
+
+func TestSlicesNotStoredReportTheirReason(t *testing.T) {
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "no-store")
+		http.ServeContent(rw, req, "file", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	cfg.Cache.SliceSize = 4
+	req := httptest.NewRequest(http.MethodGet, "/file", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	recorder := serve(reverseProxy.GetHandler(), req)
+	assert.Equal(t, "01", recorder.Body.String())
+	assert.Equal(t, "caeche; fwd=uri-miss; fwd-status=206; detail=no-store", recorder.Header().Get("Cache-Status"))
+}
+
+func TestReloadKeepsCacheAndAppliesRoutes(t *testing.T) {
+	var fetches int32
+	reverseProxy, cfg := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		rw.Write([]byte("body"))
+	}))
+	serve(reverseProxy.GetHandler(), httptest.NewRequest(http.MethodGet, "/cached", nil))
+
+	reloadedCfg := *cfg
+	reloadedCfg.Routes = []config.RouteConfig{{Name: "private", PathPrefix: "/private/", Bypass: true}}
+	reloaded, err := reverseProxy.Reload(reloadedCfg)
+	assert.NoError(t, err)
+	handler := reloaded.GetHandler()
+
+	recorder := serve(handler, httptest.NewRequest(http.MethodGet, "/cached", nil))
+	assert.Equal(t, "body", recorder.Body.String())
+	serve(handler, httptest.NewRequest(http.MethodGet, "/private/page", nil))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/private/page", nil))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	assert.Equal(t, reverseProxy.statuses, reloaded.statuses)
+
+	reloadedCfg.Routes = []config.RouteConfig{{Name: "broken", Backend: "unknown"}}
+	_, err = reverseProxy.Reload(reloadedCfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// route forwards the matching requests to a backend, with its own cache rules.
+type route struct {
+	name       string
+	host       string
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	pool       *pool
+	defaultTTL int
+	bypass     bool
+	// rules are the cache policy rules of the route, followed by the global ones
+	rules []rule
+}
+
+// router matches the requests against the routes of the config, in order,
+// falling back to the default backend.
+type router struct {
+	routes       []route
+	defaultRoute route
+	// pools are the pools of the backends, shared by their routes
+	pools []*pool
+}
+
+// defaultBackendName names the default backend, e.g. in the admin API.
+const defaultBackendName = "default"
+
+type routeContextKey struct{}
+
+func newRouter(cfg config.Config) (*router, error) {
+	defaultPool, err := newPool(defaultBackendName, cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("default backend: %w", err)
+	}
+	globalRules, err := newRules(cfg.Cache.Rules)
+	if err != nil {
+		return nil, err
+	}
+	router := &router{
+		// The global default TTL is set on the routes rather than on the
+		// cache, so that it's reloaded along with them
+		defaultRoute: route{pool: defaultPool, defaultTTL: cfg.DefaultTTL, rules: globalRules},
+		pools:        []*pool{defaultPool},
+	}
+	pools := map[string]*pool{}
+	for name, backend := range cfg.Backends {
+		pool, err := newPool(name, backend)
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", name, err)
+		}
+		pools[name] = pool
+		router.pools = append(router.pools, pool)
+	}
+	names := map[string]bool{}
+	for _, routeConfig := range cfg.Routes {
+		if routeConfig.Name == "" {
+			return nil, fmt.Errorf("route without name")
+		}
+		if names[routeConfig.Name] {
+			return nil, fmt.Errorf("duplicate route %q", routeConfig.Name)
+		}
+		names[routeConfig.Name] = true
+
+		route := route{
+			name:       routeConfig.Name,
+			host:       strings.ToLower(routeConfig.Host),
+			pathPrefix: routeConfig.PathPrefix,
+			pool:       defaultPool,
+			defaultTTL: routeConfig.DefaultTTL,
+			bypass:     routeConfig.Bypass,
+		}
+		if route.defaultTTL == 0 {
+			route.defaultTTL = cfg.DefaultTTL
+		}
+		if routeConfig.PathRegex != "" {
+			pathRegex, err := regexp.Compile(routeConfig.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", routeConfig.Name, err)
+			}
+			route.pathRegex = pathRegex
+		}
+		routeRules, err := newRules(routeConfig.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", routeConfig.Name, err)
+		}
+		route.rules = append(routeRules, globalRules...)
+		if routeConfig.Backend != "" {
+			pool, ok := pools[routeConfig.Backend]
+			if !ok {
+				return nil, fmt.Errorf("route %q: unknown backend %q", routeConfig.Name, routeConfig.Backend)
+			}
+			route.pool = pool
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router, nil
+}
+
+// match returns the first route matching the request, or the default one.
+func (router *router) match(req *http.Request) route {
+	for _, route := range router.routes {
+		if route.matches(req) {
+			return route
+		}
+	}
+	return router.defaultRoute
+}
+
+// label names the route in the metrics, the default one after its backend.
+func (route route) label() string {
+	if route.name == "" {
+		return defaultBackendName
+	}
+	return route.name
+}
+
+func (route route) matches(req *http.Request) bool {
+	if route.host != "" && !matchesHost(route.host, req.Host) {
+		return false
+	}
+	if route.pathPrefix != "" && !strings.HasPrefix(req.URL.Path, route.pathPrefix) {
+		return false
+	}
+	if route.pathRegex != nil && !route.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// matchesHost tells if the Host header, without its port, is the host of the
+// route or one of its subdomains when the latter starts with "*.".
+func matchesHost(pattern string, host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// withRoute returns a shallow copy of the request bound to the route, its
+// responses being cached in the namespace of the route.
+func withRoute(req *http.Request, route route) *http.Request {
+	req = req.WithContext(context.WithValue(req.Context(), routeContextKey{}, route))
+	return cachePackage.WithNamespace(req, route.name)
+}
+
+func routeOf(req *http.Request) (route, bool) {
+	route, ok := req.Context().Value(routeContextKey{}).(route)
+	return route, ok
+}
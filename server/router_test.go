@@ -0,0 +1,72 @@
+package server
+
+import (
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	cfg := config.NewConfigWithDefault()
+	cfg.Backends = map[string]config.BackendConfig{
+		"api":    {Host: "api:80", Scheme: "http"},
+		"static": {Host: "static:80", Scheme: "http"},
+	}
+	cfg.Routes = []config.RouteConfig{
+		{Name: "v2", Host: "api.domain.com", PathRegex: `^/v2/`, Backend: "api", DefaultTTL: 10},
+		{Name: "api", Host: "api.domain.com", Backend: "api"},
+		{Name: "static", Host: "*.cdn.domain.com", PathPrefix: "/assets/", Backend: "static"},
+	}
+	router, err := newRouter(cfg)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		desc     string
+		url      string
+		expected string
+	}{
+		{desc: "Host and path regex", url: "http://api.domain.com/v2/users", expected: "v2"},
+		{desc: "First matching route", url: "http://API.domain.com:8080/v1/users", expected: "api"},
+		{desc: "Subdomain and path prefix", url: "http://eu.cdn.domain.com/assets/logo.png", expected: "static"},
+		{desc: "Path prefix not matching", url: "http://eu.cdn.domain.com/index.html", expected: ""},
+		{desc: "Parent domain not matching", url: "http://cdn.domain.com/assets/logo.png", expected: ""},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			route := router.match(httptest.NewRequest(http.MethodGet, test.url, nil))
+			assert.Equal(t, test.expected, route.name)
+		})
+	}
+
+	route := router.match(httptest.NewRequest(http.MethodGet, "http://api.domain.com/v2/users", nil))
+	assert.Equal(t, "api:80", route.pool.host)
+	assert.Equal(t, 10, route.defaultTTL)
+	assert.Equal(t, config.DEFAULT_BACKEND_HOST, router.match(httptest.NewRequest(http.MethodGet, "http://other.com/", nil)).pool.host)
+}
+
+func TestRouterRejectsInvalidRoutes(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		backends map[string]config.BackendConfig
+		routes   []config.RouteConfig
+	}{
+		{desc: "Route without name", routes: []config.RouteConfig{{PathPrefix: "/"}}},
+		{desc: "Duplicate route", routes: []config.RouteConfig{{Name: "a"}, {Name: "a"}}},
+		{desc: "Unknown backend", routes: []config.RouteConfig{{Name: "a", Backend: "unknown"}}},
+		{desc: "Invalid regex", routes: []config.RouteConfig{{Name: "a", PathRegex: "("}}},
+		{desc: "Unknown balancing", backends: map[string]config.BackendConfig{"a": {Host: "a:80", Balancing: "random"}}},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			cfg := config.NewConfigWithDefault()
+			cfg.Backends = test.backends
+			cfg.Routes = test.routes
+			_, err := newRouter(cfg)
+			assert.Error(t, err)
+		})
+	}
+}
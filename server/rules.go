@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// rule overrides the cache policy of the matching requests and responses.
+type rule struct {
+	paths        []*regexp.Regexp
+	methods      []string
+	statuses     []int
+	contentTypes []string
+	bypass       bool
+	policy       cachePackage.StoragePolicy
+}
+
+func newRules(ruleConfigs []config.RuleConfig) ([]rule, error) {
+	rules := make([]rule, 0, len(ruleConfigs))
+	for i, ruleConfig := range ruleConfigs {
+		rule := rule{
+			statuses:     ruleConfig.Statuses,
+			contentTypes: ruleConfig.ContentTypes,
+			bypass:       ruleConfig.Bypass,
+			policy: cachePackage.StoragePolicy{
+				TTL:                ruleConfig.TTL,
+				CacheableStatuses:  ruleConfig.CacheableStatuses,
+				IgnoreCacheControl: ruleConfig.IgnoreCacheControl,
+				ForceCache:         ruleConfig.ForceCache,
+			},
+		}
+		for _, method := range ruleConfig.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(method))
+		}
+		if ruleConfig.PathGlob != "" {
+			rule.paths = append(rule.paths, globToRegexp(ruleConfig.PathGlob))
+		}
+		if ruleConfig.PathRegex != "" {
+			pathRegex, err := regexp.Compile(ruleConfig.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			rule.paths = append(rule.paths, pathRegex)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchesRequest tells if the request matches the path and method criteria of
+// the rule.
+func (rule rule) matchesRequest(req *http.Request) bool {
+	for _, path := range rule.paths {
+		if !path.MatchString(req.URL.Path) {
+			return false
+		}
+	}
+	if len(rule.methods) > 0 && !containsString(rule.methods, req.Method) {
+		return false
+	}
+	return true
+}
+
+// matchesResponse tells if the response, and its request, match all the
+// criteria of the rule.
+func (rule rule) matchesResponse(res *http.Response) bool {
+	if !rule.matchesRequest(res.Request) {
+		return false
+	}
+	if len(rule.statuses) > 0 && !containsInt(rule.statuses, res.StatusCode) {
+		return false
+	}
+	if len(rule.contentTypes) > 0 && !matchesContentType(rule.contentTypes, res.Header.Get("Content-Type")) {
+		return false
+	}
+	return true
+}
+
+// hasResponseCriteria tells if the rule can only be matched once the response
+// is known.
+func (rule rule) hasResponseCriteria() bool {
+	return len(rule.statuses) > 0 || len(rule.contentTypes) > 0
+}
+
+// requestRule returns the first rule matching the request, among the ones
+// which don't depend on its response.
+func requestRule(rules []rule, req *http.Request) (rule, bool) {
+	for _, rule := range rules {
+		if !rule.hasResponseCriteria() && rule.matchesRequest(req) {
+			return rule, true
+		}
+	}
+	return rule{}, false
+}
+
+// responseRule returns the first rule matching the response.
+func responseRule(rules []rule, res *http.Response) (rule, bool) {
+	for _, rule := range rules {
+		if rule.matchesResponse(res) {
+			return rule, true
+		}
+	}
+	return rule{}, false
+}
+
+// globToRegexp converts a path glob, where "*" matches any characters but "/"
+// and "**" any characters, into an anchored regex.
+func globToRegexp(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			pattern.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+// matchesContentType tells if the media type of the Content-Type header is
+// one of the patterns, "type/*" matching every subtype.
+func matchesContentType(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
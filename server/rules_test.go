@@ -0,0 +1,54 @@
+package server
+
+import (
+	"github.com/sdelicata/caeche/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	testCases := []struct {
+		glob     string
+		path     string
+		expected bool
+	}{
+		{glob: "/static/*.css", path: "/static/main.css", expected: true},
+		{glob: "/static/*.css", path: "/static/css/main.css", expected: false},
+		{glob: "/static/**", path: "/static/css/main.css", expected: true},
+		{glob: "/img/?.png", path: "/img/a.png", expected: true},
+		{glob: "/a.b", path: "/axb", expected: false},
+	}
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, globToRegexp(test.glob).MatchString(test.path), "%s on %s", test.glob, test.path)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := newRules([]config.RuleConfig{
+		{PathGlob: "/api/**", Methods: []string{"get"}, Statuses: []int{404}, TTL: 5},
+		{PathGlob: "/api/**", ContentTypes: []string{"image/*"}, ForceCache: true},
+		{PathRegex: "^/api/", Bypass: true},
+	})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	matched, ok := requestRule(rules, req)
+	assert.True(t, ok)
+	assert.True(t, matched.bypass, "Rules on the response shouldn't match the request")
+
+	res := &http.Response{Request: req, StatusCode: http.StatusNotFound, Header: http.Header{}}
+	matched, _ = responseRule(rules, res)
+	assert.Equal(t, 5, matched.policy.TTL)
+
+	res = &http.Response{Request: req, StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"image/png; q=1"}}}
+	matched, _ = responseRule(rules, res)
+	assert.True(t, matched.policy.ForceCache)
+
+	_, ok = requestRule(rules, httptest.NewRequest(http.MethodGet, "/other", nil))
+	assert.False(t, ok)
+
+	_, err = newRules([]config.RuleConfig{{PathRegex: "("}})
+	assert.Error(t, err)
+}
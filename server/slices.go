@@ -0,0 +1,250 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUnslicedResources bounds the number of resources remembered as not
+// sliced by their backend, the oldest being forgotten all at once past it.
+const maxUnslicedResources = 10000
+
+// errNotSliced is returned when the backend doesn't answer a slice request
+// with the slice, e.g. when it doesn't support range requests.
+var errNotSliced = errors.New("no slice in response")
+
+// unslicedResources remembers the resources whose backend ignored the range
+// of a slice request, so that their range requests are forwarded as is.
+type unslicedResources struct {
+	mutex     sync.Mutex
+	resources map[string]bool
+}
+
+func newUnslicedResources() *unslicedResources {
+	return &unslicedResources{resources: make(map[string]bool)}
+}
+
+func (unsliced *unslicedResources) add(key string) {
+	unsliced.mutex.Lock()
+	defer unsliced.mutex.Unlock()
+	if !unsliced.resources[key] && len(unsliced.resources) >= maxUnslicedResources {
+		unsliced.resources = make(map[string]bool)
+	}
+	unsliced.resources[key] = true
+}
+
+func (unsliced *unslicedResources) has(key string) bool {
+	unsliced.mutex.Lock()
+	defer unsliced.mutex.Unlock()
+	return unsliced.resources[key]
+}
+
+// slice is a part of a resource, cached apart from the other ones.
+type slice struct {
+	index     int64
+	response  cachePackage.Response
+	byteRange cachePackage.ByteRange
+	// size is the size of the whole resource
+	size   int64
+	cached bool
+	// notStoredReason tells why the slice fetched wasn't stored in cache, if it wasn't
+	notStoredReason string
+	// whole is the response of the backend ignoring the range, whose body is
+	// to be closed by the caller
+	whole *http.Response
+}
+
+// serveSlices serves the range request from the slices of the resource,
+// fetching the missing ones, and tells if it did. It doesn't when the backend
+// doesn't answer with a slice, the request being forwarded as is then, or
+// served with the whole response returned if the backend ignored the range.
+func (reverseProxy *ReverseProxy) serveSlices(rw http.ResponseWriter, req *http.Request, start time.Time) (bool, *http.Response) {
+	first, err := reverseProxy.getSlice(req, firstSliceIndex(req, reverseProxy.config.Cache.SliceSize))
+	if errors.Is(err, errNotSliced) {
+		log.Debugf("Not slicing %s : %s", req.URL, err)
+		if first.whole != nil {
+			reverseProxy.unsliced.add(coalescingKey(req))
+			// Served as the response of the request, not of the slice request
+			first.whole.Request = req
+		}
+		return false, first.whole
+	}
+	if err != nil {
+		log.Error(err)
+		status := missStatus("uri-miss", 0, false, "backend-unreachable")
+		reverseProxy.setCacheStatusHeaders(rw, status)
+		rw.WriteHeader(http.StatusBadGateway)
+		reverseProxy.logRequest(rw, req, start, http.StatusBadGateway, status)
+		return true, nil
+	}
+
+	// The cache status is the one of the first slice
+	status := missStatus("uri-miss", http.StatusPartialContent, first.notStoredReason == "", first.notStoredReason)
+	if first.cached {
+		status = hitStatus(first.response.Expires)
+	}
+	reverseProxy.setCacheStatusHeaders(rw, status)
+	_, span := reverseProxy.tracer.Start(req.Context(), "WriteResponse")
+	defer span.End()
+	cachePackage.CopySliceHeaders(rw, first.response)
+
+	var ranges []cachePackage.ByteRange
+	if cachePackage.RangeApplies(req, first.response.ResponseHeaders) {
+		ranges, err = cachePackage.Ranges(req, first.size)
+	}
+	var statusCode int
+	switch {
+	case errors.Is(err, cachePackage.ErrRangeNotSatisfiable):
+		statusCode = cachePackage.WriteRangeNotSatisfiable(rw, first.size)
+	case ranges == nil:
+		rw.Header().Set("Content-Length", strconv.FormatInt(first.size, 10))
+		rw.WriteHeader(http.StatusOK)
+		if err := reverseProxy.copySlices(rw, req, first, cachePackage.ByteRange{Length: first.size}); err != nil {
+			log.Errorf("Writing %s : %s", req.URL, err)
+		}
+		statusCode = http.StatusOK
+	default:
+		statusCode = cachePackage.WritePartialContent(rw, ranges, first.size, func(writer io.Writer, byteRange cachePackage.ByteRange) error {
+			return reverseProxy.copySlices(writer, req, first, byteRange)
+		})
+	}
+	reverseProxy.logRequest(rw, req, start, statusCode, status)
+	return true, nil
+}
+
+// copySlices copies the range of the resource out of its slices, which must
+// belong to the same version of the resource as the first one.
+func (reverseProxy *ReverseProxy) copySlices(writer io.Writer, req *http.Request, first slice, byteRange cachePackage.ByteRange) error {
+	sliceSize := reverseProxy.config.Cache.SliceSize
+	for offset := byteRange.Start; offset <= byteRange.End(); {
+		current := first
+		if index := offset / sliceSize; index != first.index {
+			var err error
+			if current, err = reverseProxy.getSlice(req, index); err != nil {
+				if current.whole != nil {
+					current.whole.Body.Close()
+				}
+				return err
+			}
+			if current.size != first.size || current.response.ResponseHeaders.Get("ETag") != first.response.ResponseHeaders.Get("ETag") {
+				return fmt.Errorf("slice %d of %s belongs to another version of the resource", index, req.URL)
+			}
+		}
+		end := byteRange.End()
+		if current.byteRange.End() < end {
+			end = current.byteRange.End()
+		}
+		if offset < current.byteRange.Start || end < offset {
+			return fmt.Errorf("slice %d of %s doesn't hold byte %d", current.index, req.URL, offset)
+		}
+		if err := copySlice(writer, current, offset, end-offset+1); err != nil {
+			return err
+		}
+		offset = end + 1
+	}
+	return nil
+}
+
+func copySlice(writer io.Writer, slice slice, offset int64, length int64) error {
+	body, err := slice.response.OpenBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := body.Seek(offset-slice.byteRange.Start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(writer, body, length)
+	return err
+}
+
+// getSlice returns the slice at index of the resource, from cache or fetched
+// from the backend and cached. When the backend answers with the whole
+// resource, the latter is returned in the slice along with errNotSliced.
+func (reverseProxy *ReverseProxy) getSlice(req *http.Request, index int64) (slice, error) {
+	sliceReq := cachePackage.SliceRequest(req, index, reverseProxy.config.Cache.SliceSize)
+	if cached, ok := reverseProxy.getCachedSlice(sliceReq, index); ok {
+		return cached, nil
+	}
+	leader, call, done, fetched := reverseProxy.joinFetch(sliceReq)
+	if leader {
+		defer done()
+	} else if fetched {
+		if cached, ok := reverseProxy.getCachedSlice(sliceReq, index); ok {
+			return cached, nil
+		}
+	}
+
+	requestTime := time.Now().UTC()
+	res, err := reverseProxy.fetch(sliceReq)
+	if err != nil {
+		return slice{}, err
+	}
+	if res.StatusCode == http.StatusOK {
+		return slice{whole: res}, fmt.Errorf("%w: range ignored", errNotSliced)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return slice{}, fmt.Errorf("%w: status %d", errNotSliced, res.StatusCode)
+	}
+	byteRange, size, err := cachePackage.ParseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return slice{}, fmt.Errorf("%w: %s", errNotSliced, err)
+	}
+	if byteRange.Start != index*reverseProxy.config.Cache.SliceSize {
+		return slice{}, fmt.Errorf("%w: range %d-%d", errNotSliced, byteRange.Start, byteRange.End())
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, byteRange.Length))
+	if err != nil {
+		return slice{}, err
+	}
+	if int64(len(body)) != byteRange.Length {
+		return slice{}, fmt.Errorf("slice %d of %s truncated", index, req.URL)
+	}
+
+	cachePackage.VaryOnSlice(res.Header)
+	if leader {
+		variant, _ := cachePackage.Variant(sliceReq, res.Header)
+		call.announce(res.Header.Clone(), variant)
+	}
+	response := newCachedResponse(res, requestTime, time.Now().UTC())
+	response.Body = body
+	reason := notStoredReason(res)
+	if reason == "" {
+		reverseProxy.cache.Save(response)
+	}
+	return slice{index: index, response: response, byteRange: byteRange, size: size, notStoredReason: reason}, nil
+}
+
+func (reverseProxy *ReverseProxy) getCachedSlice(sliceReq *http.Request, index int64) (slice, bool) {
+	response, ok := reverseProxy.getCached(sliceReq)
+	if !ok || response.StatusCode != http.StatusPartialContent || !cachePackage.IsValidForRequest(response, sliceReq) {
+		return slice{}, false
+	}
+	byteRange, size, err := cachePackage.ParseContentRange(response.ResponseHeaders.Get("Content-Range"))
+	if err != nil {
+		return slice{}, false
+	}
+	return slice{index: index, response: response, byteRange: byteRange, size: size, cached: true}, true
+}
+
+// firstSliceIndex returns the index of the slice holding the first byte
+// requested, or of the first slice when it depends on the size of the
+// resource.
+func firstSliceIndex(req *http.Request, sliceSize int64) int64 {
+	spec := strings.TrimPrefix(strings.TrimSpace(req.Header.Get("Range")), "bytes=")
+	first := strings.SplitN(strings.SplitN(spec, ",", 2)[0], "-", 2)[0]
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil || start < 0 {
+		return 0
+	}
+	return start / sliceSize
+}
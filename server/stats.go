@@ -0,0 +1,32 @@
+package server
+
+import (
+	"sync"
+)
+
+// statusCounter counts the requests handled by the proxy by cache status.
+type statusCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func newStatusCounter() *statusCounter {
+	return &statusCounter{counts: make(map[string]int64)}
+}
+
+func (counter *statusCounter) add(flag string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.counts[flag]++
+}
+
+// snapshot returns a copy of the counts.
+func (counter *statusCounter) snapshot() map[string]int64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counts := make(map[string]int64, len(counter.counts))
+	for flag, count := range counter.counts {
+		counts[flag] = count
+	}
+	return counts
+}
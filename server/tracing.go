@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	cachePackage "github.com/sdelicata/caeche/cache"
+	"github.com/sdelicata/caeche/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const tracerName = "github.com/sdelicata/caeche/server"
+
+// Span attributes of the cache, next to the semantic conventions of HTTP.
+const (
+	cacheStatusKey = attribute.Key("caeche.cache_status")
+	cacheHitKey    = attribute.Key("caeche.cache_hit")
+	routeKey       = attribute.Key("caeche.route")
+	backendKey     = attribute.Key("caeche.backend")
+	requestIDKey   = attribute.Key("caeche.request_id")
+)
+
+// NewTracerProvider returns the provider of the tracers exporting the spans as
+// set in the config, or nil without exporter.
+func NewTracerProvider(cfg config.TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName))),
+	), nil
+}
+
+// startRequestSpan starts the span of a request handled by the proxy, in the
+// trace of the client if any.
+func (reverseProxy *ReverseProxy) startRequestSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx := reverseProxy.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := reverseProxy.tracer.Start(ctx, "ReverseProxy.ServeHTTP",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(req.Method),
+			semconv.HTTPTargetKey.String(req.URL.RequestURI()),
+			semconv.HTTPHostKey.String(req.Host),
+			requestIDKey.String(req.Header.Get(requestIDHeader)),
+		),
+	)
+	return req.WithContext(ctx), span
+}
+
+// getCached looks the response to the request up in the cache, in a span of
+// its own.
+func (reverseProxy *ReverseProxy) getCached(req *http.Request) (response cachePackage.Response, ok bool) {
+	_, span := reverseProxy.tracer.Start(req.Context(), "cache.Get")
+	defer span.End()
+	response, ok = reverseProxy.cache.Get(req)
+	span.SetAttributes(cacheHitKey.Bool(ok))
+	return response, ok
+}
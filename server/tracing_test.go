@@ -0,0 +1,50 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	var traceparent string
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		rw.Write([]byte("body"))
+	}))
+	recorder := tracetest.NewSpanRecorder()
+	reverseProxy.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+
+	req := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serve(reverseProxy.GetHandler(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	assert.Len(t, spans, 4)
+	root := spans["ReverseProxy.ServeHTTP"]
+	if !assert.NotNil(t, root) {
+		return
+	}
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent().SpanID().String())
+	assert.Equal(t, trace.SpanKindServer, root.SpanKind())
+	assert.Contains(t, root.Attributes(), cacheStatusKey.String("MISS"))
+	assert.Contains(t, root.Attributes(), attribute.Int("http.status_code", http.StatusOK))
+	for _, name := range []string{"cache.Get", "ReverseProxy.fetch", "WriteResponse"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, root.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+		}
+	}
+	assert.Contains(t, spans["cache.Get"].Attributes(), cacheHitKey.Bool(false))
+
+	fetch := spans["ReverseProxy.fetch"]
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+fetch.SpanContext().SpanID().String()+"-01", traceparent)
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWarmConcurrency is the number of URLs warmed at the same time,
+	// unless set otherwise
+	DefaultWarmConcurrency = 4
+	maxWarmConcurrency     = 64
+	// maxWarmURLs bounds the URLs of a warm, sitemaps included
+	maxWarmURLs = 100000
+	// maxReportedFailures bounds the failures listed in a warm report
+	maxReportedFailures = 100
+	warmerUserAgent     = "caeche-warmer"
+)
+
+// ErrWarmRunning is returned when starting a warm while another one runs.
+var ErrWarmRunning = errors.New("a warm is already running")
+
+// WarmRequest lists the URLs to fetch through the proxy so that they're cached
+// before the clients request them. The URLs of the sitemaps are added to them.
+type WarmRequest struct {
+	URLs     []string `json:"urls"`
+	Sitemaps []string `json:"sitemaps"`
+	// Concurrency is the number of URLs fetched at the same time
+	Concurrency int `json:"concurrency"`
+	// Rate is the maximum number of URLs fetched per second, 0 meaning unlimited
+	Rate float64 `json:"rate"`
+}
+
+// WarmReport sums up a warm, as it runs.
+type WarmReport struct {
+	Running   bool          `json:"running"`
+	Started   time.Time     `json:"started"`
+	Duration  float64       `json:"duration"`
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Failures  []WarmFailure `json:"failures"`
+}
+
+// WarmFailure tells why an URL couldn't be warmed: the status code of its
+// response, or the error preventing to fetch it.
+type WarmFailure struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// warmer warms the cache through the handler of the reverse proxy, one warm at
+// a time.
+type warmer struct {
+	mutex  sync.Mutex
+	report WarmReport
+	cancel context.CancelFunc
+	client *http.Client
+}
+
+func newWarmer() *warmer {
+	return &warmer{client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// start starts warming the URLs of the request in the background, until done
+// or stopped.
+func (warmer *warmer) start(handler http.Handler, warmRequest WarmRequest) error {
+	warmer.mutex.Lock()
+	defer warmer.mutex.Unlock()
+	if warmer.report.Running {
+		return ErrWarmRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	warmer.cancel = cancel
+	warmer.report = WarmReport{Running: true, Started: time.Now().UTC()}
+	go warmer.run(ctx, handler, warmRequest)
+	return nil
+}
+
+// stop stops the running warm, if any, once the URLs being fetched are done.
+func (warmer *warmer) stop() {
+	warmer.mutex.Lock()
+	defer warmer.mutex.Unlock()
+	if warmer.cancel != nil {
+		warmer.cancel()
+	}
+}
+
+// status returns the report of the current or last warm.
+func (warmer *warmer) status() WarmReport {
+	warmer.mutex.Lock()
+	defer warmer.mutex.Unlock()
+	report := warmer.report
+	report.Failures = append([]WarmFailure(nil), warmer.report.Failures...)
+	if report.Running {
+		report.Duration = time.Since(report.Started).Seconds()
+	}
+	return report
+}
+
+func (warmer *warmer) run(ctx context.Context, handler http.Handler, warmRequest WarmRequest) {
+	urls := warmRequest.URLs
+	for _, sitemap := range warmRequest.Sitemaps {
+		sitemapURLs, err := warmer.readSitemap(ctx, sitemap, 1)
+		if err != nil {
+			log.Errorf("Reading sitemap %s : %s", sitemap, err)
+			warmer.record(WarmFailure{URL: sitemap, Error: err.Error()})
+		}
+		urls = append(urls, sitemapURLs...)
+	}
+	if len(urls) > maxWarmURLs {
+		log.Warnf("Warming the first %d URLs out of %d", maxWarmURLs, len(urls))
+		urls = urls[:maxWarmURLs]
+	}
+	log.Infof("Warming %d URLs", len(urls))
+
+	concurrency := warmRequest.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWarmConcurrency
+	} else if concurrency > maxWarmConcurrency {
+		concurrency = maxWarmConcurrency
+	}
+	var ticker *time.Ticker
+	if warmRequest.Rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / warmRequest.Rate))
+		defer ticker.Stop()
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rawURL := range queue {
+				warmer.record(warmURL(ctx, handler, rawURL))
+			}
+		}()
+	}
+	for _, rawURL := range urls {
+		if ticker != nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- rawURL
+	}
+	close(queue)
+	wg.Wait()
+
+	warmer.mutex.Lock()
+	defer warmer.mutex.Unlock()
+	warmer.cancel()
+	warmer.cancel = nil
+	warmer.report.Running = false
+	warmer.report.Duration = time.Since(warmer.report.Started).Seconds()
+	log.Infof("Warmed %d URLs, %d failed, in %.1fs", warmer.report.Succeeded, warmer.report.Failed, warmer.report.Duration)
+}
+
+// record counts the outcome of the warm of an URL, an empty failure meaning a
+// success.
+func (warmer *warmer) record(failure WarmFailure) {
+	warmer.mutex.Lock()
+	defer warmer.mutex.Unlock()
+	warmer.report.Total++
+	if failure.StatusCode == 0 && failure.Error == "" {
+		warmer.report.Succeeded++
+		return
+	}
+	warmer.report.Failed++
+	if len(warmer.report.Failures) < maxReportedFailures {
+		warmer.report.Failures = append(warmer.report.Failures, failure)
+	}
+}
+
+// warmURL requests the URL through the handler of the reverse proxy, as a
+// client would, the route being matched against its host.
+func warmURL(ctx context.Context, handler http.Handler, rawURL string) WarmFailure {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return WarmFailure{URL: rawURL, Error: err.Error()}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.RequestURI(), nil)
+	if err != nil {
+		return WarmFailure{URL: rawURL, Error: err.Error()}
+	}
+	req.Host = target.Host
+	req.RequestURI = target.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", warmerUserAgent)
+	req.Header.Set("Accept-Encoding", "br, zstd, gzip")
+
+	rw := &discardResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(rw, req)
+	if rw.statusCode >= http.StatusBadRequest {
+		return WarmFailure{URL: rawURL, StatusCode: rw.statusCode}
+	}
+	return WarmFailure{}
+}
+
+// discardResponseWriter discards the responses of the warmed URLs, keeping
+// their status code.
+type discardResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (rw *discardResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *discardResponseWriter) WriteHeader(statusCode int) {
+	if rw.statusCode == 0 {
+		rw.statusCode = statusCode
+	}
+}
+
+func (rw *discardResponseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return len(data), nil
+}
+
+func (rw *discardResponseWriter) Flush() {}
+
+// readSitemap returns the URLs of the sitemap, following the sitemaps of a
+// sitemap index up to depth.
+func (warmer *warmer) readSitemap(ctx context.Context, sitemap string, depth int) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemap, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", warmerUserAgent)
+	res, err := warmer.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+	urls, sitemaps, err := ReadURLs(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, nested := range sitemaps {
+		if depth <= 0 {
+			return urls, fmt.Errorf("sitemap %s nested too deep", nested)
+		}
+		nestedURLs, err := warmer.readSitemap(ctx, nested, depth-1)
+		if err != nil {
+			return urls, fmt.Errorf("sitemap %s: %w", nested, err)
+		}
+		urls = append(urls, nestedURLs...)
+	}
+	return urls, nil
+}
+
+// sitemap is either the urlset of a sitemap, or the sitemaps of a sitemap
+// index (https://www.sitemaps.org/protocol.html).
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// ReadURLs reads the URLs of a sitemap, possibly gzipped, or of a list of one
+// URL per line, "#" starting comments. It returns the sitemaps of a sitemap
+// index apart.
+func ReadURLs(reader io.Reader) ([]string, []string, error) {
+	buffered := bufio.NewReader(reader)
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		decoder, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer decoder.Close()
+		buffered = bufio.NewReader(decoder)
+	}
+	if isXML(buffered) {
+		var parsed sitemap
+		if err := xml.NewDecoder(buffered).Decode(&parsed); err != nil {
+			return nil, nil, fmt.Errorf("invalid sitemap: %w", err)
+		}
+		var urls, sitemaps []string
+		for _, entry := range parsed.URLs {
+			urls = append(urls, strings.TrimSpace(entry.Loc))
+		}
+		for _, entry := range parsed.Sitemaps {
+			sitemaps = append(sitemaps, strings.TrimSpace(entry.Loc))
+		}
+		return urls, sitemaps, nil
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(buffered)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, nil, scanner.Err()
+}
+
+// isXML tells if the next non-blank character of the reader opens an XML tag.
+func isXML(reader *bufio.Reader) bool {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch next[0] {
+		case ' ', '\t', '\r', '\n', 0xef, 0xbb, 0xbf:
+			// Blanks and byte order mark
+			_, _ = reader.ReadByte()
+		default:
+			return next[0] == '<'
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadURLs(t *testing.T) {
+	urls, sitemaps, err := ReadURLs(strings.NewReader("# Home\nhttp://example.com/\n\n  http://example.com/about  \n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://example.com/", "http://example.com/about"}, urls)
+	assert.Empty(t, sitemaps)
+
+	urls, sitemaps, err = ReadURLs(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://example.com/</loc><priority>1.0</priority></url>
+  <url><loc> http://example.com/about </loc></url>
+</urlset>`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://example.com/", "http://example.com/about"}, urls)
+	assert.Empty(t, sitemaps)
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>http://example.com/sitemap-1.xml</loc></sitemap>
+</sitemapindex>`))
+	writer.Close()
+	urls, sitemaps, err = ReadURLs(&gzipped)
+	assert.NoError(t, err)
+	assert.Empty(t, urls)
+	assert.Equal(t, []string{"http://example.com/sitemap-1.xml"}, sitemaps)
+
+	_, _, err = ReadURLs(strings.NewReader("<urlset><url>"))
+	assert.Error(t, err)
+}
+
+func TestWarmFillsTheCache(t *testing.T) {
+	var running, maxRunning int32
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if req.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		rw.Write([]byte("body"))
+	}))
+	var urls []string
+	for i := 0; i < 10; i++ {
+		urls = append(urls, "http://example.com/page/"+string(rune('a'+i)))
+	}
+	urls = append(urls, "http://example.com/missing", "://invalid")
+
+	warmer := newWarmer()
+	assert.NoError(t, warmer.start(reverseProxy.GetHandler(), WarmRequest{URLs: urls, Concurrency: 2}))
+	assert.ErrorIs(t, warmer.start(reverseProxy.GetHandler(), WarmRequest{URLs: urls}), ErrWarmRunning)
+	report := waitForWarm(t, warmer)
+
+	assert.Equal(t, 12, report.Total)
+	assert.Equal(t, 10, report.Succeeded)
+	assert.Equal(t, 2, report.Failed)
+	assert.Len(t, report.Failures, 2)
+	assert.Contains(t, report.Failures, WarmFailure{URL: "http://example.com/missing", StatusCode: http.StatusNotFound})
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(2))
+
+	recorder := serve(reverseProxy.GetHandler(), httptest.NewRequest(http.MethodGet, "http://example.com/page/a", nil))
+	assert.Contains(t, recorder.Header().Get("Cache-Status"), "hit")
+	assert.Equal(t, "body", recorder.Body.String())
+}
+
+func TestWarmRateLimitAndSitemap(t *testing.T) {
+	reverseProxy, _ := newTestReverseProxy(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("body"))
+	}))
+	var sitemapServer *httptest.Server
+	sitemapServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/sitemap_index.xml":
+			rw.Write([]byte(`<sitemapindex><sitemap><loc>` + sitemapServer.URL + `/sitemap.xml</loc></sitemap></sitemapindex>`))
+		case "/sitemap.xml":
+			rw.Write([]byte(`<urlset><url><loc>http://example.com/a</loc></url><url><loc>http://example.com/b</loc></url><url><loc>http://example.com/c</loc></url></urlset>`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(sitemapServer.Close)
+
+	warmer := newWarmer()
+	start := time.Now()
+	assert.NoError(t, warmer.start(reverseProxy.GetHandler(), WarmRequest{
+		Sitemaps: []string{sitemapServer.URL + "/sitemap_index.xml", sitemapServer.URL + "/gone.xml"},
+		Rate:     20,
+	}))
+	report := waitForWarm(t, warmer)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	assert.Equal(t, 3, report.Succeeded)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, sitemapServer.URL+"/gone.xml", report.Failures[0].URL)
+}
+
+func waitForWarm(t *testing.T, warmer *warmer) WarmReport {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if report := warmer.status(); !report.Running {
+			return report
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Warm still running")
+	return WarmReport{}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sdelicata/caeche/cache"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const snapshotUsage = `Usage: caeche snapshot [flags] save|load <file>
+
+save writes a snapshot of the cache of the running proxy to the file, and load
+restores the responses of the snapshot in it, "-" meaning stdout or stdin.
+
+Flags:
+`
+
+// runSnapshot saves or loads a snapshot of the cache of the running proxy,
+// through its admin API.
+func runSnapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), snapshotUsage)
+		flags.PrintDefaults()
+	}
+	client := newAdminClient(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expecting save or load, and a file")
+	}
+	action, path := flags.Arg(0), flags.Arg(1)
+
+	switch action {
+	case "save":
+		res, err := client.do(http.MethodGet, "/snapshot", nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		output, err := openOutput(path)
+		if err != nil {
+			return err
+		}
+		written, err := io.Copy(output, res.Body)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		log.Infof("Saved a snapshot of %d bytes to %s", written, path)
+	case "load":
+		input, err := openInput(path)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		res, err := client.do(http.MethodPut, "/snapshot", input)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		var result struct {
+			Restored int `json:"restored"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			return err
+		}
+		log.Infof("Restored %d responses from %s", result.Restored, path)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown snapshot action %q", action)
+	}
+	return nil
+}
+
+// restoreSnapshot loads the snapshot file in the cache at startup or, when
+// handed the listeners by a previous process, in the background once the
+// latter has saved it, closing pipe. The requests are served meanwhile.
+func restoreSnapshot(path string, responseCache cache.Cache, pipe *os.File) {
+	if pipe == nil {
+		loadSnapshot(path, responseCache)
+		return
+	}
+	go func() {
+		defer pipe.Close()
+		log.Infof("Waiting for the previous process to save the snapshot %s", path)
+		_, _ = io.Copy(ioutil.Discard, pipe)
+		loadSnapshot(path, responseCache)
+	}()
+}
+
+// loadSnapshot restores the responses of the snapshot file in the cache, if
+// the file exists and the cache can be restored.
+func loadSnapshot(path string, responseCache cache.Cache) {
+	restorer, ok := responseCache.(cache.Restorer)
+	if !ok {
+		log.Warnf("The cache can't be restored from the snapshot %s", path)
+		return
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Error loading snapshot : %s", err)
+		return
+	}
+	defer file.Close()
+	restored, err := cache.ReadSnapshot(file, restorer)
+	if err != nil {
+		log.Errorf("Error loading snapshot %s, after %d responses : %s", path, restored, err)
+		return
+	}
+	log.Infof("Restored %d responses from the snapshot %s", restored, path)
+}
+
+// saveSnapshot writes a snapshot of the cache to the file, replacing the
+// previous one only once complete.
+func saveSnapshot(path string, responseCache cache.Cache) {
+	inspector, ok := responseCache.(cache.Inspector)
+	if _, restorable := responseCache.(cache.Restorer); !ok || !restorable {
+		return
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		log.Errorf("Error saving snapshot : %s", err)
+		return
+	}
+	written, err := cache.WriteSnapshot(file, inspector)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		log.Errorf("Error saving snapshot : %s", err)
+		return
+	}
+	log.Infof("Saved %d responses to the snapshot %s", written, path)
+}
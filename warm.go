@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sdelicata/caeche/server"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const warmUsage = `Usage: caeche warm [flags] <file|sitemap URL>
+
+warm fetches the URLs of the file, one per line or a sitemap, or of the sitemap
+at the URL through the running proxy, so that they're cached. "-" reads the
+file from stdin.
+
+Flags:
+`
+
+// runWarm starts warming the cache of the running proxy through its admin
+// API, and waits for the warm to report its successes and failures.
+func runWarm(args []string) error {
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), warmUsage)
+		flags.PrintDefaults()
+	}
+	client := newAdminClient(flags)
+	concurrency := flags.Int("concurrency", server.DefaultWarmConcurrency, "number of URLs fetched at the same time")
+	rate := flags.Float64("rate", 0, "maximum number of URLs fetched per second, 0 meaning unlimited")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expecting a file or a sitemap URL")
+	}
+	source := flags.Arg(0)
+
+	warmRequest := server.WarmRequest{Concurrency: *concurrency, Rate: *rate}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		warmRequest.Sitemaps = []string{source}
+	} else {
+		input, err := openInput(source)
+		if err != nil {
+			return err
+		}
+		urls, sitemaps, err := server.ReadURLs(input)
+		input.Close()
+		if err != nil {
+			return err
+		}
+		warmRequest.URLs, warmRequest.Sitemaps = urls, sitemaps
+	}
+	body, err := json.Marshal(warmRequest)
+	if err != nil {
+		return err
+	}
+	res, err := client.do(http.MethodPost, "/warm", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	log.Infof("Warming the cache with %d URLs and %d sitemaps", len(warmRequest.URLs), len(warmRequest.Sitemaps))
+
+	var report server.WarmReport
+	for {
+		time.Sleep(time.Second)
+		res, err := client.do(http.MethodGet, "/warm", nil)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(res.Body).Decode(&report)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if !report.Running {
+			break
+		}
+		log.Infof("Warmed %d URLs, %d failed", report.Succeeded, report.Failed)
+	}
+
+	for _, failure := range report.Failures {
+		if failure.Error != "" {
+			log.Errorf("Error warming %s : %s", failure.URL, failure.Error)
+		} else {
+			log.Errorf("Error warming %s : status %d", failure.URL, failure.StatusCode)
+		}
+	}
+	log.Infof("Warmed %d URLs, %d failed, in %.1fs", report.Succeeded, report.Failed, report.Duration)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d URLs failed", report.Failed)
+	}
+	return nil
+}